@@ -3,6 +3,7 @@ package main
 import (
 	"effective-invention/server"
 	"log"
+	"os"
 
 	"github.com/joho/godotenv"
 )
@@ -12,5 +13,17 @@ func main() {
 	if err != nil {
 		log.Fatal("Error loading .env file")
 	}
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "rotate-keys":
+			server.RotateKeys()
+		case "reconcile":
+			server.Reconcile(os.Args[2:])
+		default:
+			log.Fatalf("Unknown command %q, the commands are rotate-keys and reconcile", os.Args[1])
+		}
+		return
+	}
 	server.ServeGin()
 }
@@ -0,0 +1,69 @@
+package amazonwebservices
+
+import (
+	"effective-invention/server/amazonwebservices/database"
+	"effective-invention/server/outbox"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HandleListOutboxJobs lists outbox jobs by ?status=, dead ones by default.
+func HandleListOutboxJobs(ob *outbox.Outbox) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		status := c.DefaultQuery("status", database.OutboxDead)
+		switch status {
+		case database.OutboxPending, database.OutboxSending, database.OutboxSent, database.OutboxDead:
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "status must be pending, sending, sent or dead"})
+			return
+		}
+
+		jobs, err := ob.Jobs().ListJobs(c.Request.Context(), status)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving outbox jobs."})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message": "outbox jobs found",
+			"jobs":    jobs,
+		})
+	}
+}
+
+func HandleGetOutboxJob(ob *outbox.Outbox) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		job, err := ob.Jobs().GetJob(c.Request.Context(), c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if job == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"job": job})
+	}
+}
+
+// HandleReplayOutboxJob puts a dead job back in the queue.
+func HandleReplayOutboxJob(ob *outbox.Outbox) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		job, err := ob.Replay(c.Request.Context(), c.Param("id"))
+		if errors.Is(err, database.ErrJobNotReplayable) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Only dead jobs can be replayed", "job": job})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if job == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Job queued for delivery", "job": job})
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt"
@@ -19,28 +20,19 @@ func HashedPassword(password string) (string, error) {
 		return "", err
 	}
 
-	// Diagnostic Log (Remove in production!)
-	// fmt.Printf("LOG: Generated hash for input: %s\n", password)
-
 	return string(hashBytes), nil
 }
 
 func CheckPasswordHash(password, hash string) bool {
 	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
-
-	if err != nil {
-		// This log will tell you EXACTLY why it failed
-		// e.g., "crypto/bcrypt: hashedPassword is not the hash of the given password"
-		fmt.Printf("LOG: Password check failed: %v\n", err)
-		fmt.Printf("LOG: Attempted with hash: %s and password: %s\n", hash, password)
-		return false
-	}
-
-	fmt.Println("LOG: Password check successful")
-	return true
+	return err == nil
 }
 
 var (
+	// adminEmails are granted the admin role on login (ADMIN_EMAILS, comma
+	// separated), in addition to the roles stored on the user.
+	adminEmails map[string]bool
+
 	AccessTokenSecret  string
 	RefreshTokenSecret string
 	AccessTokenTTL     = time.Minute * 15
@@ -60,12 +52,35 @@ func InitAuth() {
 	if AccessTokenSecret == "" || RefreshTokenSecret == "" {
 		log.Fatal("TOKEN_SECRET or REFRESH_TOKEN_SECRET is missing")
 	}
+
+	mfaSecret := os.Getenv("MFA_ENCRYPTION_KEY")
+	if mfaSecret == "" {
+		log.Println("MFA_ENCRYPTION_KEY not set, encrypting TOTP secrets with TOKEN_SECRET")
+		mfaSecret = AccessTokenSecret
+	}
+	mfaKey = deriveMFAKey(mfaSecret)
+
+	adminEmails = map[string]bool{}
+	for _, email := range strings.Split(os.Getenv("ADMIN_EMAILS"), ",") {
+		if email = strings.TrimSpace(email); email != "" {
+			adminEmails[strings.ToLower(email)] = true
+		}
+	}
 }
 
 type UserClaims struct {
-	ID    string `json:"id"`
-	Name  string `json:"name"`
-	Email string `json:"email"`
+	ID      string   `json:"id"`
+	Name    string   `json:"name"`
+	Email   string   `json:"email"`
+	Roles   []string `json:"roles,omitempty"`
+	Session string   `json:"sid,omitempty"` // refresh token family
+	jwt.StandardClaims
+}
+
+// RefreshClaims identify one refresh token (Id) within a login session
+// (Family). The user ID is carried in Subject.
+type RefreshClaims struct {
+	Family string `json:"fam"`
 	jwt.StandardClaims
 }
 
@@ -74,12 +89,26 @@ func NewAccessToken(claims UserClaims) (string, error) {
 	return accessToken.SignedString([]byte(AccessTokenSecret))
 }
 
-func NewRefreshToken(claims jwt.StandardClaims) (string, error) {
+func NewRefreshToken(claims RefreshClaims) (string, error) {
 	refreshToken := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	return refreshToken.SignedString([]byte(RefreshTokenSecret))
 }
 
-func ParseAccessToken(accessToken string) *UserClaims {
+// VerifyAccessToken validates the signature and expiry of an access token
+// and returns its claims. Tokens issued for a single purpose, such as the
+// MFA pending token, carry an audience and are not access tokens.
+func VerifyAccessToken(accessToken string) (*UserClaims, error) {
+	claims, err := parseUserClaims(accessToken)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Audience != "" {
+		return nil, fmt.Errorf("token is not an access token")
+	}
+	return claims, nil
+}
+
+func parseUserClaims(accessToken string) (*UserClaims, error) {
 	parsedAccessToken, err := jwt.ParseWithClaims(accessToken, &UserClaims{}, func(token *jwt.Token) (interface{}, error) {
 		// Ensure correct signing method
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
@@ -87,22 +116,32 @@ func ParseAccessToken(accessToken string) *UserClaims {
 		}
 		return []byte(AccessTokenSecret), nil
 	})
-	if err != nil || !parsedAccessToken.Valid {
-		fmt.Println("Token verification failed:", err) // Debugging output
-		return nil
+	if err != nil {
+		return nil, err
+	}
+	if !parsedAccessToken.Valid {
+		return nil, fmt.Errorf("token is not valid")
 	}
 
 	claims, ok := parsedAccessToken.Claims.(*UserClaims)
 	if !ok {
-		fmt.Println("Failed to cast token claims")
-		return nil
+		return nil, fmt.Errorf("failed to cast token claims")
 	}
 
+	return claims, nil
+}
+
+func ParseAccessToken(accessToken string) *UserClaims {
+	claims, err := VerifyAccessToken(accessToken)
+	if err != nil {
+		fmt.Println("Token verification failed:", err) // Debugging output
+		return nil
+	}
 	return claims
 }
 
-func ParseRefreshToken(refreshToken string) *jwt.StandardClaims {
-	parsedRefreshToken, err := jwt.ParseWithClaims(refreshToken, &jwt.StandardClaims{}, func(token *jwt.Token) (interface{}, error) {
+func ParseRefreshToken(refreshToken string) *RefreshClaims {
+	parsedRefreshToken, err := jwt.ParseWithClaims(refreshToken, &RefreshClaims{}, func(token *jwt.Token) (interface{}, error) {
 		// Ensure correct signing method
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
@@ -114,7 +153,7 @@ func ParseRefreshToken(refreshToken string) *jwt.StandardClaims {
 		return nil
 	}
 
-	claims, ok := parsedRefreshToken.Claims.(*jwt.StandardClaims)
+	claims, ok := parsedRefreshToken.Claims.(*RefreshClaims)
 	if !ok {
 		fmt.Println("Failed to cast refresh token claims")
 		return nil
@@ -0,0 +1,172 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const realm = "effective-invention"
+
+const principalKey = "auth.principal"
+
+// Principal is the authenticated caller, stored on the Gin context by
+// Middleware.
+type Principal struct {
+	UserID    string   `json:"userId"`
+	Name      string   `json:"name"`
+	Email     string   `json:"email"`
+	Roles     []string `json:"roles"`
+	TokenID   string   `json:"tokenId"`
+	SessionID string   `json:"sessionId"`
+}
+
+func (p *Principal) HasRole(role string) bool {
+	for _, r := range p.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+func principalFromClaims(claims *UserClaims) *Principal {
+	return &Principal{
+		UserID:    claims.ID,
+		Name:      claims.Name,
+		Email:     claims.Email,
+		Roles:     claims.Roles,
+		TokenID:   claims.Id,
+		SessionID: claims.Session,
+	}
+}
+
+// Authenticate verifies a raw access token, checks it has not been revoked
+// and returns its principal.
+func Authenticate(ctx context.Context, accessToken string) (*Principal, error) {
+	claims, err := VerifyAccessToken(accessToken)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	revoked, err := isRevoked(ctx, claims.ID, claims.Session, claims.Id, claims.IssuedAt)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, ErrTokenRevoked
+	}
+	return principalFromClaims(claims), nil
+}
+
+// BearerToken extracts the token from an "Authorization: Bearer <token>" header.
+func BearerToken(r *http.Request) (string, bool) {
+	authHeader := r.Header.Get("Authorization")
+	token, found := strings.CutPrefix(authHeader, "Bearer ")
+	if !found || token == "" {
+		return "", false
+	}
+	return token, true
+}
+
+func unauthorized(c *gin.Context, code, description string) {
+	challenge := fmt.Sprintf("Bearer realm=%q", realm)
+	if code != "" {
+		challenge += fmt.Sprintf(", error=%q, error_description=%q", code, description)
+	}
+	c.Header("WWW-Authenticate", challenge)
+	c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": description})
+}
+
+func forbidden(c *gin.Context, description string) {
+	c.Header("WWW-Authenticate", fmt.Sprintf("Bearer realm=%q, error=\"insufficient_scope\", error_description=%q", realm, description))
+	c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": description})
+}
+
+func matchesRoute(pattern, route string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return strings.HasPrefix(route, prefix)
+	}
+	return pattern == route
+}
+
+// Middleware requires a valid access token on every route of the group it is
+// attached to, except for the listed public routes. Routes are matched
+// against the registered path (c.FullPath()), and a trailing "*" matches a
+// prefix, e.g. "/public/*".
+func Middleware(publicRoutes ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		route := c.FullPath()
+		for _, pattern := range publicRoutes {
+			if matchesRoute(pattern, route) {
+				c.Next()
+				return
+			}
+		}
+
+		token, ok := BearerToken(c.Request)
+		if !ok {
+			unauthorized(c, "", "Authorization bearer token required")
+			return
+		}
+
+		principal, err := Authenticate(c.Request.Context(), token)
+		if errors.Is(err, ErrTokenRevoked) {
+			unauthorized(c, "invalid_token", "Access token has been revoked")
+			return
+		}
+		if errors.Is(err, ErrInvalidToken) {
+			unauthorized(c, "invalid_token", "Access token is invalid or expired")
+			return
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Error checking access token"})
+			return
+		}
+
+		c.Set(principalKey, principal)
+		c.Next()
+	}
+}
+
+// RequireRole rejects authenticated callers that hold none of the roles.
+// It must run after Middleware.
+func RequireRole(roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		principal, ok := CurrentPrincipal(c)
+		if !ok {
+			unauthorized(c, "", "Authorization bearer token required")
+			return
+		}
+		for _, role := range roles {
+			if principal.HasRole(role) {
+				c.Next()
+				return
+			}
+		}
+		forbidden(c, "Insufficient permissions")
+	}
+}
+
+// CurrentPrincipal returns the caller set by Middleware, if any.
+func CurrentPrincipal(c *gin.Context) (*Principal, bool) {
+	v, ok := c.Get(principalKey)
+	if !ok {
+		return nil, false
+	}
+	principal, ok := v.(*Principal)
+	return principal, ok
+}
+
+// MustPrincipal returns the caller set by Middleware and panics when the
+// route was not protected by it.
+func MustPrincipal(c *gin.Context) *Principal {
+	principal, ok := CurrentPrincipal(c)
+	if !ok {
+		panic("auth: no principal on context, is the route behind auth.Middleware?")
+	}
+	return principal
+}
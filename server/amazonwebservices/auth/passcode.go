@@ -1,48 +1,237 @@
 package auth
 
 import (
-	"bufio"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"effective-invention/server/amazonwebservices/database"
+	"encoding/base32"
+	"encoding/base64"
+	"errors"
 	"fmt"
-	"os"
+	"io"
+	"strings"
 	"time"
 
-	"github.com/mdp/qrterminal/v3"
+	"github.com/golang-jwt/jwt"
 	"github.com/skip2/go-qrcode"
 	"github.com/xlzd/gotp"
+	"golang.org/x/crypto/bcrypt"
 )
 
-var randomSecret string = gotp.RandomSecret(16)
+const (
+	TOTPIssuer         = "effective-invention"
+	totpPeriod         = 30
+	recoveryCodeCount  = 10
+	mfaPendingAudience = "mfa_pending"
+	MFAPendingTTL      = 5 * time.Minute
+	maxMFAAttempts     = 5
+	CodeAttemptWindow  = 15 * time.Minute
+)
+
+var (
+	ErrTooManyAttempts = errors.New("too many invalid codes")
+	ErrMFATokenUsed    = errors.New("MFA token was already used")
+)
+
+// mfaKey encrypts TOTP secrets at rest. It is derived from
+// MFA_ENCRYPTION_KEY in InitAuth.
+var mfaKey []byte
+
+func NewTOTPSecret() (string, error) {
+	secret := gotp.RandomSecret(20)
+	if secret == "" {
+		return "", fmt.Errorf("failed to generate TOTP secret")
+	}
+	return secret, nil
+}
+
+func TOTPProvisioningURI(secret, account string) string {
+	return gotp.NewDefaultTOTP(secret).ProvisioningUri(account, TOTPIssuer)
+}
+
+// TOTPQRCode renders the provisioning URI as a PNG for authenticator apps.
+func TOTPQRCode(uri string) ([]byte, error) {
+	return qrcode.Encode(uri, qrcode.Medium, 256)
+}
+
+// VerifyTOTP checks code against the current time step and one step either
+// side for clock drift. It returns the matched step so callers can refuse to
+// accept the same code twice; steps at or before lastStep are rejected.
+func VerifyTOTP(secret, code string, lastStep int64) (int64, bool) {
+	code = strings.TrimSpace(code)
+	totp := gotp.NewDefaultTOTP(secret)
+	now := time.Now().Unix() / totpPeriod
 
-func generateTOTPWithSecret(randomSecret string) {
-	uri := gotp.NewDefaultTOTP(randomSecret).ProvisioningUri("user@email.com", "myApp")
-	fmt.Println("Secret Key URI:", uri)
+	for _, step := range []int64{now - 1, now, now + 1} {
+		if step <= lastStep {
+			continue
+		}
+		expected := totp.At(step * totpPeriod)
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func mfaCipher() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(mfaKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
 
-	qrcode.WriteFile(uri, qrcode.Medium, 256, "qr.png")
+// EncryptSecret seals a TOTP secret with AES-GCM for storage on the user.
+func EncryptSecret(secret string) (string, error) {
+	gcm, err := mfaCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(secret), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
 
-	// Generate and display QR code in the terminal
-	qrterminal.GenerateWithConfig(uri, qrterminal.Config{
-		Level:     qrterminal.L,
-		Writer:    os.Stdout,
-		BlackChar: qrterminal.BLACK,
-		WhiteChar: qrterminal.WHITE,
+func DecryptSecret(encrypted string) (string, error) {
+	gcm, err := mfaCipher()
+	if err != nil {
+		return "", err
+	}
+	data, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		return "", err
+	}
+	if len(data) < gcm.NonceSize() {
+		return "", fmt.Errorf("encrypted secret is too short")
+	}
+	plain, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt secret: %w", err)
+	}
+	return string(plain), nil
+}
+
+// NewRecoveryCodes returns the codes to show the user once, and the bcrypt
+// hashes to store.
+func NewRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+	encoder := base32.StdEncoding.WithPadding(base32.NoPadding)
+
+	for range recoveryCodeCount {
+		raw := make([]byte, 5)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(encoder.EncodeToString(raw))
+		code = code[:4] + "-" + code[4:]
+
+		hash, err := bcrypt.GenerateFromPassword([]byte(code), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, nil, err
+		}
+		codes = append(codes, code)
+		hashes = append(hashes, string(hash))
+	}
+	return codes, hashes, nil
+}
+
+// FindRecoveryCode returns the index of the stored hash matching code, or
+// -1 when none does.
+func FindRecoveryCode(hashes []string, code string) int {
+	code = strings.ToLower(strings.TrimSpace(code))
+	for i, hash := range hashes {
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(code)) == nil {
+			return i
+		}
+	}
+	return -1
+}
+
+// NewMFAPendingToken is handed out by the password step of a login when the
+// user has two-factor enabled. It only works with VerifyMFAPendingToken and
+// is rejected everywhere an access token is expected.
+func NewMFAPendingToken(userID string) (string, error) {
+	id, err := newTokenID()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	return NewAccessToken(UserClaims{
+		ID: userID,
+		StandardClaims: jwt.StandardClaims{
+			Id:        id,
+			Audience:  mfaPendingAudience,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(MFAPendingTTL).Unix(),
+		},
 	})
+}
 
-	fmt.Println("\nScan the QR code with your authenticator app")
+func VerifyMFAPendingToken(token string) (*UserClaims, error) {
+	claims, err := parseUserClaims(token)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Audience != mfaPendingAudience {
+		return nil, fmt.Errorf("not an MFA token")
+	}
+	return claims, nil
 }
 
-func verifyOTP(randomSecret string) {
-	totp := gotp.NewDefaultTOTP(randomSecret)
+// CountMFAAttempt counts an attempt at a code for a pending token, so a five
+// minute token cannot be used to brute force the six digit code. It is
+// counted before the code is checked, so guesses sent in parallel count
+// too, and kept with the token records, so every server sees it.
+func CountMFAAttempt(ctx context.Context, claims *UserClaims) error {
+	if tokens == nil {
+		return ErrSessionsDisabled
+	}
+	record, ok, err := tokens.CountAttempt(ctx, mfaAttemptsKey(claims.Id), maxMFAAttempts, claims.ExpiresAt)
+	if err != nil || ok {
+		return err
+	}
+	if record != nil && record.UsedAt != 0 {
+		return ErrMFATokenUsed
+	}
+	return ErrTooManyAttempts
+}
 
-	// Wait for user input of the OTP
-	fmt.Print("Enter the OTP from your authenticator app: ")
-	scanner := bufio.NewScanner(os.Stdin)
-	scanner.Scan()
-	userInput := scanner.Text()
+// CountCodeAttempt counts an attempt at a code outside of a login, such as
+// to turn two-factor off, allowing maxMFAAttempts per user every
+// CodeAttemptWindow.
+func CountCodeAttempt(ctx context.Context, userID string) error {
+	if tokens == nil {
+		return ErrSessionsDisabled
+	}
+	window := time.Now().Unix() / int64(CodeAttemptWindow.Seconds())
+	expires := (window + 1) * int64(CodeAttemptWindow.Seconds())
+	_, ok, err := tokens.CountAttempt(ctx, codeAttemptsKey(userID, window), maxMFAAttempts, expires)
+	if err == nil && !ok {
+		return ErrTooManyAttempts
+	}
+	return err
+}
 
-	// Validate the provided OTP
-	if totp.Verify(userInput, time.Now().Unix()) {
-		fmt.Println("Authentication successful! Access granted.")
-	} else {
-		fmt.Println("Authentication failed! Invalid OTP.")
+// ConsumeMFAToken marks a pending token as spent after a successful login.
+// It fails if another request got there first.
+func ConsumeMFAToken(ctx context.Context, claims *UserClaims) error {
+	record, err := tokens.ConsumeToken(ctx, mfaAttemptsKey(claims.Id))
+	if errors.Is(err, database.ErrTokenReused) || (err == nil && record == nil) {
+		return ErrMFATokenUsed
 	}
+	return err
+}
+
+func deriveMFAKey(secret string) []byte {
+	sum := sha256.Sum256([]byte(secret))
+	return sum[:]
 }
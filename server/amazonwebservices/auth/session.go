@@ -0,0 +1,252 @@
+package auth
+
+import (
+	"context"
+	"effective-invention/server/amazonwebservices/database"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/golang-jwt/jwt"
+)
+
+var (
+	ErrInvalidToken        = errors.New("access token is invalid or expired")
+	ErrInvalidRefreshToken = errors.New("refresh token is invalid or expired")
+	ErrRefreshTokenReused  = errors.New("refresh token was already used, session revoked")
+	ErrTokenRevoked        = errors.New("token has been revoked")
+	ErrSessionsDisabled    = errors.New("session storage is not configured")
+)
+
+// tokens holds refresh token state and revocations. Without it access
+// tokens are still verified, but refresh and logout are unavailable.
+var tokens database.TokenRepository
+
+func UseTokenRepository(repo database.TokenRepository) {
+	tokens = repo
+}
+
+func refreshKey(tokenID string) string { return "refresh#" + tokenID }
+func accessKey(tokenID string) string  { return "jti#" + tokenID }
+func familyKey(family string) string   { return "family#" + family }
+func userKey(userID string) string     { return "user#" + userID }
+func mfaAttemptsKey(tokenID string) string {
+	return "mfa#" + tokenID
+}
+
+// codeAttemptsKey counts a user's attempts at codes in one window of
+// CodeAttemptWindow, so each window starts afresh.
+func codeAttemptsKey(userID string, window int64) string {
+	return fmt.Sprintf("code#%s#%d", userID, window)
+}
+
+func newTokenID() (string, error) {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return "", err
+	}
+	return id.String(), nil
+}
+
+func rolesFor(user *database.User) []string {
+	roles := user.Roles
+	if adminEmails[strings.ToLower(user.Email)] && !slices.Contains(roles, "admin") {
+		roles = append(slices.Clone(roles), "admin")
+	}
+	return roles
+}
+
+type Session struct {
+	AccessToken  string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+}
+
+// IssueSession starts a new refresh token family for user.
+func IssueSession(ctx context.Context, user *database.User) (*Session, error) {
+	family, err := newTokenID()
+	if err != nil {
+		return nil, err
+	}
+	return issueSession(ctx, user, family)
+}
+
+func issueSession(ctx context.Context, user *database.User, family string) (*Session, error) {
+	now := time.Now()
+
+	accessId, err := newTokenID()
+	if err != nil {
+		return nil, err
+	}
+	accessToken, err := NewAccessToken(UserClaims{
+		ID:      user.ID,
+		Name:    user.Name,
+		Email:   user.Email,
+		Roles:   rolesFor(user),
+		Session: family,
+		StandardClaims: jwt.StandardClaims{
+			Id:        accessId,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(AccessTokenTTL).Unix(),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	refreshId, err := newTokenID()
+	if err != nil {
+		return nil, err
+	}
+	refreshClaims := RefreshClaims{
+		Family: family,
+		StandardClaims: jwt.StandardClaims{
+			Id:        refreshId,
+			Subject:   user.ID,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(RefreshTokenTTL).Unix(),
+		},
+	}
+	refreshToken, err := NewRefreshToken(refreshClaims)
+	if err != nil {
+		return nil, err
+	}
+
+	if tokens != nil {
+		err = tokens.SaveToken(ctx, database.TokenRecord{
+			ID:        refreshKey(refreshId),
+			Kind:      database.TokenKindRefresh,
+			UserID:    user.ID,
+			Family:    family,
+			ExpiresAt: refreshClaims.ExpiresAt,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &Session{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(AccessTokenTTL.Seconds()),
+	}, nil
+}
+
+// RefreshSession exchanges a refresh token for a new access token and a new
+// refresh token in the same family. Presenting a refresh token a second time
+// revokes the whole family, since one of the two callers must be an attacker.
+func RefreshSession(ctx context.Context, refreshToken string, users database.UserRepository) (*Session, error) {
+	if tokens == nil {
+		return nil, ErrSessionsDisabled
+	}
+
+	claims := ParseRefreshToken(refreshToken)
+	if claims == nil || claims.Id == "" || claims.Family == "" {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	record, err := tokens.ConsumeToken(ctx, refreshKey(claims.Id))
+	if errors.Is(err, database.ErrTokenReused) {
+		if err := revoke(ctx, familyKey(claims.Family), claims.Subject); err != nil {
+			return nil, err
+		}
+		return nil, ErrRefreshTokenReused
+	}
+	if err != nil {
+		return nil, err
+	}
+	if record == nil {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	revoked, err := isRevoked(ctx, claims.Subject, claims.Family, "", claims.IssuedAt)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, ErrTokenRevoked
+	}
+
+	user, err := users.GetUserById(ctx, claims.Subject)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	return issueSession(ctx, user, claims.Family)
+}
+
+func revoke(ctx context.Context, id, userID string) error {
+	now := time.Now()
+	return tokens.SaveToken(ctx, database.TokenRecord{
+		ID:        id,
+		Kind:      database.TokenKindRevocation,
+		UserID:    userID,
+		RevokedAt: now.Unix(),
+		// nothing issued before the revocation outlives a refresh token
+		ExpiresAt: now.Add(RefreshTokenTTL).Unix(),
+	})
+}
+
+// Logout revokes the caller's access token and the session it belongs to.
+func Logout(ctx context.Context, principal *Principal) error {
+	if tokens == nil {
+		return ErrSessionsDisabled
+	}
+	if err := revoke(ctx, accessKey(principal.TokenID), principal.UserID); err != nil {
+		return err
+	}
+	if principal.SessionID != "" {
+		return revoke(ctx, familyKey(principal.SessionID), principal.UserID)
+	}
+	return nil
+}
+
+// LogoutEverywhere revokes every token issued to the caller so far.
+func LogoutEverywhere(ctx context.Context, principal *Principal) error {
+	if tokens == nil {
+		return ErrSessionsDisabled
+	}
+	if err := revoke(ctx, userKey(principal.UserID), principal.UserID); err != nil {
+		return err
+	}
+	return Logout(ctx, principal)
+}
+
+// isRevoked checks the user, session and token revocations in one lookup.
+// Empty family or tokenID are skipped.
+func isRevoked(ctx context.Context, userID, family, tokenID string, issuedAt int64) (bool, error) {
+	if tokens == nil {
+		return false, nil
+	}
+
+	ids := []string{userKey(userID)}
+	if family != "" {
+		ids = append(ids, familyKey(family))
+	}
+	if tokenID != "" {
+		ids = append(ids, accessKey(tokenID))
+	}
+
+	records, err := tokens.GetTokens(ctx, ids...)
+	if err != nil {
+		return false, err
+	}
+	for _, record := range records {
+		if record.ID == userKey(userID) {
+			// logging out everywhere only affects tokens issued before it;
+			// IssuedAt is in whole seconds, so that includes its own second
+			if issuedAt <= record.RevokedAt {
+				return true, nil
+			}
+			continue
+		}
+		return true, nil
+	}
+	return false, nil
+}
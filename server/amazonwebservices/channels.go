@@ -0,0 +1,61 @@
+package amazonwebservices
+
+import (
+	"context"
+	"effective-invention/server/amazonwebservices/database"
+	"effective-invention/server/storage"
+	"errors"
+	"strings"
+	"time"
+)
+
+// ChannelPolicy authorizes websocket channel joins against the stored files
+// and shares. Channels are named "<kind>:<id>":
+//
+//	user:<userId>  the user's own channel
+//	file:<fileId>  a file the user owns
+//	share:<token>  a share the user created, or a usable link share, since
+//	               holding its token is what being shared a file means
+//
+// Face shares are only joinable by their creator, so the channel cannot be
+// used to learn about a file without passing the face check.
+type ChannelPolicy struct {
+	Files  database.FileRepository
+	Shares database.ShareRepository
+}
+
+func NewChannelPolicy(files database.FileRepository, shares database.ShareRepository) *ChannelPolicy {
+	return &ChannelPolicy{Files: files, Shares: shares}
+}
+
+func (p *ChannelPolicy) CanJoin(ctx context.Context, userId, channel string) (bool, error) {
+	kind, id, ok := strings.Cut(channel, ":")
+	if !ok || id == "" {
+		return false, nil
+	}
+
+	switch kind {
+	case "user":
+		return id == userId, nil
+
+	case "file":
+		_, err := ownedFile(ctx, p.Files, userId, id)
+		if errors.Is(err, storage.ErrNotFound) {
+			return false, nil
+		}
+		return err == nil, err
+
+	case "share":
+		share, err := p.Shares.GetShare(ctx, id)
+		if err != nil || share == nil {
+			return false, err
+		}
+		if share.CreatedBy == userId {
+			return true, nil
+		}
+		return share.Mode == database.ShareModeLink && share.Usable(time.Now().Unix()), nil
+
+	default:
+		return false, nil
+	}
+}
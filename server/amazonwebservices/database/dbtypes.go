@@ -1,17 +1,223 @@
 package database
 
+import "path"
+
 type User struct {
-	ID        string `json:"id" dynamodbav:"id"`
-	Name      string `json:"name" dynamodbav:"name"`
-	Email     string `json:"email" dynamodbav:"email"`
-	Password  string `json:"-" dynamodbav:"password"` // "-" hides password from JSON responses
-	CreatedAt int64  `json:"createdAt" dynamodbav:"createdAt"`
-	UpdatedAt int64  `json:"updatedAt" dynamodbav:"updatedAt"`
+	ID        string   `json:"id" dynamodbav:"id"`
+	Name      string   `json:"name" dynamodbav:"name"`
+	Email     string   `json:"email" dynamodbav:"email"`
+	Password  string   `json:"-" dynamodbav:"password"` // "-" hides password from JSON responses
+	Roles     []string `json:"roles,omitempty" dynamodbav:"roles,omitempty"`
+	CreatedAt int64    `json:"createdAt" dynamodbav:"createdAt"`
+	UpdatedAt int64    `json:"updatedAt" dynamodbav:"updatedAt"`
+	// LastSeenAt is when the user last connected or disconnected a websocket.
+	LastSeenAt int64 `json:"lastSeenAt,omitempty" dynamodbav:"lastSeenAt,omitempty"`
+
+	// Two-factor state. The secret is AES-GCM encrypted and recovery codes
+	// are bcrypt hashes; none of it leaves the server.
+	TOTPEnabled   bool     `json:"totpEnabled" dynamodbav:"totpEnabled"`
+	TOTPSecret    string   `json:"-" dynamodbav:"totpSecret,omitempty"`
+	TOTPLastStep  int64    `json:"-" dynamodbav:"totpLastStep"`
+	RecoveryCodes []string `json:"-" dynamodbav:"recoveryCodes,omitempty"`
 }
 
 type UserFile struct {
 	User      string `json:"user" dynamodbav:"user"` // partition key
 	ID        string `json:"id" dynamodbav:"id"`     // sort key
 	FileKey   string `json:"filekey" dynamodbav:"fileKey"`
+	Filename  string `json:"filename,omitempty" dynamodbav:"filename,omitempty"` // as uploaded
+	CreatedAt int64  `json:"createdAt" dynamodbav:"createdAt"`
+
+	Size        int64    `json:"size,omitempty" dynamodbav:"size,omitempty"`
+	ContentType string   `json:"contentType,omitempty" dynamodbav:"contentType,omitempty"` // sniffed on upload
+	SHA256      string   `json:"sha256,omitempty" dynamodbav:"sha256,omitempty"`
+	Description string   `json:"description,omitempty" dynamodbav:"description,omitempty"`
+	Tags        []string `json:"tags,omitempty" dynamodbav:"tags,omitempty"`
+
+	// Encryption is unset for files stored before content was encrypted
+	Encryption *FileEncryption `json:"encryption,omitempty" dynamodbav:"encryption,omitempty"`
+
+	// Version is the number of the current version, whose content the
+	// fields above describe. It is zero for files stored before versions,
+	// which have only the one.
+	Version int `json:"version,omitempty" dynamodbav:"version,omitempty"`
+
+	// DeletedAt is when the file was moved to the trash, or zero while it
+	// is not there. Trashed files are hidden until restored or purged.
+	DeletedAt int64 `json:"deletedAt,omitempty" dynamodbav:"deletedAt,omitempty"`
+}
+
+// Trashed reports whether the file is in the trash.
+func (f *UserFile) Trashed() bool {
+	return f.DeletedAt != 0
+}
+
+// FileVersion is one immutable revision of a UserFile's content. Numbers
+// count up from 1 for each file. Restoring an old version adds a new one
+// that shares the old one's object, noting which in RestoredFrom.
+// SizeDelta and ContentChanged compare a version with the one before it;
+// the first is compared with no content at all.
+type FileVersion struct {
+	FileID         string          `json:"fileId" dynamodbav:"fileId"` // partition key
+	Number         int             `json:"number" dynamodbav:"number"` // sort key
+	FileKey        string          `json:"-" dynamodbav:"fileKey"`
+	Size           int64           `json:"size" dynamodbav:"size"`
+	ContentType    string          `json:"contentType,omitempty" dynamodbav:"contentType,omitempty"`
+	SHA256         string          `json:"sha256,omitempty" dynamodbav:"sha256,omitempty"`
+	Encryption     *FileEncryption `json:"encryption,omitempty" dynamodbav:"encryption,omitempty"`
+	UploadedBy     string          `json:"uploadedBy" dynamodbav:"uploadedBy"`
+	RestoredFrom   int             `json:"restoredFrom,omitempty" dynamodbav:"restoredFrom,omitempty"`
+	SizeDelta      int64           `json:"sizeDelta" dynamodbav:"sizeDelta"`
+	ContentChanged bool            `json:"contentChanged" dynamodbav:"contentChanged"`
+	CreatedAt      int64           `json:"createdAt" dynamodbav:"createdAt"`
+}
+
+// FileEncryption says how a file's content is encrypted in the object
+// store: with Algorithm, under a data key of its own that is kept wrapped
+// by the master key KeyID.
+type FileEncryption struct {
+	Algorithm  string `json:"algorithm" dynamodbav:"algorithm"`
+	KeyID      string `json:"keyId" dynamodbav:"keyId"`
+	WrappedKey []byte `json:"-" dynamodbav:"wrappedKey"`
+}
+
+// Name is the filename the file was uploaded with. Files stored before
+// per-user keys have none recorded, and their key ends with it instead.
+func (f *UserFile) Name() string {
+	if f.Filename != "" {
+		return f.Filename
+	}
+	return path.Base(f.FileKey)
+}
+
+const (
+	TokenKindRefresh    = "refresh"
+	TokenKindRevocation = "revocation"
+	TokenKindAttempts   = "attempts"
+	TokenKindRelease    = "release"
+)
+
+type TokenRecord struct {
+	ID        string `json:"id" dynamodbav:"id"`
+	Kind      string `json:"kind" dynamodbav:"kind"`
+	UserID    string `json:"userId,omitempty" dynamodbav:"userId,omitempty"`
+	Family    string `json:"family,omitempty" dynamodbav:"family,omitempty"`
+	FileID    string `json:"fileId,omitempty" dynamodbav:"fileId,omitempty"`
+	UsedAt    int64  `json:"usedAt" dynamodbav:"usedAt"`
+	RevokedAt int64  `json:"revokedAt,omitempty" dynamodbav:"revokedAt,omitempty"`
+	Attempts  int    `json:"attempts,omitempty" dynamodbav:"attempts,omitempty"`
 	CreatedAt int64  `json:"createdAt" dynamodbav:"createdAt"`
+	ExpiresAt int64  `json:"expiresAt" dynamodbav:"expiresAt"` // DynamoDB TTL attribute
+}
+
+const (
+	ShareModeLink = "link"
+	ShareModeFace = "face"
+)
+
+// Share is a revocable link to a UserFile. The token is the public part of
+// the /s/{token} URL. MaxUses of zero means the link works until it expires.
+// Face shares only release the file to a visitor whose selfie matches the
+// owner's reference image.
+type Share struct {
+	Token         string  `json:"token" dynamodbav:"token"`
+	FileID        string  `json:"fileId" dynamodbav:"fileId"`
+	CreatedBy     string  `json:"createdBy" dynamodbav:"createdBy"`
+	Mode          string  `json:"mode" dynamodbav:"mode"`
+	ReferenceID   string  `json:"referenceFileId,omitempty" dynamodbav:"referenceFileId,omitempty"`
+	FaceThreshold float32 `json:"faceThreshold,omitempty" dynamodbav:"faceThreshold,omitempty"`
+	MaxUses       int     `json:"maxUses" dynamodbav:"maxUses"`
+	RemainingUses int     `json:"remainingUses" dynamodbav:"remainingUses"`
+	UseCount      int     `json:"useCount" dynamodbav:"useCount"`
+	Revoked       bool    `json:"revoked" dynamodbav:"revoked"`
+	LastUsedAt    int64   `json:"lastUsedAt,omitempty" dynamodbav:"lastUsedAt,omitempty"`
+	CreatedAt     int64   `json:"createdAt" dynamodbav:"createdAt"`
+	ExpiresAt     int64   `json:"expiresAt" dynamodbav:"expiresAt"`
+}
+
+// Usable reports whether the share can still be opened at now.
+func (s *Share) Usable(now int64) bool {
+	if s.Revoked || s.ExpiresAt <= now {
+		return false
+	}
+	return s.MaxUses == 0 || s.RemainingUses > 0
+}
+
+// FaceAttempt records one selfie submitted to a face share.
+type FaceAttempt struct {
+	ID         string  `json:"id" dynamodbav:"id"`
+	ShareToken string  `json:"shareToken" dynamodbav:"shareToken"`
+	Matched    bool    `json:"matched" dynamodbav:"matched"`
+	Similarity float32 `json:"similarity" dynamodbav:"similarity"`
+	Threshold  float32 `json:"threshold" dynamodbav:"threshold"`
+	ClientIP   string  `json:"clientIp" dynamodbav:"clientIp"`
+	Error      string  `json:"error,omitempty" dynamodbav:"error,omitempty"`
+	CreatedAt  int64   `json:"createdAt" dynamodbav:"createdAt"`
+}
+
+const (
+	OutboxPending = "pending"
+	OutboxSending = "sending"
+	OutboxSent    = "sent"
+	OutboxDead    = "dead"
+)
+
+// OutboxJob is an email waiting to be delivered by the outbox workers.
+// While a job is sending, NextAttemptAt is when its lease runs out and
+// another worker may pick it up again.
+type OutboxJob struct {
+	ID            string   `json:"id" dynamodbav:"id"`
+	Kind          string   `json:"kind" dynamodbav:"kind"`
+	UserID        string   `json:"userId,omitempty" dynamodbav:"userId,omitempty"` // the user the email was sent for, if any
+	To            []string `json:"to" dynamodbav:"to"`
+	Subject       string   `json:"subject" dynamodbav:"subject"`
+	Payload       []byte   `json:"-" dynamodbav:"payload"`
+	Status        string   `json:"status" dynamodbav:"status"`
+	Attempts      int      `json:"attempts" dynamodbav:"attempts"`
+	NextAttemptAt int64    `json:"nextAttemptAt" dynamodbav:"nextAttemptAt"`
+	LastError     string   `json:"lastError,omitempty" dynamodbav:"lastError,omitempty"`
+	ProviderID    string   `json:"providerId,omitempty" dynamodbav:"providerId,omitempty"`
+	CreatedAt     int64    `json:"createdAt" dynamodbav:"createdAt"`
+	UpdatedAt     int64    `json:"updatedAt" dynamodbav:"updatedAt"`
+	SentAt        int64    `json:"sentAt,omitempty" dynamodbav:"sentAt,omitempty"`
+	ExpiresAt     int64    `json:"expiresAt,omitempty" dynamodbav:"expiresAt,omitempty"` // DynamoDB TTL attribute, set once sent
+}
+
+// PendingMessage is a direct websocket message kept until its recipient
+// acknowledges it or it expires. IDs sort in the order messages were sent.
+type PendingMessage struct {
+	UserID    string `json:"userId" dynamodbav:"userId"`
+	ID        string `json:"id" dynamodbav:"id"`
+	Payload   []byte `json:"-" dynamodbav:"payload"`
+	CreatedAt int64  `json:"createdAt" dynamodbav:"createdAt"`
+	ExpiresAt int64  `json:"expiresAt" dynamodbav:"expiresAt"` // DynamoDB TTL attribute
+}
+
+// Upload is an upload in progress, either sent in parts through this server
+// or, when Direct, straight to the object store with a signed request.
+// Completing it creates the UserFile FileID, stored at FileKey, or when
+// NewVersion adds a version of that existing file.
+type Upload struct {
+	ID            string   `json:"id" dynamodbav:"id"`
+	User          string   `json:"user" dynamodbav:"user"`
+	FileID        string   `json:"fileId" dynamodbav:"fileId"`
+	FileKey       string   `json:"-" dynamodbav:"fileKey"`
+	Direct        bool     `json:"direct" dynamodbav:"direct"`
+	NewVersion    bool     `json:"newVersion,omitempty" dynamodbav:"newVersion,omitempty"`
+	StoreUploadID string   `json:"-" dynamodbav:"storeUploadId,omitempty"` // the object store's ID for a multipart upload
+	StagingKey    string   `json:"-" dynamodbav:"stagingKey,omitempty"`    // where a direct upload is sent, before it is encrypted into FileKey
+	Filename      string   `json:"filename" dynamodbav:"filename"`
+	Description   string   `json:"description,omitempty" dynamodbav:"description,omitempty"`
+	Tags          []string `json:"tags,omitempty" dynamodbav:"tags,omitempty"`
+	Size          int64    `json:"size" dynamodbav:"size"`                             // declared when the upload starts
+	PartSize      int64    `json:"partSize,omitempty" dynamodbav:"partSize,omitempty"` // of every part but the last
+	ContentType   string   `json:"contentType,omitempty" dynamodbav:"contentType,omitempty"`
+	SHA256        string   `json:"sha256,omitempty" dynamodbav:"sha256,omitempty"` // expected checksum of a direct upload
+	CreatedAt     int64    `json:"createdAt" dynamodbav:"createdAt"`
+	UpdatedAt     int64    `json:"updatedAt" dynamodbav:"updatedAt"`   // when a part last arrived
+	ClaimedAt     int64    `json:"-" dynamodbav:"claimedAt,omitempty"` // when finalizing a direct upload began
+
+	// Encryption is what the parts of a chunked upload are encrypted with,
+	// and becomes the file's
+	Encryption *FileEncryption `json:"-" dynamodbav:"encryption,omitempty"`
 }
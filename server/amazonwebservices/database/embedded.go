@@ -0,0 +1,513 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errNoItem lets an updateItem callback abort when the item is missing.
+var errNoItem = errors.New("item not found")
+
+// EmbeddedDB is a small table store used when running without DynamoDB.
+// Every table is a map of id to a gob encoded item. When path is set the
+// whole database is rewritten to that single file after every change.
+type EmbeddedDB struct {
+	mu     sync.RWMutex
+	path   string
+	tables map[string]map[string][]byte
+}
+
+// OpenEmbeddedDB loads the database at path, creating it if needed. An empty
+// path keeps everything in memory.
+func OpenEmbeddedDB(path string) (*EmbeddedDB, error) {
+	db := &EmbeddedDB{
+		path:   path,
+		tables: make(map[string]map[string][]byte),
+	}
+	if path == "" {
+		return db, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return db, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read embedded database: %w", err)
+	}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&db.tables); err != nil {
+		return nil, fmt.Errorf("failed to decode embedded database: %w", err)
+	}
+	return db, nil
+}
+
+// save must be called with the write lock held.
+func (db *EmbeddedDB) save() error {
+	if db.path == "" {
+		return nil
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(db.tables); err != nil {
+		return fmt.Errorf("failed to encode embedded database: %w", err)
+	}
+	if dir := filepath.Dir(db.path); dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+	}
+	tmp := db.path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0o600); err != nil {
+		return fmt.Errorf("failed to write embedded database: %w", err)
+	}
+	return os.Rename(tmp, db.path)
+}
+
+func encodeItem(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeItem(data []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+func getItem[T any](db *EmbeddedDB, table, id string) (*T, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	data, ok := db.tables[table][id]
+	if !ok {
+		return nil, nil
+	}
+	var item T
+	if err := decodeItem(data, &item); err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+func putItem[T any](db *EmbeddedDB, table, id string, item T) error {
+	data, err := encodeItem(item)
+	if err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.tables[table] == nil {
+		db.tables[table] = make(map[string][]byte)
+	}
+	db.tables[table][id] = data
+	return db.save()
+}
+
+// updateItem runs fn on the current item under the write lock and stores the
+// result, which makes it the embedded equivalent of a conditional update.
+// exists is false when there is no item with that id; fn returning an error
+// leaves the table untouched.
+func updateItem[T any](db *EmbeddedDB, table, id string, fn func(item *T, exists bool) error) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var item T
+	data, exists := db.tables[table][id]
+	if exists {
+		if err := decodeItem(data, &item); err != nil {
+			return err
+		}
+	}
+	if err := fn(&item, exists); err != nil {
+		return err
+	}
+
+	data, err := encodeItem(item)
+	if err != nil {
+		return err
+	}
+	if db.tables[table] == nil {
+		db.tables[table] = make(map[string][]byte)
+	}
+	db.tables[table][id] = data
+	return db.save()
+}
+
+func deleteItem(db *EmbeddedDB, table, id string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.tables[table][id]; !ok {
+		return nil
+	}
+	delete(db.tables[table], id)
+	return db.save()
+}
+
+// deleteItemIf deletes item id from table when check, called with it,
+// returns nil, and returns check's error otherwise. A missing item is not
+// an error.
+func deleteItemIf[T any](db *EmbeddedDB, table, id string, check func(item *T) error) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	data, ok := db.tables[table][id]
+	if !ok {
+		return nil
+	}
+	var item T
+	if err := decodeItem(data, &item); err != nil {
+		return err
+	}
+	if err := check(&item); err != nil {
+		return err
+	}
+	delete(db.tables[table], id)
+	return db.save()
+}
+
+// deleteItems deletes every item in table for which match returns true,
+// saving the database once.
+func deleteItems[T any](db *EmbeddedDB, table string, match func(item *T) bool) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	deleted := false
+	for id, data := range db.tables[table] {
+		var item T
+		if err := decodeItem(data, &item); err != nil {
+			return err
+		}
+		if match(&item) {
+			delete(db.tables[table], id)
+			deleted = true
+		}
+	}
+	if !deleted {
+		return nil
+	}
+	return db.save()
+}
+
+// scanItems returns every item in table for which keep returns true.
+// A nil keep returns everything.
+func scanItems[T any](db *EmbeddedDB, table string, keep func(item *T) bool) ([]T, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	var items []T
+	for _, data := range db.tables[table] {
+		var item T
+		if err := decodeItem(data, &item); err != nil {
+			return nil, err
+		}
+		if keep == nil || keep(&item) {
+			items = append(items, item)
+		}
+	}
+	return items, nil
+}
+
+// EmbeddedUserRepository is the UserRepository backed by an EmbeddedDB.
+type EmbeddedUserRepository struct {
+	db        *EmbeddedDB
+	tableName string
+}
+
+func NewEmbeddedUserRepository(db *EmbeddedDB, tableName string) *EmbeddedUserRepository {
+	return &EmbeddedUserRepository{db: db, tableName: tableName}
+}
+
+func (r *EmbeddedUserRepository) CreateUser(ctx context.Context, id, name, email, password string) (*User, error) {
+	now := time.Now().Unix()
+	user := User{
+		ID:        id,
+		Name:      name,
+		Email:     strings.ToLower(email),
+		Password:  password,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := putItem(r.db, r.tableName, id, user); err != nil {
+		return nil, err
+	}
+	user.Password = ""
+	return &user, nil
+}
+
+func (r *EmbeddedUserRepository) GetUserById(ctx context.Context, id string) (*User, error) {
+	return getItem[User](r.db, r.tableName, id)
+}
+
+func (r *EmbeddedUserRepository) GetUserByEmail(ctx context.Context, email string) (*User, error) {
+	users, err := scanItems(r.db, r.tableName, func(u *User) bool {
+		return strings.EqualFold(u.Email, email)
+	})
+	if err != nil || len(users) == 0 {
+		return nil, err
+	}
+	// the email index is sorted by createdAt, keep the same pick
+	sort.Slice(users, func(i, j int) bool { return users[i].CreatedAt < users[j].CreatedAt })
+	return &users[0], nil
+}
+
+func (r *EmbeddedUserRepository) GetAllUsers(ctx context.Context) ([]User, error) {
+	return scanItems[User](r.db, r.tableName, nil)
+}
+
+func (r *EmbeddedUserRepository) UpdateUser(ctx context.Context, user User) error {
+	return updateItem(r.db, r.tableName, user.ID, func(existing *User, exists bool) error {
+		if !exists {
+			return errNoItem
+		}
+		existing.UpdatedAt = time.Now().Unix()
+		if user.Name != "" {
+			existing.Name = user.Name
+		}
+		if user.Email != "" {
+			existing.Email = strings.ToLower(user.Email)
+		}
+		return nil
+	})
+}
+
+func (r *EmbeddedUserRepository) UpdatePassword(ctx context.Context, user User) error {
+	return updateItem(r.db, r.tableName, user.ID, func(existing *User, exists bool) error {
+		if !exists {
+			return errNoItem
+		}
+		existing.Password = user.Password
+		existing.UpdatedAt = time.Now().Unix()
+		return nil
+	})
+}
+
+func (r *EmbeddedUserRepository) UpdateTOTP(ctx context.Context, user User) error {
+	return updateItem(r.db, r.tableName, user.ID, func(existing *User, exists bool) error {
+		if !exists {
+			return errNoItem
+		}
+		existing.TOTPEnabled = user.TOTPEnabled
+		existing.TOTPSecret = user.TOTPSecret
+		existing.TOTPLastStep = user.TOTPLastStep
+		existing.RecoveryCodes = user.RecoveryCodes
+		existing.UpdatedAt = time.Now().Unix()
+		return nil
+	})
+}
+
+func (r *EmbeddedUserRepository) UseTOTPStep(ctx context.Context, id string, step int64) (bool, error) {
+	err := updateItem(r.db, r.tableName, id, func(existing *User, exists bool) error {
+		if !exists || existing.TOTPLastStep >= step {
+			return errNoItem
+		}
+		existing.TOTPLastStep = step
+		return nil
+	})
+	if errors.Is(err, errNoItem) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to use TOTP step: %w", err)
+	}
+	return true, nil
+}
+
+func (r *EmbeddedUserRepository) UseRecoveryCode(ctx context.Context, id string, index int, hash string) (bool, error) {
+	err := updateItem(r.db, r.tableName, id, func(existing *User, exists bool) error {
+		if !exists || index >= len(existing.RecoveryCodes) || existing.RecoveryCodes[index] != hash {
+			return errNoItem
+		}
+		existing.RecoveryCodes = slices.Delete(existing.RecoveryCodes, index, index+1)
+		return nil
+	})
+	if errors.Is(err, errNoItem) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to use recovery code: %w", err)
+	}
+	return true, nil
+}
+
+func (r *EmbeddedUserRepository) UpdateLastSeen(ctx context.Context, id string, at int64) error {
+	return updateItem(r.db, r.tableName, id, func(existing *User, exists bool) error {
+		if !exists {
+			return errNoItem
+		}
+		existing.LastSeenAt = at
+		return nil
+	})
+}
+
+func (r *EmbeddedUserRepository) DeleteUser(ctx context.Context, id string) error {
+	return deleteItem(r.db, r.tableName, id)
+}
+
+// EmbeddedFileRepository is the FileRepository backed by an EmbeddedDB.
+type EmbeddedFileRepository struct {
+	db        *EmbeddedDB
+	tableName string
+}
+
+func NewEmbeddedFileRepository(db *EmbeddedDB, tableName string) *EmbeddedFileRepository {
+	return &EmbeddedFileRepository{db: db, tableName: tableName}
+}
+
+func (r *EmbeddedFileRepository) CreateFile(ctx context.Context, file UserFile) error {
+	if file.CreatedAt == 0 {
+		file.CreatedAt = time.Now().Unix()
+	}
+	if err := putItem(r.db, r.tableName, file.ID, file); err != nil {
+		return fmt.Errorf("failed to insert file: %w", err)
+	}
+	fmt.Println("File created:", file.ID)
+	return nil
+}
+
+func (r *EmbeddedFileRepository) GetFile(ctx context.Context, id string) (*UserFile, error) {
+	return getItem[UserFile](r.db, r.tableName, id)
+}
+
+func (r *EmbeddedFileRepository) ListFiles(ctx context.Context) ([]UserFile, error) {
+	return scanItems[UserFile](r.db, r.tableName, nil)
+}
+
+func (r *EmbeddedFileRepository) ListFilesByUserSorted(ctx context.Context, userId string) ([]UserFile, error) {
+	files, err := scanItems(r.db, r.tableName, func(f *UserFile) bool {
+		return f.User == userId
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		if files[i].CreatedAt != files[j].CreatedAt {
+			return files[i].CreatedAt > files[j].CreatedAt
+		}
+		return files[i].ID > files[j].ID
+	})
+	return files, nil
+}
+
+func (r *EmbeddedFileRepository) ScanFiles(ctx context.Context, fn func(page []UserFile) error) error {
+	files, err := scanItems[UserFile](r.db, r.tableName, nil)
+	if err != nil {
+		return err
+	}
+	return fn(files)
+}
+
+func (r *EmbeddedFileRepository) UpdateContentInfo(ctx context.Context, id, fileKey string, size int64, sha256 string) error {
+	err := updateItem(r.db, r.tableName, id, func(file *UserFile, exists bool) error {
+		if !exists || file.FileKey != fileKey {
+			return errNoItem
+		}
+		file.Size = size
+		file.SHA256 = sha256
+		return nil
+	})
+	if err != nil && !errors.Is(err, errNoItem) {
+		return fmt.Errorf("failed to update file content info: %w", err)
+	}
+	return nil
+}
+
+func (r *EmbeddedFileRepository) UpdateEncryption(ctx context.Context, id, fileKey string, enc FileEncryption) error {
+	err := updateItem(r.db, r.tableName, id, func(file *UserFile, exists bool) error {
+		if !exists || file.FileKey != fileKey {
+			return errNoItem
+		}
+		file.Encryption = &enc
+		return nil
+	})
+	if errors.Is(err, errNoItem) {
+		return ErrFileChanged
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update file encryption: %w", err)
+	}
+	return nil
+}
+
+func (r *EmbeddedFileRepository) SetCurrentVersion(ctx context.Context, id string, version FileVersion) error {
+	err := updateItem(r.db, r.tableName, id, func(file *UserFile, exists bool) error {
+		if !exists || file.Version >= version.Number {
+			return errNoItem
+		}
+		file.FileKey = version.FileKey
+		file.Size = version.Size
+		file.ContentType = version.ContentType
+		file.SHA256 = version.SHA256
+		file.Encryption = version.Encryption
+		file.Version = version.Number
+		return nil
+	})
+	if err != nil && !errors.Is(err, errNoItem) {
+		return fmt.Errorf("failed to set current version: %w", err)
+	}
+	return nil
+}
+
+func (r *EmbeddedFileRepository) TrashFile(ctx context.Context, id string, deletedAt int64) error {
+	err := updateItem(r.db, r.tableName, id, func(file *UserFile, exists bool) error {
+		if !exists || file.Trashed() {
+			return errNoItem
+		}
+		file.DeletedAt = deletedAt
+		return nil
+	})
+	if err != nil && !errors.Is(err, errNoItem) {
+		return fmt.Errorf("failed to trash file: %w", err)
+	}
+	return nil
+}
+
+func (r *EmbeddedFileRepository) RestoreFile(ctx context.Context, id string) error {
+	err := updateItem(r.db, r.tableName, id, func(file *UserFile, exists bool) error {
+		if !exists {
+			return errNoItem
+		}
+		file.DeletedAt = 0
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to restore file: %w", err)
+	}
+	return nil
+}
+
+func (r *EmbeddedFileRepository) ListTrashedFiles(ctx context.Context, before int64) ([]UserFile, error) {
+	return scanItems(r.db, r.tableName, func(file *UserFile) bool {
+		return file.Trashed() && file.DeletedAt < before
+	})
+}
+
+func (r *EmbeddedFileRepository) DeleteTrashedFile(ctx context.Context, id string) error {
+	err := deleteItemIf(r.db, r.tableName, id, func(file *UserFile) error {
+		if !file.Trashed() {
+			return ErrFileNotTrashed
+		}
+		return nil
+	})
+	if errors.Is(err, ErrFileNotTrashed) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete file: %w", err)
+	}
+	fmt.Println("🗑️ File deleted:", id)
+	return nil
+}
@@ -0,0 +1,154 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func CreateFaceAttemptsTable(client *dynamodb.Client, tableName string) error {
+	_, err := client.DescribeTable(context.TODO(), &dynamodb.DescribeTableInput{
+		TableName: aws.String(tableName),
+	})
+	if err == nil {
+		return nil
+	}
+
+	var notFound *types.ResourceNotFoundException
+	if !errors.As(err, &notFound) {
+		return fmt.Errorf("error checking table existence: %w", err)
+	}
+
+	fmt.Println("Face attempts table not found — creating now...")
+
+	_, err = client.CreateTable(context.TODO(), &dynamodb.CreateTableInput{
+		TableName: aws.String(tableName),
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String("id"), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String("shareToken"), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String("createdAt"), AttributeType: types.ScalarAttributeTypeN},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String("id"), KeyType: types.KeyTypeHash},
+		},
+		GlobalSecondaryIndexes: []types.GlobalSecondaryIndex{
+			{
+				IndexName: aws.String("shareToken-index"),
+				KeySchema: []types.KeySchemaElement{
+					{AttributeName: aws.String("shareToken"), KeyType: types.KeyTypeHash},
+					{AttributeName: aws.String("createdAt"), KeyType: types.KeyTypeRange},
+				},
+				Projection: &types.Projection{
+					ProjectionType: types.ProjectionTypeAll,
+				},
+			},
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create Face attempts table: %w", err)
+	}
+
+	fmt.Println("Face attempts table created.")
+	return nil
+}
+
+// DynamoFaceAttemptRepository is the FaceAttemptRepository backed by a
+// DynamoDB table.
+type DynamoFaceAttemptRepository struct {
+	client    *dynamodb.Client
+	tableName string
+}
+
+func NewDynamoFaceAttemptRepository(client *dynamodb.Client, tableName string) *DynamoFaceAttemptRepository {
+	return &DynamoFaceAttemptRepository{client: client, tableName: tableName}
+}
+
+func (r *DynamoFaceAttemptRepository) RecordAttempt(ctx context.Context, attempt FaceAttempt) error {
+	if attempt.CreatedAt == 0 {
+		attempt.CreatedAt = time.Now().Unix()
+	}
+	item, err := attributevalue.MarshalMap(attempt)
+	if err != nil {
+		return fmt.Errorf("failed to marshal face attempt: %w", err)
+	}
+	_, err = r.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(r.tableName),
+		Item:      item,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record face attempt: %w", err)
+	}
+	return nil
+}
+
+func (r *DynamoFaceAttemptRepository) ListAttempts(ctx context.Context, shareToken string) ([]FaceAttempt, error) {
+	var items []map[string]types.AttributeValue
+	var lastEvaluatedKey map[string]types.AttributeValue
+
+	for {
+		out, err := r.client.Query(ctx, &dynamodb.QueryInput{
+			TableName:              aws.String(r.tableName),
+			IndexName:              aws.String("shareToken-index"),
+			KeyConditionExpression: aws.String("shareToken = :token"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":token": &types.AttributeValueMemberS{Value: shareToken},
+			},
+			ExclusiveStartKey: lastEvaluatedKey,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to query face attempts: %w", err)
+		}
+		items = append(items, out.Items...)
+
+		if out.LastEvaluatedKey == nil {
+			break
+		}
+		lastEvaluatedKey = out.LastEvaluatedKey
+	}
+
+	var attempts []FaceAttempt
+	if err := attributevalue.UnmarshalListOfMaps(items, &attempts); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal face attempts: %w", err)
+	}
+	return attempts, nil
+}
+
+// EmbeddedFaceAttemptRepository is the FaceAttemptRepository backed by an
+// EmbeddedDB.
+type EmbeddedFaceAttemptRepository struct {
+	db        *EmbeddedDB
+	tableName string
+}
+
+func NewEmbeddedFaceAttemptRepository(db *EmbeddedDB, tableName string) *EmbeddedFaceAttemptRepository {
+	return &EmbeddedFaceAttemptRepository{db: db, tableName: tableName}
+}
+
+func (r *EmbeddedFaceAttemptRepository) RecordAttempt(ctx context.Context, attempt FaceAttempt) error {
+	if attempt.CreatedAt == 0 {
+		attempt.CreatedAt = time.Now().Unix()
+	}
+	if err := putItem(r.db, r.tableName, attempt.ID, attempt); err != nil {
+		return fmt.Errorf("failed to record face attempt: %w", err)
+	}
+	return nil
+}
+
+func (r *EmbeddedFaceAttemptRepository) ListAttempts(ctx context.Context, shareToken string) ([]FaceAttempt, error) {
+	attempts, err := scanItems(r.db, r.tableName, func(a *FaceAttempt) bool {
+		return a.ShareToken == shareToken
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(attempts, func(i, j int) bool { return attempts[i].CreatedAt < attempts[j].CreatedAt })
+	return attempts, nil
+}
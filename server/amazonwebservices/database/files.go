@@ -13,6 +13,9 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 )
 
+var ErrFileChanged = errors.New("file is gone or has new content")
+var ErrFileNotTrashed = errors.New("file is not in the trash")
+
 func CreateFilesTable(client *dynamodb.Client, tableName string) error {
 
 	_, err := client.DescribeTable(context.TODO(), &dynamodb.DescribeTableInput{
@@ -103,26 +106,40 @@ func CreateFilesTable(client *dynamodb.Client, tableName string) error {
 	return nil
 }
 
-func CreateFile(client *dynamodb.Client, tableName, id, fileKey, user string) error {
-	_, err := client.PutItem(context.TODO(), &dynamodb.PutItemInput{
-		TableName: aws.String(tableName),
-		Item: map[string]types.AttributeValue{
-			"id":        &types.AttributeValueMemberS{Value: id},
-			"fileKey":   &types.AttributeValueMemberS{Value: fileKey},
-			"user":      &types.AttributeValueMemberS{Value: user},
-			"createdAt": &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Unix(), 10)}},
+// DynamoFileRepository is the FileRepository backed by a DynamoDB table.
+type DynamoFileRepository struct {
+	client    *dynamodb.Client
+	tableName string
+}
+
+func NewDynamoFileRepository(client *dynamodb.Client, tableName string) *DynamoFileRepository {
+	return &DynamoFileRepository{client: client, tableName: tableName}
+}
+
+func (r *DynamoFileRepository) CreateFile(ctx context.Context, file UserFile) error {
+	if file.CreatedAt == 0 {
+		file.CreatedAt = time.Now().Unix()
+	}
+	item, err := attributevalue.MarshalMap(file)
+	if err != nil {
+		return fmt.Errorf("failed to marshal file: %w", err)
+	}
+
+	_, err = r.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(r.tableName),
+		Item:      item,
 	})
 	if err != nil {
 		return fmt.Errorf("failed to insert file: %w", err)
 	}
 
-	fmt.Println("File created:", id)
+	fmt.Println("File created:", file.ID)
 	return nil
 }
 
-func GetFile(client *dynamodb.Client, tableName, id string) (*UserFile, error) {
-	out, err := client.GetItem(context.TODO(), &dynamodb.GetItemInput{
-		TableName: aws.String(tableName),
+func (r *DynamoFileRepository) GetFile(ctx context.Context, id string) (*UserFile, error) {
+	out, err := r.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(r.tableName),
 		Key: map[string]types.AttributeValue{
 			"id": &types.AttributeValueMemberS{Value: id},
 		},
@@ -145,24 +162,41 @@ func GetFile(client *dynamodb.Client, tableName, id string) (*UserFile, error) {
 	return &file, nil
 }
 
-func ListFiles(client *dynamodb.Client, tableName string) ([]map[string]types.AttributeValue, error) {
-	out, err := client.Scan(context.TODO(), &dynamodb.ScanInput{
-		TableName: aws.String(tableName),
-	})
-	if err != nil {
-		return nil, fmt.Errorf("failed to list files: %w", err)
+func (r *DynamoFileRepository) ListFiles(ctx context.Context) ([]UserFile, error) {
+	var items []map[string]types.AttributeValue
+	var lastEvaluatedKey map[string]types.AttributeValue
+
+	for {
+		out, err := r.client.Scan(ctx, &dynamodb.ScanInput{
+			TableName:         aws.String(r.tableName),
+			ExclusiveStartKey: lastEvaluatedKey,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list files: %w", err)
+		}
+
+		items = append(items, out.Items...)
+		if out.LastEvaluatedKey == nil {
+			break
+		}
+		lastEvaluatedKey = out.LastEvaluatedKey
 	}
 
-	return out.Items, nil
+	var files []UserFile
+	err := attributevalue.UnmarshalListOfMaps(items, &files)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal files: %w", err)
+	}
+	return files, nil
 }
 
-func ListFilesByUserSorted(client *dynamodb.Client, tableName string, userId string) ([]UserFile, error) {
+func (r *DynamoFileRepository) ListFilesByUserSorted(ctx context.Context, userId string) ([]UserFile, error) {
 	var allItems []map[string]types.AttributeValue
 	var lastEvaluatedKey map[string]types.AttributeValue
 
 	for {
 		input := &dynamodb.QueryInput{
-			TableName:                aws.String(tableName),
+			TableName:                aws.String(r.tableName),
 			IndexName:                aws.String("user-index"),
 			KeyConditionExpression:   aws.String("#u = :userVal"),
 			ExpressionAttributeNames: map[string]string{"#u": "user"},
@@ -173,7 +207,7 @@ func ListFilesByUserSorted(client *dynamodb.Client, tableName string, userId str
 			ExclusiveStartKey: lastEvaluatedKey,
 		}
 
-		out, err := client.Query(context.TODO(), input)
+		out, err := r.client.Query(ctx, input)
 		if err != nil {
 			return nil, err
 		}
@@ -194,13 +228,217 @@ func ListFilesByUserSorted(client *dynamodb.Client, tableName string, userId str
 	return files, nil
 }
 
-func DeleteFile(client *dynamodb.Client, tableName, id string) error {
-	_, err := client.DeleteItem(context.TODO(), &dynamodb.DeleteItemInput{
-		TableName: aws.String(tableName),
+func (r *DynamoFileRepository) ScanFiles(ctx context.Context, fn func(page []UserFile) error) error {
+	var lastEvaluatedKey map[string]types.AttributeValue
+	for {
+		out, err := r.client.Scan(ctx, &dynamodb.ScanInput{
+			TableName:         aws.String(r.tableName),
+			ExclusiveStartKey: lastEvaluatedKey,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to scan files: %w", err)
+		}
+
+		var files []UserFile
+		if err := attributevalue.UnmarshalListOfMaps(out.Items, &files); err != nil {
+			return fmt.Errorf("failed to unmarshal files: %w", err)
+		}
+		if err := fn(files); err != nil {
+			return err
+		}
+		if out.LastEvaluatedKey == nil {
+			return nil
+		}
+		lastEvaluatedKey = out.LastEvaluatedKey
+	}
+}
+
+func (r *DynamoFileRepository) UpdateContentInfo(ctx context.Context, id, fileKey string, size int64, sha256 string) error {
+	_, err := r.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(r.tableName),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+		UpdateExpression:    aws.String("SET #size = :size, sha256 = :sha256"),
+		ConditionExpression: aws.String("fileKey = :fileKey"),
+		ExpressionAttributeNames: map[string]string{
+			"#size": "size",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":size":    &types.AttributeValueMemberN{Value: strconv.FormatInt(size, 10)},
+			":sha256":  &types.AttributeValueMemberS{Value: sha256},
+			":fileKey": &types.AttributeValueMemberS{Value: fileKey},
+		},
+	})
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		// gone, or moved on to other content
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update file content info: %w", err)
+	}
+	return nil
+}
+
+func (r *DynamoFileRepository) UpdateEncryption(ctx context.Context, id, fileKey string, enc FileEncryption) error {
+	av, err := attributevalue.Marshal(enc)
+	if err != nil {
+		return fmt.Errorf("failed to marshal encryption: %w", err)
+	}
+	_, err = r.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(r.tableName),
 		Key: map[string]types.AttributeValue{
 			"id": &types.AttributeValueMemberS{Value: id},
 		},
+		UpdateExpression:    aws.String("SET encryption = :enc"),
+		ConditionExpression: aws.String("fileKey = :fileKey"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":enc":     av,
+			":fileKey": &types.AttributeValueMemberS{Value: fileKey},
+		},
 	})
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return ErrFileChanged
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update file encryption: %w", err)
+	}
+	return nil
+}
+
+func (r *DynamoFileRepository) SetCurrentVersion(ctx context.Context, id string, version FileVersion) error {
+	update := "SET #fileKey = :fileKey, #size = :size, #contentType = :contentType, #sha256 = :sha256, #version = :version"
+	values := map[string]types.AttributeValue{
+		":fileKey":     &types.AttributeValueMemberS{Value: version.FileKey},
+		":size":        &types.AttributeValueMemberN{Value: strconv.FormatInt(version.Size, 10)},
+		":contentType": &types.AttributeValueMemberS{Value: version.ContentType},
+		":sha256":      &types.AttributeValueMemberS{Value: version.SHA256},
+		":version":     &types.AttributeValueMemberN{Value: strconv.Itoa(version.Number)},
+	}
+	if version.Encryption != nil {
+		enc, err := attributevalue.Marshal(version.Encryption)
+		if err != nil {
+			return fmt.Errorf("failed to marshal encryption: %w", err)
+		}
+		update += ", #encryption = :encryption"
+		values[":encryption"] = enc
+	} else {
+		update += " REMOVE #encryption"
+	}
+
+	_, err := r.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(r.tableName),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+		UpdateExpression:    aws.String(update),
+		ConditionExpression: aws.String("attribute_exists(id) AND (attribute_not_exists(#version) OR #version < :version)"),
+		ExpressionAttributeNames: map[string]string{
+			"#fileKey":     "fileKey",
+			"#size":        "size",
+			"#contentType": "contentType",
+			"#sha256":      "sha256",
+			"#version":     "version",
+			"#encryption":  "encryption",
+		},
+		ExpressionAttributeValues: values,
+	})
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		// gone, or already at a newer version
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to set current version: %w", err)
+	}
+	return nil
+}
+
+func (r *DynamoFileRepository) TrashFile(ctx context.Context, id string, deletedAt int64) error {
+	_, err := r.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(r.tableName),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+		UpdateExpression:    aws.String("SET deletedAt = :deletedAt"),
+		ConditionExpression: aws.String("attribute_exists(id) AND attribute_not_exists(deletedAt)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":deletedAt": &types.AttributeValueMemberN{Value: strconv.FormatInt(deletedAt, 10)},
+		},
+	})
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		// gone, or already in the trash
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to trash file: %w", err)
+	}
+	return nil
+}
+
+func (r *DynamoFileRepository) RestoreFile(ctx context.Context, id string) error {
+	_, err := r.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(r.tableName),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+		UpdateExpression:    aws.String("REMOVE deletedAt"),
+		ConditionExpression: aws.String("attribute_exists(id)"),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to restore file: %w", err)
+	}
+	return nil
+}
+
+func (r *DynamoFileRepository) ListTrashedFiles(ctx context.Context, before int64) ([]UserFile, error) {
+	var items []map[string]types.AttributeValue
+	var lastEvaluatedKey map[string]types.AttributeValue
+	for {
+		out, err := r.client.Scan(ctx, &dynamodb.ScanInput{
+			TableName:        aws.String(r.tableName),
+			FilterExpression: aws.String("deletedAt < :before"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":before": &types.AttributeValueMemberN{Value: strconv.FormatInt(before, 10)},
+			},
+			ExclusiveStartKey: lastEvaluatedKey,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list trashed files: %w", err)
+		}
+
+		items = append(items, out.Items...)
+		if out.LastEvaluatedKey == nil {
+			break
+		}
+		lastEvaluatedKey = out.LastEvaluatedKey
+	}
+
+	var files []UserFile
+	if err := attributevalue.UnmarshalListOfMaps(items, &files); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal files: %w", err)
+	}
+	return files, nil
+}
+
+func (r *DynamoFileRepository) DeleteTrashedFile(ctx context.Context, id string) error {
+	_, err := r.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(r.tableName),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+		ConditionExpression: aws.String("attribute_not_exists(id) OR deletedAt > :zero"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":zero": &types.AttributeValueMemberN{Value: "0"},
+		},
+	})
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return ErrFileNotTrashed
+	}
 	if err != nil {
 		return fmt.Errorf("failed to delete file: %w", err)
 	}
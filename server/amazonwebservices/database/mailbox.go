@@ -0,0 +1,199 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func CreateMailboxTable(client *dynamodb.Client, tableName string) error {
+	_, err := client.DescribeTable(context.TODO(), &dynamodb.DescribeTableInput{
+		TableName: aws.String(tableName),
+	})
+	if err == nil {
+		return nil
+	}
+
+	var notFound *types.ResourceNotFoundException
+	if !errors.As(err, &notFound) {
+		return fmt.Errorf("error checking table existence: %w", err)
+	}
+
+	fmt.Println("Mailbox table not found — creating now...")
+
+	_, err = client.CreateTable(context.TODO(), &dynamodb.CreateTableInput{
+		TableName: aws.String(tableName),
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String("userId"), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String("id"), AttributeType: types.ScalarAttributeTypeS},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String("userId"), KeyType: types.KeyTypeHash},
+			{AttributeName: aws.String("id"), KeyType: types.KeyTypeRange},
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create Mailbox table: %w", err)
+	}
+
+	waiter := dynamodb.NewTableExistsWaiter(client)
+	if err := waiter.Wait(context.TODO(), &dynamodb.DescribeTableInput{TableName: aws.String(tableName)}, 2*time.Minute); err != nil {
+		return fmt.Errorf("failed waiting for Mailbox table: %w", err)
+	}
+	_, err = client.UpdateTimeToLive(context.TODO(), &dynamodb.UpdateTimeToLiveInput{
+		TableName: aws.String(tableName),
+		TimeToLiveSpecification: &types.TimeToLiveSpecification{
+			AttributeName: aws.String("expiresAt"),
+			Enabled:       aws.Bool(true),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to enable TTL on Mailbox table: %w", err)
+	}
+
+	fmt.Println("Mailbox table created.")
+	return nil
+}
+
+// DynamoMailboxRepository is the MailboxRepository backed by a DynamoDB
+// table keyed by user and message ID.
+type DynamoMailboxRepository struct {
+	client    *dynamodb.Client
+	tableName string
+}
+
+func NewDynamoMailboxRepository(client *dynamodb.Client, tableName string) *DynamoMailboxRepository {
+	return &DynamoMailboxRepository{client: client, tableName: tableName}
+}
+
+func (r *DynamoMailboxRepository) StoreMessage(ctx context.Context, msg PendingMessage) error {
+	item, err := attributevalue.MarshalMap(msg)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %w", err)
+	}
+	_, err = r.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(r.tableName),
+		Item:      item,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store message: %w", err)
+	}
+	return nil
+}
+
+func (r *DynamoMailboxRepository) ListMessages(ctx context.Context, userId, afterID string, limit int) ([]PendingMessage, error) {
+	keyCondition := "userId = :user"
+	values := map[string]types.AttributeValue{
+		":user": &types.AttributeValueMemberS{Value: userId},
+		// expired items linger until DynamoDB's TTL sweep removes them
+		":now": &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Unix(), 10)},
+	}
+	if afterID != "" {
+		keyCondition += " AND id > :after"
+		values[":after"] = &types.AttributeValueMemberS{Value: afterID}
+	}
+
+	var messages []PendingMessage
+	var lastEvaluatedKey map[string]types.AttributeValue
+	for len(messages) < limit {
+		out, err := r.client.Query(ctx, &dynamodb.QueryInput{
+			TableName:                 aws.String(r.tableName),
+			KeyConditionExpression:    aws.String(keyCondition),
+			FilterExpression:          aws.String("expiresAt > :now"),
+			ExpressionAttributeValues: values,
+			ScanIndexForward:          aws.Bool(true),
+			Limit:                     aws.Int32(int32(limit - len(messages))),
+			ExclusiveStartKey:         lastEvaluatedKey,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to query messages: %w", err)
+		}
+
+		var page []PendingMessage
+		if err := attributevalue.UnmarshalListOfMaps(out.Items, &page); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal messages: %w", err)
+		}
+		messages = append(messages, page...)
+
+		if out.LastEvaluatedKey == nil {
+			break
+		}
+		lastEvaluatedKey = out.LastEvaluatedKey
+	}
+	return messages, nil
+}
+
+func (r *DynamoMailboxRepository) AckMessage(ctx context.Context, userId, id string) error {
+	_, err := r.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(r.tableName),
+		Key: map[string]types.AttributeValue{
+			"userId": &types.AttributeValueMemberS{Value: userId},
+			"id":     &types.AttributeValueMemberS{Value: id},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to acknowledge message: %w", err)
+	}
+	return nil
+}
+
+// EmbeddedMailboxRepository is the MailboxRepository backed by an
+// EmbeddedDB.
+type EmbeddedMailboxRepository struct {
+	db        *EmbeddedDB
+	tableName string
+}
+
+func NewEmbeddedMailboxRepository(db *EmbeddedDB, tableName string) *EmbeddedMailboxRepository {
+	return &EmbeddedMailboxRepository{db: db, tableName: tableName}
+}
+
+func mailboxKey(userId, id string) string {
+	return userId + "/" + id
+}
+
+func (r *EmbeddedMailboxRepository) StoreMessage(ctx context.Context, msg PendingMessage) error {
+	if err := putItem(r.db, r.tableName, mailboxKey(msg.UserID, msg.ID), msg); err != nil {
+		return fmt.Errorf("failed to store message: %w", err)
+	}
+	return nil
+}
+
+func (r *EmbeddedMailboxRepository) ListMessages(ctx context.Context, userId, afterID string, limit int) ([]PendingMessage, error) {
+	now := time.Now().Unix()
+	r.purgeExpired(now)
+
+	messages, err := scanItems(r.db, r.tableName, func(m *PendingMessage) bool {
+		return m.UserID == userId && m.ID > afterID
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(messages, func(i, j int) bool { return messages[i].ID < messages[j].ID })
+	if len(messages) > limit {
+		messages = messages[:limit]
+	}
+	return messages, nil
+}
+
+func (r *EmbeddedMailboxRepository) purgeExpired(now int64) {
+	deleteItems(r.db, r.tableName, func(m *PendingMessage) bool {
+		return m.ExpiresAt <= now
+	})
+}
+
+func (r *EmbeddedMailboxRepository) AckMessage(ctx context.Context, userId, id string) error {
+	if err := deleteItem(r.db, r.tableName, mailboxKey(userId, id)); err != nil {
+		return fmt.Errorf("failed to acknowledge message: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,498 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+var ErrJobNotReplayable = errors.New("only dead jobs can be replayed")
+
+// sentJobRetention is how long delivered jobs are kept for inspection.
+const sentJobRetention = 7 * 24 * time.Hour
+
+func CreateOutboxTable(client *dynamodb.Client, tableName string) error {
+	_, err := client.DescribeTable(context.TODO(), &dynamodb.DescribeTableInput{
+		TableName: aws.String(tableName),
+	})
+	if err == nil {
+		return nil
+	}
+
+	var notFound *types.ResourceNotFoundException
+	if !errors.As(err, &notFound) {
+		return fmt.Errorf("error checking table existence: %w", err)
+	}
+
+	fmt.Println("Outbox table not found — creating now...")
+
+	_, err = client.CreateTable(context.TODO(), &dynamodb.CreateTableInput{
+		TableName: aws.String(tableName),
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String("id"), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String("status"), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String("nextAttemptAt"), AttributeType: types.ScalarAttributeTypeN},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String("id"), KeyType: types.KeyTypeHash},
+		},
+		GlobalSecondaryIndexes: []types.GlobalSecondaryIndex{
+			{
+				IndexName: aws.String("status-index"),
+				KeySchema: []types.KeySchemaElement{
+					{AttributeName: aws.String("status"), KeyType: types.KeyTypeHash},
+					{AttributeName: aws.String("nextAttemptAt"), KeyType: types.KeyTypeRange},
+				},
+				Projection: &types.Projection{
+					ProjectionType: types.ProjectionTypeKeysOnly,
+				},
+			},
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create Outbox table: %w", err)
+	}
+
+	waiter := dynamodb.NewTableExistsWaiter(client)
+	err = waiter.Wait(context.TODO(), &dynamodb.DescribeTableInput{
+		TableName: aws.String(tableName),
+	}, 2*time.Minute)
+	if err != nil {
+		return fmt.Errorf("failed waiting for Outbox table to become active: %w", err)
+	}
+
+	_, err = client.UpdateTimeToLive(context.TODO(), &dynamodb.UpdateTimeToLiveInput{
+		TableName: aws.String(tableName),
+		TimeToLiveSpecification: &types.TimeToLiveSpecification{
+			AttributeName: aws.String("expiresAt"),
+			Enabled:       aws.Bool(true),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to enable TTL on Outbox table: %w", err)
+	}
+
+	fmt.Println("Outbox table created and active.")
+	return nil
+}
+
+// DynamoOutboxRepository is the OutboxRepository backed by a DynamoDB table.
+// Due jobs are found through the keys-only status-index and claimed one by
+// one with a conditional update, so several servers can share the table.
+type DynamoOutboxRepository struct {
+	client    *dynamodb.Client
+	tableName string
+}
+
+func NewDynamoOutboxRepository(client *dynamodb.Client, tableName string) *DynamoOutboxRepository {
+	return &DynamoOutboxRepository{client: client, tableName: tableName}
+}
+
+func (r *DynamoOutboxRepository) key(id string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"id": &types.AttributeValueMemberS{Value: id},
+	}
+}
+
+func (r *DynamoOutboxRepository) EnqueueJob(ctx context.Context, job OutboxJob) error {
+	now := time.Now().Unix()
+	job.Status = OutboxPending
+	job.CreatedAt = now
+	job.UpdatedAt = now
+	if job.NextAttemptAt == 0 {
+		job.NextAttemptAt = now
+	}
+
+	item, err := attributevalue.MarshalMap(job)
+	if err != nil {
+		return fmt.Errorf("failed to marshal outbox job: %w", err)
+	}
+	_, err = r.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(r.tableName),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(id)"),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to enqueue outbox job: %w", err)
+	}
+	return nil
+}
+
+func (r *DynamoOutboxRepository) GetJob(ctx context.Context, id string) (*OutboxJob, error) {
+	result, err := r.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(r.tableName),
+		Key:            r.key(id),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get outbox job: %w", err)
+	}
+	if result.Item == nil {
+		return nil, nil
+	}
+
+	var job OutboxJob
+	if err := attributevalue.UnmarshalMap(result.Item, &job); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal outbox job: %w", err)
+	}
+	return &job, nil
+}
+
+// queryStatus returns the ids in status, optionally only those due by now.
+func (r *DynamoOutboxRepository) queryStatus(ctx context.Context, status string, dueBy int64, limit int) ([]string, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(r.tableName),
+		IndexName:              aws.String("status-index"),
+		KeyConditionExpression: aws.String("#status = :status"),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "status",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":status": &types.AttributeValueMemberS{Value: status},
+		},
+	}
+	if dueBy > 0 {
+		input.KeyConditionExpression = aws.String("#status = :status AND nextAttemptAt <= :now")
+		input.ExpressionAttributeValues[":now"] = &types.AttributeValueMemberN{Value: fmt.Sprint(dueBy)}
+	}
+
+	var ids []string
+	for {
+		out, err := r.client.Query(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query outbox: %w", err)
+		}
+		for _, item := range out.Items {
+			var job struct {
+				ID string `dynamodbav:"id"`
+			}
+			if err := attributevalue.UnmarshalMap(item, &job); err != nil {
+				return nil, err
+			}
+			ids = append(ids, job.ID)
+		}
+		if out.LastEvaluatedKey == nil || (limit > 0 && len(ids) >= limit) {
+			break
+		}
+		input.ExclusiveStartKey = out.LastEvaluatedKey
+	}
+	if limit > 0 && len(ids) > limit {
+		ids = ids[:limit]
+	}
+	return ids, nil
+}
+
+func (r *DynamoOutboxRepository) ListJobs(ctx context.Context, status string) ([]OutboxJob, error) {
+	ids, err := r.queryStatus(ctx, status, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := make([]OutboxJob, 0, len(ids))
+	for _, id := range ids {
+		job, err := r.GetJob(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if job != nil && job.Status == status {
+			jobs = append(jobs, *job)
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].CreatedAt > jobs[j].CreatedAt })
+	return jobs, nil
+}
+
+func (r *DynamoOutboxRepository) ClaimJobs(ctx context.Context, limit int, lease time.Duration) ([]OutboxJob, error) {
+	now := time.Now().Unix()
+
+	var ids []string
+	for _, status := range []string{OutboxPending, OutboxSending} {
+		found, err := r.queryStatus(ctx, status, now, limit-len(ids))
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, found...)
+		if len(ids) >= limit {
+			break
+		}
+	}
+
+	var claimed []OutboxJob
+	for _, id := range ids {
+		out, err := r.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+			TableName:           aws.String(r.tableName),
+			Key:                 r.key(id),
+			UpdateExpression:    aws.String("SET #status = :sending, nextAttemptAt = :lease, attempts = attempts + :one, updatedAt = :now"),
+			ConditionExpression: aws.String("(#status = :pending OR #status = :sending) AND nextAttemptAt <= :now"),
+			ExpressionAttributeNames: map[string]string{
+				"#status": "status",
+			},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":pending": &types.AttributeValueMemberS{Value: OutboxPending},
+				":sending": &types.AttributeValueMemberS{Value: OutboxSending},
+				":lease":   &types.AttributeValueMemberN{Value: fmt.Sprint(now + int64(lease.Seconds()))},
+				":now":     &types.AttributeValueMemberN{Value: fmt.Sprint(now)},
+				":one":     &types.AttributeValueMemberN{Value: "1"},
+			},
+			ReturnValues: types.ReturnValueAllNew,
+		})
+		var conditionFailed *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionFailed) {
+			// another worker got it first, the index is eventually consistent
+			continue
+		}
+		if err != nil {
+			return claimed, fmt.Errorf("failed to claim outbox job: %w", err)
+		}
+
+		var job OutboxJob
+		if err := attributevalue.UnmarshalMap(out.Attributes, &job); err != nil {
+			return claimed, fmt.Errorf("failed to unmarshal outbox job: %w", err)
+		}
+		claimed = append(claimed, job)
+	}
+	return claimed, nil
+}
+
+func (r *DynamoOutboxRepository) CompleteJob(ctx context.Context, id, providerID string) error {
+	now := time.Now()
+	_, err := r.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:        aws.String(r.tableName),
+		Key:              r.key(id),
+		UpdateExpression: aws.String("SET #status = :sent, providerId = :provider, sentAt = :now, updatedAt = :now, expiresAt = :expires REMOVE lastError"),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "status",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":sent":     &types.AttributeValueMemberS{Value: OutboxSent},
+			":provider": &types.AttributeValueMemberS{Value: providerID},
+			":now":      &types.AttributeValueMemberN{Value: fmt.Sprint(now.Unix())},
+			":expires":  &types.AttributeValueMemberN{Value: fmt.Sprint(now.Add(sentJobRetention).Unix())},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to complete outbox job: %w", err)
+	}
+	return nil
+}
+
+func (r *DynamoOutboxRepository) FailJob(ctx context.Context, id, lastError string, retryAt int64, dead bool) error {
+	status := OutboxPending
+	if dead {
+		status = OutboxDead
+	}
+	_, err := r.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:        aws.String(r.tableName),
+		Key:              r.key(id),
+		UpdateExpression: aws.String("SET #status = :status, lastError = :error, nextAttemptAt = :retry, updatedAt = :now"),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "status",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":status": &types.AttributeValueMemberS{Value: status},
+			":error":  &types.AttributeValueMemberS{Value: lastError},
+			":retry":  &types.AttributeValueMemberN{Value: fmt.Sprint(retryAt)},
+			":now":    &types.AttributeValueMemberN{Value: fmt.Sprint(time.Now().Unix())},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update outbox job: %w", err)
+	}
+	return nil
+}
+
+func (r *DynamoOutboxRepository) ReplayJob(ctx context.Context, id string) (*OutboxJob, error) {
+	now := time.Now().Unix()
+	out, err := r.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(r.tableName),
+		Key:                 r.key(id),
+		UpdateExpression:    aws.String("SET #status = :pending, attempts = :zero, nextAttemptAt = :now, updatedAt = :now"),
+		ConditionExpression: aws.String("#status = :dead"),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "status",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":pending": &types.AttributeValueMemberS{Value: OutboxPending},
+			":dead":    &types.AttributeValueMemberS{Value: OutboxDead},
+			":zero":    &types.AttributeValueMemberN{Value: "0"},
+			":now":     &types.AttributeValueMemberN{Value: fmt.Sprint(now)},
+		},
+		ReturnValues: types.ReturnValueAllNew,
+	})
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		job, err := r.GetJob(ctx, id)
+		if err != nil || job == nil {
+			return nil, err
+		}
+		return job, ErrJobNotReplayable
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to replay outbox job: %w", err)
+	}
+
+	var job OutboxJob
+	if err := attributevalue.UnmarshalMap(out.Attributes, &job); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal outbox job: %w", err)
+	}
+	return &job, nil
+}
+
+// EmbeddedOutboxRepository is the OutboxRepository backed by an EmbeddedDB.
+type EmbeddedOutboxRepository struct {
+	db        *EmbeddedDB
+	tableName string
+}
+
+func NewEmbeddedOutboxRepository(db *EmbeddedDB, tableName string) *EmbeddedOutboxRepository {
+	return &EmbeddedOutboxRepository{db: db, tableName: tableName}
+}
+
+func (r *EmbeddedOutboxRepository) EnqueueJob(ctx context.Context, job OutboxJob) error {
+	now := time.Now().Unix()
+	job.Status = OutboxPending
+	job.CreatedAt = now
+	job.UpdatedAt = now
+	if job.NextAttemptAt == 0 {
+		job.NextAttemptAt = now
+	}
+	err := updateItem(r.db, r.tableName, job.ID, func(existing *OutboxJob, exists bool) error {
+		if exists {
+			return fmt.Errorf("outbox job %s already exists", job.ID)
+		}
+		*existing = job
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to enqueue outbox job: %w", err)
+	}
+	return nil
+}
+
+func (r *EmbeddedOutboxRepository) GetJob(ctx context.Context, id string) (*OutboxJob, error) {
+	return getItem[OutboxJob](r.db, r.tableName, id)
+}
+
+func (r *EmbeddedOutboxRepository) ListJobs(ctx context.Context, status string) ([]OutboxJob, error) {
+	jobs, err := scanItems(r.db, r.tableName, func(j *OutboxJob) bool {
+		return j.Status == status
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].CreatedAt > jobs[j].CreatedAt })
+	return jobs, nil
+}
+
+// purgeExpired stands in for DynamoDB TTL.
+func (r *EmbeddedOutboxRepository) purgeExpired(now int64) {
+	deleteItems(r.db, r.tableName, func(j *OutboxJob) bool {
+		return j.ExpiresAt != 0 && j.ExpiresAt <= now
+	})
+}
+
+func (r *EmbeddedOutboxRepository) ClaimJobs(ctx context.Context, limit int, lease time.Duration) ([]OutboxJob, error) {
+	now := time.Now().Unix()
+	r.purgeExpired(now)
+
+	due, err := scanItems(r.db, r.tableName, func(j *OutboxJob) bool {
+		return (j.Status == OutboxPending || j.Status == OutboxSending) && j.NextAttemptAt <= now
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].NextAttemptAt < due[j].NextAttemptAt })
+
+	var claimed []OutboxJob
+	for _, candidate := range due {
+		if len(claimed) >= limit {
+			break
+		}
+		err := updateItem(r.db, r.tableName, candidate.ID, func(job *OutboxJob, exists bool) error {
+			if !exists || (job.Status != OutboxPending && job.Status != OutboxSending) || job.NextAttemptAt > now {
+				return errNoItem
+			}
+			job.Status = OutboxSending
+			job.NextAttemptAt = now + int64(lease.Seconds())
+			job.Attempts++
+			job.UpdatedAt = now
+			claimed = append(claimed, *job)
+			return nil
+		})
+		if err != nil && !errors.Is(err, errNoItem) {
+			return claimed, fmt.Errorf("failed to claim outbox job: %w", err)
+		}
+	}
+	return claimed, nil
+}
+
+func (r *EmbeddedOutboxRepository) CompleteJob(ctx context.Context, id, providerID string) error {
+	now := time.Now()
+	err := updateItem(r.db, r.tableName, id, func(job *OutboxJob, exists bool) error {
+		if !exists {
+			return errNoItem
+		}
+		job.Status = OutboxSent
+		job.ProviderID = providerID
+		job.LastError = ""
+		job.SentAt = now.Unix()
+		job.UpdatedAt = now.Unix()
+		job.ExpiresAt = now.Add(sentJobRetention).Unix()
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to complete outbox job: %w", err)
+	}
+	return nil
+}
+
+func (r *EmbeddedOutboxRepository) FailJob(ctx context.Context, id, lastError string, retryAt int64, dead bool) error {
+	err := updateItem(r.db, r.tableName, id, func(job *OutboxJob, exists bool) error {
+		if !exists {
+			return errNoItem
+		}
+		job.Status = OutboxPending
+		if dead {
+			job.Status = OutboxDead
+		}
+		job.LastError = lastError
+		job.NextAttemptAt = retryAt
+		job.UpdatedAt = time.Now().Unix()
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update outbox job: %w", err)
+	}
+	return nil
+}
+
+func (r *EmbeddedOutboxRepository) ReplayJob(ctx context.Context, id string) (*OutboxJob, error) {
+	var replayed *OutboxJob
+	now := time.Now().Unix()
+	err := updateItem(r.db, r.tableName, id, func(job *OutboxJob, exists bool) error {
+		if !exists {
+			return errNoItem
+		}
+		replayed = job
+		if job.Status != OutboxDead {
+			return ErrJobNotReplayable
+		}
+		job.Status = OutboxPending
+		job.Attempts = 0
+		job.NextAttemptAt = now
+		job.UpdatedAt = now
+		return nil
+	})
+	if errors.Is(err, errNoItem) {
+		return nil, nil
+	}
+	return replayed, err
+}
@@ -0,0 +1,166 @@
+package database
+
+import (
+	"context"
+	"time"
+)
+
+// UserRepository is the storage contract for user accounts. Lookups return
+// nil, nil when the user does not exist. Emails are matched case-insensitively.
+type UserRepository interface {
+	CreateUser(ctx context.Context, id, name, email, password string) (*User, error)
+	GetUserById(ctx context.Context, id string) (*User, error)
+	GetUserByEmail(ctx context.Context, email string) (*User, error)
+	GetAllUsers(ctx context.Context) ([]User, error)
+	UpdateUser(ctx context.Context, user User) error
+	UpdatePassword(ctx context.Context, user User) error
+	// UpdateTOTP writes the two-factor fields of user as given, so an
+	// empty secret or code list clears them.
+	UpdateTOTP(ctx context.Context, user User) error
+	// UseTOTPStep records step as the user's last used TOTP step. It
+	// reports false when a step as late has already been used.
+	UseTOTPStep(ctx context.Context, id string, step int64) (bool, error)
+	// UseRecoveryCode removes the recovery code hash at index. It reports
+	// false when that is no longer where hash is.
+	UseRecoveryCode(ctx context.Context, id string, index int, hash string) (bool, error)
+	// UpdateLastSeen records when the user was last active, leaving
+	// updatedAt alone.
+	UpdateLastSeen(ctx context.Context, id string, at int64) error
+	DeleteUser(ctx context.Context, id string) error
+}
+
+// FileRepository is the storage contract for file records. GetFile returns
+// nil, nil when the record does not exist, and per-user listings are sorted
+// newest first by createdAt.
+type FileRepository interface {
+	CreateFile(ctx context.Context, file UserFile) error
+	GetFile(ctx context.Context, id string) (*UserFile, error)
+	ListFiles(ctx context.Context) ([]UserFile, error)
+	// ScanFiles calls fn with every file, a page at a time, and stops at the
+	// first error fn returns.
+	ScanFiles(ctx context.Context, fn func(page []UserFile) error) error
+	ListFilesByUserSorted(ctx context.Context, userId string) ([]UserFile, error)
+	// UpdateEncryption replaces the encryption metadata of a file, as when
+	// its data key is wrapped again under a new master key. It fails with
+	// ErrFileChanged unless the file is still stored at fileKey.
+	UpdateEncryption(ctx context.Context, id, fileKey string, enc FileEncryption) error
+	// UpdateContentInfo corrects the recorded size and checksum of a file's
+	// content, as long as it is still stored at fileKey.
+	UpdateContentInfo(ctx context.Context, id, fileKey string, size int64, sha256 string) error
+	// SetCurrentVersion makes version the file's current content. A file
+	// whose current version is numbered higher is left alone, so versions
+	// added at the same time end up with the newest current.
+	SetCurrentVersion(ctx context.Context, id string, version FileVersion) error
+	// TrashFile moves a file to the trash at deletedAt. A file already
+	// there keeps the time it was first trashed.
+	TrashFile(ctx context.Context, id string, deletedAt int64) error
+	// RestoreFile takes a file back out of the trash.
+	RestoreFile(ctx context.Context, id string) error
+	// ListTrashedFiles returns the files trashed before the given time.
+	ListTrashedFiles(ctx context.Context, before int64) ([]UserFile, error)
+	// DeleteTrashedFile deletes a file that is in the trash. It returns
+	// ErrFileNotTrashed when the file has been taken out of the trash, and
+	// nil when it is already gone.
+	DeleteTrashedFile(ctx context.Context, id string) error
+}
+
+// VersionRepository stores file versions. GetVersion returns nil, nil when
+// the version does not exist, and listings are sorted newest first.
+type VersionRepository interface {
+	// CreateVersion fails with ErrVersionExists when the file already has a
+	// version with that number.
+	CreateVersion(ctx context.Context, version FileVersion) error
+	GetVersion(ctx context.Context, fileId string, number int) (*FileVersion, error)
+	ListVersions(ctx context.Context, fileId string) ([]FileVersion, error)
+	UpdateVersionEncryption(ctx context.Context, fileId string, number int, enc FileEncryption) error
+	// UpdateVersionContentInfo corrects the recorded size and checksum of a
+	// version's content.
+	UpdateVersionContentInfo(ctx context.Context, fileId string, number int, size int64, sha256 string) error
+	DeleteVersion(ctx context.Context, fileId string, number int) error
+}
+
+// TokenRepository stores refresh token state and revocations. Records past
+// their ExpiresAt are treated as absent.
+type TokenRepository interface {
+	SaveToken(ctx context.Context, token TokenRecord) error
+	// ConsumeToken atomically marks a single-use record, such as a
+	// refresh token, as used. It returns the record and ErrTokenReused
+	// when it was already used, and nil, nil when it does not exist or has
+	// expired.
+	ConsumeToken(ctx context.Context, id string) (*TokenRecord, error)
+	// CountAttempt atomically counts an attempt against the record id,
+	// creating it to expire at expiresAt. Once max attempts have been
+	// counted, or the record has been used, it counts nothing and reports
+	// false, with the record.
+	CountAttempt(ctx context.Context, id string, max int, expiresAt int64) (*TokenRecord, bool, error)
+	GetTokens(ctx context.Context, ids ...string) ([]TokenRecord, error)
+}
+
+// ShareRepository stores share links. GetShare returns nil, nil when the
+// share does not exist, and listings are sorted newest first.
+type ShareRepository interface {
+	CreateShare(ctx context.Context, share Share) error
+	GetShare(ctx context.Context, token string) (*Share, error)
+	ListSharesByUser(ctx context.Context, userId string) ([]Share, error)
+	// ConsumeShare atomically records one use of a share, taking one of its
+	// remaining uses. It returns the updated share, the current share and
+	// ErrShareUnavailable when it is revoked, expired or used up, and
+	// nil, nil when it does not exist.
+	ConsumeShare(ctx context.Context, token string) (*Share, error)
+	RevokeShare(ctx context.Context, token string) error
+}
+
+// FaceAttemptRepository is the audit log of face share attempts. Listings
+// are sorted oldest first.
+type FaceAttemptRepository interface {
+	RecordAttempt(ctx context.Context, attempt FaceAttempt) error
+	ListAttempts(ctx context.Context, shareToken string) ([]FaceAttempt, error)
+}
+
+// OutboxRepository is the persistent email queue. GetJob and ReplayJob
+// return nil, nil when the job does not exist.
+type OutboxRepository interface {
+	EnqueueJob(ctx context.Context, job OutboxJob) error
+	GetJob(ctx context.Context, id string) (*OutboxJob, error)
+	// ListJobs returns the jobs in status, newest first.
+	ListJobs(ctx context.Context, status string) ([]OutboxJob, error)
+	// ClaimJobs leases up to limit due jobs to the caller, marking them as
+	// sending and counting the attempt. Jobs whose lease ran out are due
+	// again.
+	ClaimJobs(ctx context.Context, limit int, lease time.Duration) ([]OutboxJob, error)
+	CompleteJob(ctx context.Context, id, providerID string) error
+	// FailJob returns a job to pending until retryAt, or moves it to dead
+	// when dead is set.
+	FailJob(ctx context.Context, id, lastError string, retryAt int64, dead bool) error
+	// ReplayJob moves a dead job back to pending with its attempts reset.
+	// It returns ErrJobNotReplayable for jobs in any other status.
+	ReplayJob(ctx context.Context, id string) (*OutboxJob, error)
+}
+
+// MailboxRepository keeps direct websocket messages for their recipients
+// until acknowledged. ListMessages returns a user's unexpired messages with
+// IDs after afterID, oldest first, at most limit of them.
+type MailboxRepository interface {
+	StoreMessage(ctx context.Context, msg PendingMessage) error
+	ListMessages(ctx context.Context, userId, afterID string, limit int) ([]PendingMessage, error)
+	AckMessage(ctx context.Context, userId, id string) error
+}
+
+// UploadRepository tracks multipart uploads in progress. GetUpload returns
+// nil, nil when the upload does not exist.
+type UploadRepository interface {
+	CreateUpload(ctx context.Context, upload Upload) error
+	GetUpload(ctx context.Context, id string) (*Upload, error)
+	// TouchUpload records activity on an upload, keeping it from the
+	// sweeper.
+	TouchUpload(ctx context.Context, id string, at int64) error
+	// ClaimUpload marks an upload as being finalized at the given time,
+	// which also counts as activity. It reports false when the upload is
+	// gone or already claimed.
+	ClaimUpload(ctx context.Context, id string, at int64) (bool, error)
+	// ReleaseUpload undoes ClaimUpload, so finalizing can be tried again.
+	ReleaseUpload(ctx context.Context, id string) error
+	// ListStaleUploads returns the uploads with no activity since before.
+	ListStaleUploads(ctx context.Context, before int64) ([]Upload, error)
+	DeleteUpload(ctx context.Context, id string) error
+}
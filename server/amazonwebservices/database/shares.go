@@ -0,0 +1,301 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+var ErrShareUnavailable = errors.New("share is revoked, expired or used up")
+
+func CreateSharesTable(client *dynamodb.Client, tableName string) error {
+	_, err := client.DescribeTable(context.TODO(), &dynamodb.DescribeTableInput{
+		TableName: aws.String(tableName),
+	})
+	if err == nil {
+		return nil
+	}
+
+	var notFound *types.ResourceNotFoundException
+	if !errors.As(err, &notFound) {
+		return fmt.Errorf("error checking table existence: %w", err)
+	}
+
+	fmt.Println("Shares table not found — creating now...")
+
+	_, err = client.CreateTable(context.TODO(), &dynamodb.CreateTableInput{
+		TableName: aws.String(tableName),
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String("token"), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String("createdBy"), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String("createdAt"), AttributeType: types.ScalarAttributeTypeN},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String("token"), KeyType: types.KeyTypeHash},
+		},
+		GlobalSecondaryIndexes: []types.GlobalSecondaryIndex{
+			{
+				IndexName: aws.String("createdBy-index"),
+				KeySchema: []types.KeySchemaElement{
+					{AttributeName: aws.String("createdBy"), KeyType: types.KeyTypeHash},
+					{AttributeName: aws.String("createdAt"), KeyType: types.KeyTypeRange},
+				},
+				Projection: &types.Projection{
+					ProjectionType: types.ProjectionTypeAll,
+				},
+			},
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create Shares table: %w", err)
+	}
+
+	fmt.Println("Shares table created.")
+	return nil
+}
+
+// DynamoShareRepository is the ShareRepository backed by a DynamoDB table.
+type DynamoShareRepository struct {
+	client    *dynamodb.Client
+	tableName string
+}
+
+func NewDynamoShareRepository(client *dynamodb.Client, tableName string) *DynamoShareRepository {
+	return &DynamoShareRepository{client: client, tableName: tableName}
+}
+
+func (r *DynamoShareRepository) CreateShare(ctx context.Context, share Share) error {
+	if share.CreatedAt == 0 {
+		share.CreatedAt = time.Now().Unix()
+	}
+	item, err := attributevalue.MarshalMap(share)
+	if err != nil {
+		return fmt.Errorf("failed to marshal share: %w", err)
+	}
+	_, err = r.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(r.tableName),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(#token)"),
+		ExpressionAttributeNames: map[string]string{
+			"#token": "token",
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to insert share: %w", err)
+	}
+	return nil
+}
+
+func (r *DynamoShareRepository) GetShare(ctx context.Context, token string) (*Share, error) {
+	result, err := r.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(r.tableName),
+		Key: map[string]types.AttributeValue{
+			"token": &types.AttributeValueMemberS{Value: token},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get share: %w", err)
+	}
+	if result.Item == nil {
+		return nil, nil
+	}
+
+	var share Share
+	if err := attributevalue.UnmarshalMap(result.Item, &share); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal share: %w", err)
+	}
+	return &share, nil
+}
+
+func (r *DynamoShareRepository) ListSharesByUser(ctx context.Context, userId string) ([]Share, error) {
+	var items []map[string]types.AttributeValue
+	var lastEvaluatedKey map[string]types.AttributeValue
+
+	for {
+		out, err := r.client.Query(ctx, &dynamodb.QueryInput{
+			TableName:              aws.String(r.tableName),
+			IndexName:              aws.String("createdBy-index"),
+			KeyConditionExpression: aws.String("createdBy = :user"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":user": &types.AttributeValueMemberS{Value: userId},
+			},
+			ScanIndexForward:  aws.Bool(false),
+			ExclusiveStartKey: lastEvaluatedKey,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to query shares: %w", err)
+		}
+		items = append(items, out.Items...)
+
+		if out.LastEvaluatedKey == nil {
+			break
+		}
+		lastEvaluatedKey = out.LastEvaluatedKey
+	}
+
+	var shares []Share
+	if err := attributevalue.UnmarshalListOfMaps(items, &shares); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal shares: %w", err)
+	}
+	return shares, nil
+}
+
+func (r *DynamoShareRepository) ConsumeShare(ctx context.Context, token string) (*Share, error) {
+	share, err := r.GetShare(ctx, token)
+	if err != nil || share == nil {
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+	update := "SET useCount = useCount + :one, lastUsedAt = :now"
+	condition := "revoked = :false AND expiresAt > :now"
+	// maxUses never changes, so it is safe to pick the expression from it
+	if share.MaxUses > 0 {
+		update += ", remainingUses = remainingUses - :one"
+		condition += " AND remainingUses > :zero"
+	}
+
+	out, err := r.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(r.tableName),
+		Key: map[string]types.AttributeValue{
+			"token": &types.AttributeValueMemberS{Value: token},
+		},
+		UpdateExpression:    aws.String(update),
+		ConditionExpression: aws.String(condition),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":one":   &types.AttributeValueMemberN{Value: "1"},
+			":zero":  &types.AttributeValueMemberN{Value: "0"},
+			":now":   &types.AttributeValueMemberN{Value: fmt.Sprint(now)},
+			":false": &types.AttributeValueMemberBOOL{Value: false},
+		},
+		ReturnValues:                        types.ReturnValueAllNew,
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	})
+
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		if conditionFailed.Item != nil {
+			attributevalue.UnmarshalMap(conditionFailed.Item, share)
+		}
+		return share, ErrShareUnavailable
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to consume share: %w", err)
+	}
+
+	var updated Share
+	if err := attributevalue.UnmarshalMap(out.Attributes, &updated); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal share: %w", err)
+	}
+	return &updated, nil
+}
+
+func (r *DynamoShareRepository) RevokeShare(ctx context.Context, token string) error {
+	_, err := r.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(r.tableName),
+		Key: map[string]types.AttributeValue{
+			"token": &types.AttributeValueMemberS{Value: token},
+		},
+		UpdateExpression:    aws.String("SET revoked = :true"),
+		ConditionExpression: aws.String("attribute_exists(#token)"),
+		ExpressionAttributeNames: map[string]string{
+			"#token": "token",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":true": &types.AttributeValueMemberBOOL{Value: true},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to revoke share: %w", err)
+	}
+	return nil
+}
+
+// EmbeddedShareRepository is the ShareRepository backed by an EmbeddedDB.
+type EmbeddedShareRepository struct {
+	db        *EmbeddedDB
+	tableName string
+}
+
+func NewEmbeddedShareRepository(db *EmbeddedDB, tableName string) *EmbeddedShareRepository {
+	return &EmbeddedShareRepository{db: db, tableName: tableName}
+}
+
+func (r *EmbeddedShareRepository) CreateShare(ctx context.Context, share Share) error {
+	if share.CreatedAt == 0 {
+		share.CreatedAt = time.Now().Unix()
+	}
+	err := updateItem(r.db, r.tableName, share.Token, func(existing *Share, exists bool) error {
+		if exists {
+			return fmt.Errorf("share %s already exists", share.Token)
+		}
+		*existing = share
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to insert share: %w", err)
+	}
+	return nil
+}
+
+func (r *EmbeddedShareRepository) GetShare(ctx context.Context, token string) (*Share, error) {
+	return getItem[Share](r.db, r.tableName, token)
+}
+
+func (r *EmbeddedShareRepository) ListSharesByUser(ctx context.Context, userId string) ([]Share, error) {
+	shares, err := scanItems(r.db, r.tableName, func(s *Share) bool {
+		return s.CreatedBy == userId
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(shares, func(i, j int) bool { return shares[i].CreatedAt > shares[j].CreatedAt })
+	return shares, nil
+}
+
+func (r *EmbeddedShareRepository) ConsumeShare(ctx context.Context, token string) (*Share, error) {
+	var consumed *Share
+	now := time.Now().Unix()
+	err := updateItem(r.db, r.tableName, token, func(share *Share, exists bool) error {
+		if !exists {
+			return errNoItem
+		}
+		consumed = share
+		if !share.Usable(now) {
+			return ErrShareUnavailable
+		}
+		if share.MaxUses > 0 {
+			share.RemainingUses--
+		}
+		share.UseCount++
+		share.LastUsedAt = now
+		return nil
+	})
+	if errors.Is(err, errNoItem) {
+		return nil, nil
+	}
+	return consumed, err
+}
+
+func (r *EmbeddedShareRepository) RevokeShare(ctx context.Context, token string) error {
+	err := updateItem(r.db, r.tableName, token, func(share *Share, exists bool) error {
+		if !exists {
+			return errNoItem
+		}
+		share.Revoked = true
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to revoke share: %w", err)
+	}
+	return nil
+}
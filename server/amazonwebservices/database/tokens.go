@@ -0,0 +1,293 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+var ErrTokenReused = errors.New("token already used")
+
+func CreateTokensTable(client *dynamodb.Client, tableName string) error {
+	_, err := client.DescribeTable(context.TODO(), &dynamodb.DescribeTableInput{
+		TableName: aws.String(tableName),
+	})
+	if err == nil {
+		return nil
+	}
+
+	var notFound *types.ResourceNotFoundException
+	if !errors.As(err, &notFound) {
+		return fmt.Errorf("error checking table existence: %w", err)
+	}
+
+	fmt.Println("Tokens table not found — creating now...")
+
+	_, err = client.CreateTable(context.TODO(), &dynamodb.CreateTableInput{
+		TableName: aws.String(tableName),
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String("id"), AttributeType: types.ScalarAttributeTypeS},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String("id"), KeyType: types.KeyTypeHash},
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create Tokens table: %w", err)
+	}
+
+	waiter := dynamodb.NewTableExistsWaiter(client)
+	err = waiter.Wait(context.TODO(), &dynamodb.DescribeTableInput{
+		TableName: aws.String(tableName),
+	}, 2*time.Minute)
+	if err != nil {
+		return fmt.Errorf("failed waiting for Tokens table to become active: %w", err)
+	}
+
+	_, err = client.UpdateTimeToLive(context.TODO(), &dynamodb.UpdateTimeToLiveInput{
+		TableName: aws.String(tableName),
+		TimeToLiveSpecification: &types.TimeToLiveSpecification{
+			AttributeName: aws.String("expiresAt"),
+			Enabled:       aws.Bool(true),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to enable TTL on Tokens table: %w", err)
+	}
+
+	fmt.Println("Tokens table created and active.")
+	return nil
+}
+
+// DynamoTokenRepository is the TokenRepository backed by a DynamoDB table
+// with TTL on expiresAt.
+type DynamoTokenRepository struct {
+	client    *dynamodb.Client
+	tableName string
+}
+
+func NewDynamoTokenRepository(client *dynamodb.Client, tableName string) *DynamoTokenRepository {
+	return &DynamoTokenRepository{client: client, tableName: tableName}
+}
+
+func (r *DynamoTokenRepository) SaveToken(ctx context.Context, token TokenRecord) error {
+	if token.CreatedAt == 0 {
+		token.CreatedAt = time.Now().Unix()
+	}
+	item, err := attributevalue.MarshalMap(token)
+	if err != nil {
+		return fmt.Errorf("failed to marshal token: %w", err)
+	}
+	_, err = r.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(r.tableName),
+		Item:      item,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save token: %w", err)
+	}
+	return nil
+}
+
+func (r *DynamoTokenRepository) ConsumeToken(ctx context.Context, id string) (*TokenRecord, error) {
+	now := time.Now().Unix()
+	out, err := r.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(r.tableName),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+		UpdateExpression:    aws.String("SET usedAt = :now"),
+		ConditionExpression: aws.String("attribute_exists(id) AND usedAt = :zero AND expiresAt > :now"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":now":  &types.AttributeValueMemberN{Value: fmt.Sprint(now)},
+			":zero": &types.AttributeValueMemberN{Value: "0"},
+		},
+		ReturnValues: types.ReturnValueAllNew,
+	})
+
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		// either missing, expired or already used; look at it to tell which
+		tokens, err := r.GetTokens(ctx, id)
+		if err != nil || len(tokens) == 0 || tokens[0].UsedAt == 0 || tokens[0].ExpiresAt <= now {
+			return nil, err
+		}
+		return &tokens[0], ErrTokenReused
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to consume token: %w", err)
+	}
+
+	var token TokenRecord
+	if err := attributevalue.UnmarshalMap(out.Attributes, &token); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal token: %w", err)
+	}
+	return &token, nil
+}
+
+func (r *DynamoTokenRepository) CountAttempt(ctx context.Context, id string, max int, expiresAt int64) (*TokenRecord, bool, error) {
+	now := time.Now().Unix()
+	_, err := r.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(r.tableName),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+		UpdateExpression: aws.String("SET #kind = :kind, usedAt = if_not_exists(usedAt, :zero), " +
+			"createdAt = if_not_exists(createdAt, :now), expiresAt = if_not_exists(expiresAt, :expires) ADD attempts :one"),
+		ConditionExpression: aws.String("(attribute_not_exists(attempts) OR attempts < :max) AND (attribute_not_exists(usedAt) OR usedAt = :zero)"),
+		ExpressionAttributeNames: map[string]string{
+			"#kind": "kind",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":kind":    &types.AttributeValueMemberS{Value: TokenKindAttempts},
+			":zero":    &types.AttributeValueMemberN{Value: "0"},
+			":one":     &types.AttributeValueMemberN{Value: "1"},
+			":max":     &types.AttributeValueMemberN{Value: fmt.Sprint(max)},
+			":now":     &types.AttributeValueMemberN{Value: fmt.Sprint(now)},
+			":expires": &types.AttributeValueMemberN{Value: fmt.Sprint(expiresAt)},
+		},
+	})
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		tokens, err := r.GetTokens(ctx, id)
+		if err != nil || len(tokens) == 0 {
+			return nil, false, err
+		}
+		return &tokens[0], false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to count attempt: %w", err)
+	}
+	return nil, true, nil
+}
+
+func (r *DynamoTokenRepository) GetTokens(ctx context.Context, ids ...string) ([]TokenRecord, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	keys := make([]map[string]types.AttributeValue, 0, len(ids))
+	for _, id := range ids {
+		keys = append(keys, map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		})
+	}
+
+	var items []map[string]types.AttributeValue
+	request := map[string]types.KeysAndAttributes{
+		r.tableName: {Keys: keys, ConsistentRead: aws.Bool(true)},
+	}
+	for len(request) > 0 {
+		out, err := r.client.BatchGetItem(ctx, &dynamodb.BatchGetItemInput{RequestItems: request})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get tokens: %w", err)
+		}
+		items = append(items, out.Responses[r.tableName]...)
+		request = out.UnprocessedKeys
+	}
+
+	var tokens []TokenRecord
+	if err := attributevalue.UnmarshalListOfMaps(items, &tokens); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal tokens: %w", err)
+	}
+
+	// TTL deletion is lazy, so expired items can still be returned
+	now := time.Now().Unix()
+	live := tokens[:0]
+	for _, t := range tokens {
+		if t.ExpiresAt > now {
+			live = append(live, t)
+		}
+	}
+	return live, nil
+}
+
+// EmbeddedTokenRepository is the TokenRepository backed by an EmbeddedDB.
+type EmbeddedTokenRepository struct {
+	db        *EmbeddedDB
+	tableName string
+}
+
+func NewEmbeddedTokenRepository(db *EmbeddedDB, tableName string) *EmbeddedTokenRepository {
+	return &EmbeddedTokenRepository{db: db, tableName: tableName}
+}
+
+func (r *EmbeddedTokenRepository) SaveToken(ctx context.Context, token TokenRecord) error {
+	if token.CreatedAt == 0 {
+		token.CreatedAt = time.Now().Unix()
+	}
+	r.purgeExpired()
+	return putItem(r.db, r.tableName, token.ID, token)
+}
+
+// purgeExpired stands in for DynamoDB TTL.
+func (r *EmbeddedTokenRepository) purgeExpired() {
+	now := time.Now().Unix()
+	deleteItems(r.db, r.tableName, func(t *TokenRecord) bool {
+		return t.ExpiresAt <= now
+	})
+}
+
+func (r *EmbeddedTokenRepository) ConsumeToken(ctx context.Context, id string) (*TokenRecord, error) {
+	var consumed *TokenRecord
+	now := time.Now().Unix()
+	err := updateItem(r.db, r.tableName, id, func(token *TokenRecord, exists bool) error {
+		if !exists || token.ExpiresAt <= now {
+			return errNoItem
+		}
+		consumed = token
+		if token.UsedAt != 0 {
+			return ErrTokenReused
+		}
+		token.UsedAt = now
+		return nil
+	})
+	if errors.Is(err, errNoItem) {
+		return nil, nil
+	}
+	return consumed, err
+}
+
+func (r *EmbeddedTokenRepository) CountAttempt(ctx context.Context, id string, max int, expiresAt int64) (*TokenRecord, bool, error) {
+	var refused *TokenRecord
+	now := time.Now().Unix()
+	err := updateItem(r.db, r.tableName, id, func(token *TokenRecord, exists bool) error {
+		if !exists || token.ExpiresAt <= now {
+			*token = TokenRecord{ID: id, Kind: TokenKindAttempts, CreatedAt: now, ExpiresAt: expiresAt}
+		}
+		if token.Attempts >= max || token.UsedAt != 0 {
+			refused = token
+			return errNoItem
+		}
+		token.Attempts++
+		return nil
+	})
+	if errors.Is(err, errNoItem) {
+		return refused, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to count attempt: %w", err)
+	}
+	return nil, true, nil
+}
+
+func (r *EmbeddedTokenRepository) GetTokens(ctx context.Context, ids ...string) ([]TokenRecord, error) {
+	now := time.Now().Unix()
+	var tokens []TokenRecord
+	for _, id := range ids {
+		token, err := getItem[TokenRecord](r.db, r.tableName, id)
+		if err != nil {
+			return nil, err
+		}
+		if token != nil && token.ExpiresAt > now {
+			tokens = append(tokens, *token)
+		}
+	}
+	return tokens, nil
+}
@@ -0,0 +1,278 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+func CreateUploadsTable(client *dynamodb.Client, tableName string) error {
+	_, err := client.DescribeTable(context.TODO(), &dynamodb.DescribeTableInput{
+		TableName: aws.String(tableName),
+	})
+	if err == nil {
+		return nil
+	}
+
+	var notFound *types.ResourceNotFoundException
+	if !errors.As(err, &notFound) {
+		return fmt.Errorf("error checking table existence: %w", err)
+	}
+
+	fmt.Println("Uploads table not found — creating now...")
+
+	_, err = client.CreateTable(context.TODO(), &dynamodb.CreateTableInput{
+		TableName: aws.String(tableName),
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String("id"), AttributeType: types.ScalarAttributeTypeS},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String("id"), KeyType: types.KeyTypeHash},
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create Uploads table: %w", err)
+	}
+
+	waiter := dynamodb.NewTableExistsWaiter(client)
+	if err := waiter.Wait(context.TODO(), &dynamodb.DescribeTableInput{TableName: aws.String(tableName)}, 2*time.Minute); err != nil {
+		return fmt.Errorf("failed waiting for Uploads table: %w", err)
+	}
+
+	fmt.Println("Uploads table created.")
+	return nil
+}
+
+// DynamoUploadRepository is the UploadRepository backed by a DynamoDB table.
+// Stale uploads are found with a scan, which is fine for a table that only
+// holds uploads in flight.
+type DynamoUploadRepository struct {
+	client    *dynamodb.Client
+	tableName string
+}
+
+func NewDynamoUploadRepository(client *dynamodb.Client, tableName string) *DynamoUploadRepository {
+	return &DynamoUploadRepository{client: client, tableName: tableName}
+}
+
+func (r *DynamoUploadRepository) CreateUpload(ctx context.Context, upload Upload) error {
+	item, err := attributevalue.MarshalMap(upload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal upload: %w", err)
+	}
+	_, err = r.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(r.tableName),
+		Item:      item,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create upload: %w", err)
+	}
+	return nil
+}
+
+func (r *DynamoUploadRepository) GetUpload(ctx context.Context, id string) (*Upload, error) {
+	out, err := r.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(r.tableName),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("dynamodb error: %w", err)
+	}
+	if out.Item == nil {
+		return nil, nil
+	}
+
+	var upload Upload
+	if err := attributevalue.UnmarshalMap(out.Item, &upload); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal upload: %w", err)
+	}
+	return &upload, nil
+}
+
+func (r *DynamoUploadRepository) TouchUpload(ctx context.Context, id string, at int64) error {
+	_, err := r.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(r.tableName),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+		UpdateExpression:    aws.String("SET updatedAt = :at"),
+		ConditionExpression: aws.String("attribute_exists(id)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":at": &types.AttributeValueMemberN{Value: strconv.FormatInt(at, 10)},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to touch upload: %w", err)
+	}
+	return nil
+}
+
+func (r *DynamoUploadRepository) ClaimUpload(ctx context.Context, id string, at int64) (bool, error) {
+	_, err := r.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(r.tableName),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+		UpdateExpression:    aws.String("SET claimedAt = :at, updatedAt = :at"),
+		ConditionExpression: aws.String("attribute_exists(id) AND attribute_not_exists(claimedAt)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":at": &types.AttributeValueMemberN{Value: strconv.FormatInt(at, 10)},
+		},
+	})
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to claim upload: %w", err)
+	}
+	return true, nil
+}
+
+func (r *DynamoUploadRepository) ReleaseUpload(ctx context.Context, id string) error {
+	_, err := r.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(r.tableName),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+		UpdateExpression:    aws.String("REMOVE claimedAt"),
+		ConditionExpression: aws.String("attribute_exists(id)"),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to release upload: %w", err)
+	}
+	return nil
+}
+
+func (r *DynamoUploadRepository) ListStaleUploads(ctx context.Context, before int64) ([]Upload, error) {
+	var items []map[string]types.AttributeValue
+	var lastEvaluatedKey map[string]types.AttributeValue
+	for {
+		out, err := r.client.Scan(ctx, &dynamodb.ScanInput{
+			TableName:        aws.String(r.tableName),
+			FilterExpression: aws.String("updatedAt < :before"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":before": &types.AttributeValueMemberN{Value: strconv.FormatInt(before, 10)},
+			},
+			ExclusiveStartKey: lastEvaluatedKey,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list stale uploads: %w", err)
+		}
+
+		items = append(items, out.Items...)
+		if out.LastEvaluatedKey == nil {
+			break
+		}
+		lastEvaluatedKey = out.LastEvaluatedKey
+	}
+
+	var uploads []Upload
+	if err := attributevalue.UnmarshalListOfMaps(items, &uploads); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal uploads: %w", err)
+	}
+	return uploads, nil
+}
+
+func (r *DynamoUploadRepository) DeleteUpload(ctx context.Context, id string) error {
+	_, err := r.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(r.tableName),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete upload: %w", err)
+	}
+	return nil
+}
+
+// EmbeddedUploadRepository is the UploadRepository backed by an EmbeddedDB.
+type EmbeddedUploadRepository struct {
+	db        *EmbeddedDB
+	tableName string
+}
+
+func NewEmbeddedUploadRepository(db *EmbeddedDB, tableName string) *EmbeddedUploadRepository {
+	return &EmbeddedUploadRepository{db: db, tableName: tableName}
+}
+
+func (r *EmbeddedUploadRepository) CreateUpload(ctx context.Context, upload Upload) error {
+	if err := putItem(r.db, r.tableName, upload.ID, upload); err != nil {
+		return fmt.Errorf("failed to create upload: %w", err)
+	}
+	return nil
+}
+
+func (r *EmbeddedUploadRepository) GetUpload(ctx context.Context, id string) (*Upload, error) {
+	return getItem[Upload](r.db, r.tableName, id)
+}
+
+func (r *EmbeddedUploadRepository) TouchUpload(ctx context.Context, id string, at int64) error {
+	err := updateItem(r.db, r.tableName, id, func(upload *Upload, exists bool) error {
+		if !exists {
+			return errNoItem
+		}
+		upload.UpdatedAt = at
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to touch upload: %w", err)
+	}
+	return nil
+}
+
+func (r *EmbeddedUploadRepository) ClaimUpload(ctx context.Context, id string, at int64) (bool, error) {
+	err := updateItem(r.db, r.tableName, id, func(upload *Upload, exists bool) error {
+		if !exists || upload.ClaimedAt != 0 {
+			return errNoItem
+		}
+		upload.ClaimedAt = at
+		upload.UpdatedAt = at
+		return nil
+	})
+	if errors.Is(err, errNoItem) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to claim upload: %w", err)
+	}
+	return true, nil
+}
+
+func (r *EmbeddedUploadRepository) ReleaseUpload(ctx context.Context, id string) error {
+	err := updateItem(r.db, r.tableName, id, func(upload *Upload, exists bool) error {
+		if !exists {
+			return errNoItem
+		}
+		upload.ClaimedAt = 0
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to release upload: %w", err)
+	}
+	return nil
+}
+
+func (r *EmbeddedUploadRepository) ListStaleUploads(ctx context.Context, before int64) ([]Upload, error) {
+	return scanItems(r.db, r.tableName, func(upload *Upload) bool {
+		return upload.UpdatedAt < before
+	})
+}
+
+func (r *EmbeddedUploadRepository) DeleteUpload(ctx context.Context, id string) error {
+	if err := deleteItem(r.db, r.tableName, id); err != nil {
+		return fmt.Errorf("failed to delete upload: %w", err)
+	}
+	return nil
+}
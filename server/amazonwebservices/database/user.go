@@ -19,6 +19,16 @@ func currentTimestamp() string {
 	return strconv.FormatInt(time.Now().Unix(), 10)
 }
 
+// DynamoUserRepository is the UserRepository backed by a DynamoDB table.
+type DynamoUserRepository struct {
+	client    *dynamodb.Client
+	tableName string
+}
+
+func NewDynamoUserRepository(client *dynamodb.Client, tableName string) *DynamoUserRepository {
+	return &DynamoUserRepository{client: client, tableName: tableName}
+}
+
 func CreateUsersTable(client *dynamodb.Client, tableName string) error {
 	_, err := client.DescribeTable(context.TODO(), &dynamodb.DescribeTableInput{
 		TableName: aws.String(tableName),
@@ -61,12 +71,12 @@ func CreateUsersTable(client *dynamodb.Client, tableName string) error {
 	return err
 }
 
-func CreateUser(client *dynamodb.Client, tableName string, id, name, email, password string) (*User, error) {
+func (r *DynamoUserRepository) CreateUser(ctx context.Context, id, name, email, password string) (*User, error) {
 	now := currentTimestamp()
 	normalizedEmail := strings.ToLower(email)
 
-	_, err := client.PutItem(context.TODO(), &dynamodb.PutItemInput{
-		TableName: aws.String(tableName),
+	_, err := r.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(r.tableName),
 		Item: map[string]types.AttributeValue{
 			"id":        &types.AttributeValueMemberS{Value: id},
 			"name":      &types.AttributeValueMemberS{Value: name},
@@ -92,9 +102,9 @@ func CreateUser(client *dynamodb.Client, tableName string, id, name, email, pass
 	}, nil
 }
 
-func GetUserById(client *dynamodb.Client, tableName, id string) (map[string]types.AttributeValue, error) {
-	result, err := client.GetItem(context.TODO(), &dynamodb.GetItemInput{
-		TableName: aws.String(tableName),
+func (r *DynamoUserRepository) GetUserById(ctx context.Context, id string) (*User, error) {
+	result, err := r.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(r.tableName),
 		Key: map[string]types.AttributeValue{
 			"id": &types.AttributeValueMemberS{Value: id},
 		},
@@ -102,16 +112,25 @@ func GetUserById(client *dynamodb.Client, tableName, id string) (map[string]type
 	if err != nil {
 		return nil, err
 	}
-	return result.Item, nil
+	if result.Item == nil {
+		return nil, nil
+	}
+
+	var user User
+	err = attributevalue.UnmarshalMap(result.Item, &user)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
 }
 
-func GetAllUsers(client *dynamodb.Client, tableName string) ([]map[string]types.AttributeValue, error) {
+func (r *DynamoUserRepository) GetAllUsers(ctx context.Context) ([]User, error) {
 	var items []map[string]types.AttributeValue
 	var lastEvaluatedKey map[string]types.AttributeValue
 
 	for {
-		out, err := client.Scan(context.TODO(), &dynamodb.ScanInput{
-			TableName:         aws.String(tableName),
+		out, err := r.client.Scan(ctx, &dynamodb.ScanInput{
+			TableName:         aws.String(r.tableName),
 			ExclusiveStartKey: lastEvaluatedKey,
 		})
 		if err != nil {
@@ -126,14 +145,19 @@ func GetAllUsers(client *dynamodb.Client, tableName string) ([]map[string]types.
 		lastEvaluatedKey = out.LastEvaluatedKey
 	}
 
-	return items, nil
+	var users []User
+	err := attributevalue.UnmarshalListOfMaps(items, &users)
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
 }
 
-func GetUserByEmail(client *dynamodb.Client, tableName, email string) (*User, error) {
+func (r *DynamoUserRepository) GetUserByEmail(ctx context.Context, email string) (*User, error) {
 	email = strings.ToLower(email)
 
-	result, err := client.Query(context.TODO(), &dynamodb.QueryInput{
-		TableName:              aws.String(tableName),
+	result, err := r.client.Query(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(r.tableName),
 		IndexName:              aws.String("email-index"), // Use the GSI
 		KeyConditionExpression: aws.String("email = :email"),
 		ExpressionAttributeValues: map[string]types.AttributeValue{
@@ -147,7 +171,7 @@ func GetUserByEmail(client *dynamodb.Client, tableName, email string) (*User, er
 	}
 
 	if len(result.Items) == 0 {
-		return nil, err
+		return nil, nil
 	}
 
 	var user User
@@ -159,11 +183,11 @@ func GetUserByEmail(client *dynamodb.Client, tableName, email string) (*User, er
 	return &user, nil
 }
 
-func UpdateUser(client *dynamodb.Client, tableName string, user User) error {
+func (r *DynamoUserRepository) UpdateUser(ctx context.Context, user User) error {
 	updateBuilder := expression.UpdateBuilder{}
 
 	// Always update the updatedAt timestamp
-	updateBuilder = updateBuilder.Set(expression.Name("updatedAt"), expression.Value(currentTimestamp()))
+	updateBuilder = updateBuilder.Set(expression.Name("updatedAt"), expression.Value(time.Now().Unix()))
 
 	if user.Name != "" {
 		updateBuilder = updateBuilder.Set(expression.Name("name"), expression.Value(user.Name))
@@ -177,11 +201,12 @@ func UpdateUser(client *dynamodb.Client, tableName string, user User) error {
 		return err
 	}
 
-	_, err = client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
-		TableName: aws.String(tableName),
+	_, err = r.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(r.tableName),
 		Key: map[string]types.AttributeValue{
 			"id": &types.AttributeValueMemberS{Value: user.ID},
 		},
+		ConditionExpression:       aws.String("attribute_exists(id)"),
 		ExpressionAttributeNames:  expr.Names(),
 		ExpressionAttributeValues: expr.Values(),
 		UpdateExpression:          expr.Update(),
@@ -190,8 +215,8 @@ func UpdateUser(client *dynamodb.Client, tableName string, user User) error {
 	return err
 }
 
-func UpdatePassword(client *dynamodb.Client, tableName string, user User) error {
-	now := currentTimestamp()
+func (r *DynamoUserRepository) UpdatePassword(ctx context.Context, user User) error {
+	now := time.Now().Unix()
 	update := expression.Set(expression.Name("password"), expression.Value(user.Password)).
 		Set(expression.Name("updatedAt"), expression.Value(now))
 
@@ -200,11 +225,12 @@ func UpdatePassword(client *dynamodb.Client, tableName string, user User) error
 		return err
 	}
 
-	_, err = client.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
-		TableName: aws.String(tableName),
+	_, err = r.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(r.tableName),
 		Key: map[string]types.AttributeValue{
 			"id": &types.AttributeValueMemberS{Value: user.ID},
 		},
+		ConditionExpression:       aws.String("attribute_exists(id)"),
 		ExpressionAttributeNames:  expr.Names(),
 		ExpressionAttributeValues: expr.Values(),
 		UpdateExpression:          expr.Update(),
@@ -213,9 +239,102 @@ func UpdatePassword(client *dynamodb.Client, tableName string, user User) error
 	return err
 }
 
-func DeleteUser(client *dynamodb.Client, tableName, id string) error {
-	_, err := client.DeleteItem(context.TODO(), &dynamodb.DeleteItemInput{
-		TableName: aws.String(tableName),
+func (r *DynamoUserRepository) UpdateTOTP(ctx context.Context, user User) error {
+	update := expression.Set(expression.Name("totpEnabled"), expression.Value(user.TOTPEnabled)).
+		Set(expression.Name("totpLastStep"), expression.Value(user.TOTPLastStep)).
+		Set(expression.Name("updatedAt"), expression.Value(time.Now().Unix()))
+
+	if user.TOTPSecret != "" {
+		update = update.Set(expression.Name("totpSecret"), expression.Value(user.TOTPSecret))
+	} else {
+		update = update.Remove(expression.Name("totpSecret"))
+	}
+	if len(user.RecoveryCodes) > 0 {
+		update = update.Set(expression.Name("recoveryCodes"), expression.Value(user.RecoveryCodes))
+	} else {
+		update = update.Remove(expression.Name("recoveryCodes"))
+	}
+
+	expr, err := expression.NewBuilder().WithUpdate(update).Build()
+	if err != nil {
+		return err
+	}
+
+	_, err = r.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(r.tableName),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: user.ID},
+		},
+		ConditionExpression:       aws.String("attribute_exists(id)"),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		UpdateExpression:          expr.Update(),
+	})
+	return err
+}
+
+func (r *DynamoUserRepository) UseTOTPStep(ctx context.Context, id string, step int64) (bool, error) {
+	_, err := r.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(r.tableName),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+		ConditionExpression: aws.String("totpLastStep < :step"),
+		UpdateExpression:    aws.String("SET totpLastStep = :step"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":step": &types.AttributeValueMemberN{Value: strconv.FormatInt(step, 10)},
+		},
+	})
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to use TOTP step: %w", err)
+	}
+	return true, nil
+}
+
+func (r *DynamoUserRepository) UseRecoveryCode(ctx context.Context, id string, index int, hash string) (bool, error) {
+	_, err := r.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(r.tableName),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+		ConditionExpression: aws.String(fmt.Sprintf("recoveryCodes[%d] = :hash", index)),
+		UpdateExpression:    aws.String(fmt.Sprintf("REMOVE recoveryCodes[%d]", index)),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":hash": &types.AttributeValueMemberS{Value: hash},
+		},
+	})
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to use recovery code: %w", err)
+	}
+	return true, nil
+}
+
+func (r *DynamoUserRepository) UpdateLastSeen(ctx context.Context, id string, at int64) error {
+	_, err := r.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(r.tableName),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+		ConditionExpression: aws.String("attribute_exists(id)"),
+		UpdateExpression:    aws.String("SET lastSeenAt = :at"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":at": &types.AttributeValueMemberN{Value: strconv.FormatInt(at, 10)},
+		},
+	})
+	return err
+}
+
+func (r *DynamoUserRepository) DeleteUser(ctx context.Context, id string) error {
+	_, err := r.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(r.tableName),
 		Key: map[string]types.AttributeValue{
 			"id": &types.AttributeValueMemberS{Value: id},
 		},
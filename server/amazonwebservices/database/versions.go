@@ -0,0 +1,285 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+var ErrVersionExists = errors.New("file version already exists")
+
+func CreateVersionsTable(client *dynamodb.Client, tableName string) error {
+	_, err := client.DescribeTable(context.TODO(), &dynamodb.DescribeTableInput{
+		TableName: aws.String(tableName),
+	})
+	if err == nil {
+		return nil
+	}
+
+	var notFound *types.ResourceNotFoundException
+	if !errors.As(err, &notFound) {
+		return fmt.Errorf("error checking table existence: %w", err)
+	}
+
+	fmt.Println("Versions table not found — creating now...")
+
+	_, err = client.CreateTable(context.TODO(), &dynamodb.CreateTableInput{
+		TableName: aws.String(tableName),
+		AttributeDefinitions: []types.AttributeDefinition{
+			{AttributeName: aws.String("fileId"), AttributeType: types.ScalarAttributeTypeS},
+			{AttributeName: aws.String("number"), AttributeType: types.ScalarAttributeTypeN},
+		},
+		KeySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String("fileId"), KeyType: types.KeyTypeHash},
+			{AttributeName: aws.String("number"), KeyType: types.KeyTypeRange},
+		},
+		BillingMode: types.BillingModePayPerRequest,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create Versions table: %w", err)
+	}
+
+	waiter := dynamodb.NewTableExistsWaiter(client)
+	if err := waiter.Wait(context.TODO(), &dynamodb.DescribeTableInput{TableName: aws.String(tableName)}, 2*time.Minute); err != nil {
+		return fmt.Errorf("failed waiting for Versions table: %w", err)
+	}
+
+	fmt.Println("Versions table created.")
+	return nil
+}
+
+// DynamoVersionRepository is the VersionRepository backed by a DynamoDB
+// table keyed by file ID and version number.
+type DynamoVersionRepository struct {
+	client    *dynamodb.Client
+	tableName string
+}
+
+func NewDynamoVersionRepository(client *dynamodb.Client, tableName string) *DynamoVersionRepository {
+	return &DynamoVersionRepository{client: client, tableName: tableName}
+}
+
+func versionKey(fileId string, number int) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"fileId": &types.AttributeValueMemberS{Value: fileId},
+		"number": &types.AttributeValueMemberN{Value: strconv.Itoa(number)},
+	}
+}
+
+func (r *DynamoVersionRepository) CreateVersion(ctx context.Context, version FileVersion) error {
+	if version.CreatedAt == 0 {
+		version.CreatedAt = time.Now().Unix()
+	}
+	item, err := attributevalue.MarshalMap(version)
+	if err != nil {
+		return fmt.Errorf("failed to marshal version: %w", err)
+	}
+	_, err = r.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(r.tableName),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(fileId)"),
+	})
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return ErrVersionExists
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create version: %w", err)
+	}
+	return nil
+}
+
+func (r *DynamoVersionRepository) GetVersion(ctx context.Context, fileId string, number int) (*FileVersion, error) {
+	out, err := r.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(r.tableName),
+		Key:       versionKey(fileId, number),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("dynamodb error: %w", err)
+	}
+	if out.Item == nil {
+		return nil, nil
+	}
+
+	var version FileVersion
+	if err := attributevalue.UnmarshalMap(out.Item, &version); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal version: %w", err)
+	}
+	return &version, nil
+}
+
+func (r *DynamoVersionRepository) ListVersions(ctx context.Context, fileId string) ([]FileVersion, error) {
+	var items []map[string]types.AttributeValue
+	var lastEvaluatedKey map[string]types.AttributeValue
+	for {
+		out, err := r.client.Query(ctx, &dynamodb.QueryInput{
+			TableName:              aws.String(r.tableName),
+			KeyConditionExpression: aws.String("fileId = :fileId"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":fileId": &types.AttributeValueMemberS{Value: fileId},
+			},
+			ScanIndexForward:  aws.Bool(false),
+			ExclusiveStartKey: lastEvaluatedKey,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to query versions: %w", err)
+		}
+
+		items = append(items, out.Items...)
+		if out.LastEvaluatedKey == nil {
+			break
+		}
+		lastEvaluatedKey = out.LastEvaluatedKey
+	}
+
+	var versions []FileVersion
+	if err := attributevalue.UnmarshalListOfMaps(items, &versions); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal versions: %w", err)
+	}
+	return versions, nil
+}
+
+func (r *DynamoVersionRepository) UpdateVersionEncryption(ctx context.Context, fileId string, number int, enc FileEncryption) error {
+	av, err := attributevalue.Marshal(enc)
+	if err != nil {
+		return fmt.Errorf("failed to marshal encryption: %w", err)
+	}
+	_, err = r.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(r.tableName),
+		Key:                 versionKey(fileId, number),
+		UpdateExpression:    aws.String("SET encryption = :enc"),
+		ConditionExpression: aws.String("attribute_exists(fileId)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":enc": av,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update version encryption: %w", err)
+	}
+	return nil
+}
+
+func (r *DynamoVersionRepository) UpdateVersionContentInfo(ctx context.Context, fileId string, number int, size int64, sha256 string) error {
+	_, err := r.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(r.tableName),
+		Key:                 versionKey(fileId, number),
+		UpdateExpression:    aws.String("SET #size = :size, sha256 = :sha256"),
+		ConditionExpression: aws.String("attribute_exists(fileId)"),
+		ExpressionAttributeNames: map[string]string{
+			"#size": "size",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":size":   &types.AttributeValueMemberN{Value: strconv.FormatInt(size, 10)},
+			":sha256": &types.AttributeValueMemberS{Value: sha256},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update version content info: %w", err)
+	}
+	return nil
+}
+
+func (r *DynamoVersionRepository) DeleteVersion(ctx context.Context, fileId string, number int) error {
+	_, err := r.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(r.tableName),
+		Key:       versionKey(fileId, number),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete version: %w", err)
+	}
+	return nil
+}
+
+// EmbeddedVersionRepository is the VersionRepository backed by an
+// EmbeddedDB, with items keyed "fileId#number".
+type EmbeddedVersionRepository struct {
+	db        *EmbeddedDB
+	tableName string
+}
+
+func NewEmbeddedVersionRepository(db *EmbeddedDB, tableName string) *EmbeddedVersionRepository {
+	return &EmbeddedVersionRepository{db: db, tableName: tableName}
+}
+
+func embeddedVersionID(fileId string, number int) string {
+	return fileId + "#" + strconv.Itoa(number)
+}
+
+func (r *EmbeddedVersionRepository) CreateVersion(ctx context.Context, version FileVersion) error {
+	if version.CreatedAt == 0 {
+		version.CreatedAt = time.Now().Unix()
+	}
+	err := updateItem(r.db, r.tableName, embeddedVersionID(version.FileID, version.Number), func(v *FileVersion, exists bool) error {
+		if exists {
+			return ErrVersionExists
+		}
+		*v = version
+		return nil
+	})
+	if errors.Is(err, ErrVersionExists) {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create version: %w", err)
+	}
+	return nil
+}
+
+func (r *EmbeddedVersionRepository) GetVersion(ctx context.Context, fileId string, number int) (*FileVersion, error) {
+	return getItem[FileVersion](r.db, r.tableName, embeddedVersionID(fileId, number))
+}
+
+func (r *EmbeddedVersionRepository) ListVersions(ctx context.Context, fileId string) ([]FileVersion, error) {
+	versions, err := scanItems(r.db, r.tableName, func(v *FileVersion) bool {
+		return v.FileID == fileId
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Number > versions[j].Number })
+	return versions, nil
+}
+
+func (r *EmbeddedVersionRepository) UpdateVersionEncryption(ctx context.Context, fileId string, number int, enc FileEncryption) error {
+	err := updateItem(r.db, r.tableName, embeddedVersionID(fileId, number), func(v *FileVersion, exists bool) error {
+		if !exists {
+			return errNoItem
+		}
+		v.Encryption = &enc
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update version encryption: %w", err)
+	}
+	return nil
+}
+
+func (r *EmbeddedVersionRepository) UpdateVersionContentInfo(ctx context.Context, fileId string, number int, size int64, sha256 string) error {
+	err := updateItem(r.db, r.tableName, embeddedVersionID(fileId, number), func(v *FileVersion, exists bool) error {
+		if !exists {
+			return errNoItem
+		}
+		v.Size = size
+		v.SHA256 = sha256
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update version content info: %w", err)
+	}
+	return nil
+}
+
+func (r *EmbeddedVersionRepository) DeleteVersion(ctx context.Context, fileId string, number int) error {
+	if err := deleteItem(r.db, r.tableName, embeddedVersionID(fileId, number)); err != nil {
+		return fmt.Errorf("failed to delete version: %w", err)
+	}
+	return nil
+}
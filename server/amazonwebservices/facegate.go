@@ -0,0 +1,350 @@
+package amazonwebservices
+
+import (
+	"bytes"
+	"context"
+	"effective-invention/server/amazonwebservices/auth"
+	"effective-invention/server/amazonwebservices/database"
+	"effective-invention/server/events"
+	"effective-invention/server/storage"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gofrs/uuid"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+const (
+	// maxFaceImageSize is the Rekognition limit for inline image bytes.
+	maxFaceImageSize = 5 << 20
+	// faceReleaseTTL is how long the download link released by a matching
+	// selfie stays valid. It works only once.
+	faceReleaseTTL = 60 * time.Second
+)
+
+// FaceGate releases face shares to visitors whose selfie matches the owner's
+// reference image. Threshold is the minimum similarity (0-100) for every
+// share; a share can only ask for more. After MaxAttempts failed selfies the
+// share is revoked. Released links are kept in Tokens until they are used.
+type FaceGate struct {
+	Files       database.FileRepository
+	Shares      database.ShareRepository
+	Attempts    database.FaceAttemptRepository
+	Tokens      database.TokenRepository
+	Store       storage.ObjectStore
+	Vault       *Vault
+	Matcher     FaceMatcher
+	Threshold   float32
+	MaxAttempts int
+	Events      *events.Bus
+}
+
+func (g *FaceGate) threshold(share *database.Share) float32 {
+	return max(g.Threshold, share.FaceThreshold)
+}
+
+func (g *FaceGate) failedAttempts(ctx context.Context, token string) (int, error) {
+	attempts, err := g.Attempts.ListAttempts(ctx, token)
+	if err != nil {
+		return 0, err
+	}
+	failed := 0
+	for _, a := range attempts {
+		if !a.Matched {
+			failed++
+		}
+	}
+	return failed, nil
+}
+
+func (g *FaceGate) readReference(ctx context.Context, fileId string) ([]byte, error) {
+	reference, err := g.Files.GetFile(ctx, fileId)
+	if err != nil {
+		return nil, err
+	}
+	if reference == nil || reference.Trashed() {
+		return nil, storage.ErrNotFound
+	}
+	return readFaceImage(ctx, g.Store, g.Vault, reference)
+}
+
+// readFaceImage reads an image file to send to Rekognition inline.
+func readFaceImage(ctx context.Context, store storage.ObjectStore, vault *Vault, file *database.UserFile) ([]byte, error) {
+	obj, err := vault.Open(ctx, store, file)
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(obj.Body, maxFaceImageSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxFaceImageSize {
+		return nil, fmt.Errorf("reference image is larger than %d bytes", maxFaceImageSize)
+	}
+	return data, nil
+}
+
+func (g *FaceGate) record(ctx context.Context, attempt database.FaceAttempt) {
+	id, err := uuid.NewV1()
+	if err == nil {
+		attempt.ID = fmt.Sprintf("ATTEMPT_%s", id)
+		err = g.Attempts.RecordAttempt(ctx, attempt)
+	}
+	if err != nil {
+		log.Printf("Error recording face attempt for share %s...: %v", attempt.ShareToken[:6], err)
+	}
+}
+
+// releaseKey is the token record of a released download link.
+func releaseKey(id string) string {
+	return "release#" + id
+}
+
+// release records a single-use download of file and returns its link,
+// which HandleRelease serves.
+func (g *FaceGate) release(ctx context.Context, file *database.UserFile) (string, error) {
+	id, err := newShareToken()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	err = g.Tokens.SaveToken(ctx, database.TokenRecord{
+		ID:        releaseKey(id),
+		Kind:      database.TokenKindRelease,
+		FileID:    file.ID,
+		CreatedAt: now.Unix(),
+		ExpiresAt: now.Add(faceReleaseTTL).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s/releases/%s", g.Vault.BaseURL, id), nil
+}
+
+// HandleVerify is POST /s/{token}/verify. The visitor sends a live selfie in
+// the "selfie" form field; a match uses up one of the share's uses and
+// returns a download link that works once, within a minute. Pass ?format=qr
+// to get the link as a QR code instead.
+func (g *FaceGate) HandleVerify() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		token := c.Param("token")
+
+		c.Header("Cache-Control", "no-store")
+		c.Header("Referrer-Policy", "no-referrer")
+
+		if g.Matcher == nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Face verification is not available"})
+			return
+		}
+
+		share, err := g.Shares.GetShare(ctx, token)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error reading share"})
+			return
+		}
+		if share == nil || share.Mode != database.ShareModeFace {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Share not found"})
+			return
+		}
+		if !share.Usable(time.Now().Unix()) {
+			c.JSON(http.StatusGone, gin.H{"error": "This link has expired"})
+			return
+		}
+
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxFaceImageSize+1<<20)
+		selfie, _, err := c.Request.FormFile("selfie")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to get selfie from request"})
+			return
+		}
+		defer selfie.Close()
+
+		probe, err := io.ReadAll(io.LimitReader(selfie, maxFaceImageSize+1))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read selfie"})
+			return
+		}
+		if len(probe) > maxFaceImageSize {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Selfie must be 5 MB or smaller"})
+			return
+		}
+		if kind := http.DetectContentType(probe); kind != "image/jpeg" && kind != "image/png" {
+			c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Selfie must be a JPEG or PNG image"})
+			return
+		}
+
+		reference, err := g.readReference(ctx, share.ReferenceID)
+		if err != nil {
+			log.Printf("Error loading reference image for share %s...: %v", token[:6], err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error loading reference image"})
+			return
+		}
+
+		threshold := g.threshold(share)
+		attempt := database.FaceAttempt{
+			ShareToken: token,
+			Threshold:  threshold,
+			ClientIP:   c.ClientIP(),
+		}
+
+		result, err := g.Matcher.CompareFaces(ctx, reference, probe, threshold)
+		if err != nil {
+			attempt.Error = err.Error()
+		}
+		attempt.Matched = err == nil && result.IsMatch
+		attempt.Similarity = result.Similarity
+		g.record(ctx, attempt)
+
+		face := events.FaceData{
+			Token:      token,
+			FileID:     share.FileID,
+			Similarity: attempt.Similarity,
+			Threshold:  threshold,
+			ClientIP:   attempt.ClientIP,
+		}
+		if !attempt.Matched {
+			g.Events.Publish(events.FaceRejected, share.CreatedBy, face)
+
+			failed, countErr := g.failedAttempts(ctx, token)
+			if countErr == nil && g.MaxAttempts > 0 && failed >= g.MaxAttempts {
+				if err := g.Shares.RevokeShare(ctx, token); err != nil {
+					log.Printf("Error locking share %s...: %v", token[:6], err)
+				}
+				c.JSON(http.StatusGone, gin.H{"error": "Too many failed attempts, this link has been locked"})
+				return
+			}
+			if err != nil {
+				c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "No face could be compared, please retake the selfie"})
+				return
+			}
+			c.JSON(http.StatusForbidden, gin.H{"error": "Face does not match"})
+			return
+		}
+
+		file, err := g.Files.GetFile(ctx, share.FileID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error reading file"})
+			return
+		}
+		if file == nil || file.Trashed() {
+			c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+			return
+		}
+
+		g.Events.Publish(events.FaceVerified, share.CreatedBy, face)
+
+		if _, err := g.Shares.ConsumeShare(ctx, token); errors.Is(err, database.ErrShareUnavailable) {
+			c.JSON(http.StatusGone, gin.H{"error": "This link has expired"})
+			return
+		} else if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error reading share"})
+			return
+		}
+
+		url, err := g.release(ctx, file)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate download link"})
+			return
+		}
+
+		if c.Query("format") == "qr" {
+			png, err := qrcode.Encode(url, qrcode.Medium, 256)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate QR code"})
+				return
+			}
+			c.DataFromReader(http.StatusOK, int64(len(png)), "image/png", bytes.NewReader(png), nil)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message":    "Face verified",
+			"url":        url,
+			"expires_in": int64(faceReleaseTTL.Seconds()),
+			"similarity": result.Similarity,
+		})
+	}
+}
+
+// HandleRelease is GET /releases/{id}, the link HandleVerify returns. It
+// streams the file the first time it is fetched and is spent after that,
+// whether or not the download completes.
+func (g *FaceGate) HandleRelease() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+
+		c.Header("Cache-Control", "no-store")
+		c.Header("Referrer-Policy", "no-referrer")
+
+		record, err := g.Tokens.ConsumeToken(ctx, releaseKey(c.Param("id")))
+		if errors.Is(err, database.ErrTokenReused) {
+			c.JSON(http.StatusGone, gin.H{"error": "This link has already been used"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error reading link"})
+			return
+		}
+		if record == nil {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Link is invalid or has expired"})
+			return
+		}
+
+		file, err := g.Files.GetFile(ctx, record.FileID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error reading file"})
+			return
+		}
+		if file == nil || file.Trashed() {
+			c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+			return
+		}
+
+		err = StreamDownloadFile(c, g.Store, g.Vault, file)
+		if errors.Is(err, storage.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+			return
+		}
+		if err != nil {
+			log.Printf("Error serving released file %s: %v", file.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error reading file"})
+		}
+	}
+}
+
+// HandleAttempts lists the attempts made against one of the caller's shares.
+func (g *FaceGate) HandleAttempts() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		principal := auth.MustPrincipal(c)
+		token := c.Param("token")
+
+		share, err := g.Shares.GetShare(c.Request.Context(), token)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if share == nil || share.CreatedBy != principal.UserID {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Share not found"})
+			return
+		}
+
+		attempts, err := g.Attempts.ListAttempts(c.Request.Context(), token)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving attempts."})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message":  "share attempts found",
+			"attempts": attempts,
+		})
+	}
+}
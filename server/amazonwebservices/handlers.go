@@ -4,87 +4,50 @@ import (
 	"bytes"
 	"effective-invention/server/amazonwebservices/auth"
 	"effective-invention/server/amazonwebservices/database"
+	"effective-invention/server/events"
+	"effective-invention/server/storage"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"image/png"
+	"mime/multipart"
 	"net/http"
 	"strings"
 	"time"
+	"unicode/utf8"
 
-	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/rekognition"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/gin-gonic/gin"
 	"github.com/gofrs/uuid"
-	"github.com/golang-jwt/jwt"
 	qrcode "github.com/skip2/go-qrcode"
 )
 
-func HandleFileUpload(client *s3.Client) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		authHeader := c.GetHeader("Authorization")
-		if authHeader == "" {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Auth header not found"})
-			return
-		}
-		token := strings.TrimPrefix(authHeader, "Bearer ")
-		if token == authHeader {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "API token error"})
-			return
-		}
-		claims := auth.ParseAccessToken(token)
-		if claims == nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error parsing auth token"})
-			return
-		}
+// requestedFile resolves the :id route parameter to a file the caller may
+// read, either their own or one shared with them through the token in
+// ?share=. It writes the error response when there is none.
+func requestedFile(c *gin.Context, files database.FileRepository, shares database.ShareRepository) (*database.UserFile, bool) {
+	principal := auth.MustPrincipal(c)
 
-		file, header, err := c.Request.FormFile("file") // "file" is the key in the form-data
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to get file from request"})
-			return
-		}
-		defer file.Close()
-
-		err = StreamUploadFile(client, header.Filename, file)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
-		}
-
-		c.JSON(http.StatusOK, gin.H{
-			"message": "File uploaded successfully",
-		})
+	file, err := readableFile(c.Request.Context(), files, shares, principal.UserID, c.Param("id"), c.Query("share"))
+	if errors.Is(err, storage.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return nil, false
 	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error reading file"})
+		return nil, false
+	}
+	return file, true
 }
 
-func HandleFileDOwnloadLink(client *s3.Client) gin.HandlerFunc {
+func HandleFileDOwnloadLink(files database.FileRepository, shares database.ShareRepository, store storage.ObjectStore, vault *Vault) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		authHeader := c.GetHeader("Authorization")
-		if authHeader == "" {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Auth header not found"})
-			return
-		}
-		token := strings.TrimPrefix(authHeader, "Bearer ")
-		if token == authHeader {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "API token error"})
-			return
-		}
-		claims := auth.ParseAccessToken(token)
-		if claims == nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error parsing auth token"})
+		file, ok := requestedFile(c, files, shares)
+		if !ok {
 			return
 		}
 
-		filename := c.Param("filename")
-		if filename == "" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Filename is required"})
-			return
-		}
-
-		fileKey := fmt.Sprintf("uploads/%s", filename)
-
-		url, err := GeneratePresignedDownloadURL(client, fileKey)
+		url, err := GeneratePresignedDownloadURL(store, vault, file)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
@@ -98,33 +61,14 @@ func HandleFileDOwnloadLink(client *s3.Client) gin.HandlerFunc {
 	}
 }
 
-func HandleFileDOwnloadLinkQR(client *s3.Client) gin.HandlerFunc {
+func HandleFileDOwnloadLinkQR(files database.FileRepository, shares database.ShareRepository, store storage.ObjectStore, vault *Vault) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		authHeader := c.GetHeader("Authorization")
-		if authHeader == "" {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Auth header not found"})
-			return
-		}
-		token := strings.TrimPrefix(authHeader, "Bearer ")
-		if token == authHeader {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "API token error"})
-			return
-		}
-		claims := auth.ParseAccessToken(token)
-		if claims == nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error parsing auth token"})
-			return
-		}
-
-		filename := c.Param("filename")
-		if filename == "" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Filename is required"})
+		file, ok := requestedFile(c, files, shares)
+		if !ok {
 			return
 		}
 
-		fileKey := fmt.Sprintf("uploads/%s", filename)
-
-		url, err := GeneratePresignedDownloadURL(client, fileKey)
+		url, err := GeneratePresignedDownloadURL(store, vault, file)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
@@ -140,46 +84,30 @@ func HandleFileDOwnloadLinkQR(client *s3.Client) gin.HandlerFunc {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encode QR image"})
 			return
 		}
-		c.Header("Content-Type", "image/png")
 		c.Header("Content-Disposition", "inline; filename=\"download_qr.png\"")
-		c.Writer.Write(buf.Bytes())
-
-		c.JSON(http.StatusOK, gin.H{
-			"message": "File download link generated successfully",
-			"expires": "5 minutes",
-			"url":     url,
-		})
+		c.Data(http.StatusOK, "image/png", buf.Bytes())
 	}
 }
 
-func HandleFileDownloadStream(client *s3.Client) gin.HandlerFunc {
+func HandleFileDownloadStream(files database.FileRepository, shares database.ShareRepository, store storage.ObjectStore, vault *Vault) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		authHeader := c.GetHeader("Authorization")
-		if authHeader == "" {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Auth header not found"})
-			return
-		}
-		token := strings.TrimPrefix(authHeader, "Bearer ")
-		if token == authHeader {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "API token error"})
+		file, ok := requestedFile(c, files, shares)
+		if !ok {
 			return
 		}
-		claims := auth.ParseAccessToken(token)
-		if claims == nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error parsing auth token"})
+
+		err := StreamDownloadFile(c, store, vault, file)
+		if errors.Is(err, storage.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
 			return
 		}
-
-		filename := c.Param("filename")
-
-		err := StreamDownloadFile(c, client, filename)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		}
 	}
 }
 
-func HandleUserCreation(client *dynamodb.Client) gin.HandlerFunc {
+func HandleUserCreation(users database.UserRepository) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		type RegisterRequest struct {
 			Name     string `json:"name"`
@@ -208,9 +136,8 @@ func HandleUserCreation(client *dynamodb.Client) gin.HandlerFunc {
 		}
 
 		// 3. Create the user
-		createdUser, err := database.CreateUser(
-			client,
-			"users",
+		createdUser, err := users.CreateUser(
+			c.Request.Context(),
 			userId,
 			req.Name,
 			req.Email,
@@ -229,7 +156,7 @@ func HandleUserCreation(client *dynamodb.Client) gin.HandlerFunc {
 	}
 }
 
-func HandleAuthentication(client *dynamodb.Client) gin.HandlerFunc {
+func HandleAuthentication(users database.UserRepository) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		type LoginRequest struct {
 			Email    string `json:"email"`
@@ -244,7 +171,7 @@ func HandleAuthentication(client *dynamodb.Client) gin.HandlerFunc {
 		}
 		defer c.Request.Body.Close()
 
-		user, err := database.GetUserByEmail(client, "users", req.Email)
+		user, err := users.GetUserByEmail(c.Request.Context(), req.Email)
 		if err != nil || user == nil {
 			c.JSON(http.StatusUnauthorized, gin.H{
 				"error": "User not found or database error",
@@ -252,10 +179,6 @@ func HandleAuthentication(client *dynamodb.Client) gin.HandlerFunc {
 			return
 		}
 
-		fmt.Printf("DEBUG: Login attempt for %s\n", req.Email)
-		fmt.Printf("DEBUG: Password from Request: %s\n", req.Password)
-		fmt.Printf("DEBUG: Password from Database Struct: %s\n", user.Password)
-
 		pass := auth.CheckPasswordHash(req.Password, user.Password)
 		if !pass {
 			c.JSON(http.StatusUnauthorized, gin.H{
@@ -264,36 +187,24 @@ func HandleAuthentication(client *dynamodb.Client) gin.HandlerFunc {
 			return
 		}
 
-		userClaims := auth.UserClaims{
-			ID:    user.ID,
-			Name:  user.Name,
-			Email: user.Email,
-			StandardClaims: jwt.StandardClaims{
-				IssuedAt:  time.Now().Unix(),
-				ExpiresAt: time.Now().Add(time.Minute * 15).Unix(),
-			},
-		}
-
-		token, err := auth.NewAccessToken(userClaims)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"error": "Error generating access token",
-			})
+		if user.TOTPEnabled {
+			startTwoFactorLogin(c, user)
 			return
 		}
 
-		refreshToken, err := auth.NewRefreshToken(userClaims.StandardClaims)
+		session, err := auth.IssueSession(c.Request.Context(), user)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{
-				"error": "Error generating refresh token",
+				"error": "Error generating tokens",
 			})
 			return
 		}
 
 		response := map[string]interface{}{
 			"message":       "Success",
-			"token":         token,
-			"refresh_token": refreshToken,
+			"token":         session.AccessToken,
+			"refresh_token": session.RefreshToken,
+			"expires_in":    session.ExpiresIn,
 			"user":          user,
 		}
 
@@ -302,77 +213,93 @@ func HandleAuthentication(client *dynamodb.Client) gin.HandlerFunc {
 	}
 }
 
-func HandleGetAllUsers(client *dynamodb.Client) gin.HandlerFunc {
+func HandleRefreshToken(users database.UserRepository) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		authHeader := c.GetHeader("Authorization")
-		if authHeader == "" {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Auth header not found"})
+		type RefreshRequest struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+
+		var req RefreshRequest
+		if err := c.ShouldBindJSON(&req); err != nil || req.RefreshToken == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "refresh_token is required"})
 			return
 		}
-		token := strings.TrimPrefix(authHeader, "Bearer ")
-		if token == authHeader {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "API token error"})
+
+		session, err := auth.RefreshSession(c.Request.Context(), req.RefreshToken, users)
+		switch {
+		case errors.Is(err, auth.ErrRefreshTokenReused):
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Refresh token reuse detected, please log in again"})
+			return
+		case errors.Is(err, auth.ErrInvalidRefreshToken), errors.Is(err, auth.ErrTokenRevoked):
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Refresh token is invalid, expired or revoked"})
+			return
+		case err != nil:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error refreshing session"})
 			return
 		}
-		claims := auth.ParseAccessToken(token)
-		if claims == nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error parsing auth token"})
+
+		c.JSON(http.StatusOK, gin.H{
+			"message":       "Success",
+			"token":         session.AccessToken,
+			"refresh_token": session.RefreshToken,
+			"expires_in":    session.ExpiresIn,
+		})
+	}
+}
+
+func HandleLogout() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		principal := auth.MustPrincipal(c)
+
+		if err := auth.Logout(c.Request.Context(), principal); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
-		resp, err := database.GetAllUsers(client, "users")
-		if err != nil {
+
+		c.JSON(http.StatusOK, gin.H{"message": "Logged out"})
+	}
+}
+
+func HandleLogoutEverywhere() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		principal := auth.MustPrincipal(c)
+
+		if err := auth.LogoutEverywhere(c.Request.Context(), principal); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
-		var users []database.User
 
-		for _, item := range resp {
-			var user database.User
-			err = attributevalue.UnmarshalMap(item, &user)
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-				return
-			}
-			users = append(users, user)
+		c.JSON(http.StatusOK, gin.H{"message": "Logged out of all sessions"})
+	}
+}
+
+func HandleGetAllUsers(users database.UserRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		allUsers, err := users.GetAllUsers(c.Request.Context())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
 		}
 
 		response := map[string]interface{}{
 			"message": "Success",
-			"users":   users,
+			"users":   allUsers,
 		}
 
 		c.JSON(http.StatusOK, response)
 	}
 }
 
-func HandleGetUserById(client *dynamodb.Client) gin.HandlerFunc {
+func HandleGetUserById(users database.UserRepository) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		id := c.Param("id")
-		authHeader := c.GetHeader("Authorization")
-		if authHeader == "" {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Auth header not found"})
-			return
-		}
-		token := strings.TrimPrefix(authHeader, "Bearer ")
-		if token == authHeader {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "API token error"})
-			return
-		}
-		claims := auth.ParseAccessToken(token)
-		if claims == nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error parsing auth token"})
-			return
-		}
-
-		resp, err := database.GetUserById(client, "users", id)
+		user, err := users.GetUserById(c.Request.Context(), id)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
-		var user database.User
-		err = attributevalue.UnmarshalMap(resp, &user)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		if user == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
 			return
 		}
 
@@ -386,24 +313,23 @@ func HandleGetUserById(client *dynamodb.Client) gin.HandlerFunc {
 	}
 }
 
-func HandleUpdateUser(client *dynamodb.Client) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		authHeader := c.GetHeader("Authorization")
-		if authHeader == "" {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Auth header not found"})
-			return
-		}
-		token := strings.TrimPrefix(authHeader, "Bearer ")
-		if token == authHeader {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "API token error"})
-			return
-		}
-		claims := auth.ParseAccessToken(token)
-		if claims == nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error parsing auth token"})
-			return
-		}
+// targetUser is the ID of the user a request acts on: id, or the caller
+// when id is empty. Only admins may act on other users; for anyone else it
+// writes the error response.
+func targetUser(c *gin.Context, id string) (string, bool) {
+	principal := auth.MustPrincipal(c)
+	if id == "" {
+		return principal.UserID, true
+	}
+	if id != principal.UserID && !principal.HasRole("admin") {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You can only change your own account"})
+		return "", false
+	}
+	return id, true
+}
 
+func HandleUpdateUser(users database.UserRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
 		var user database.User
 
 		if err := json.NewDecoder(c.Request.Body).Decode(&user); err != nil {
@@ -412,7 +338,13 @@ func HandleUpdateUser(client *dynamodb.Client) gin.HandlerFunc {
 		}
 		defer c.Request.Body.Close()
 
-		err := database.UpdateUser(client, "users", user)
+		id, ok := targetUser(c, user.ID)
+		if !ok {
+			return
+		}
+		user.ID = id
+
+		err := users.UpdateUser(c.Request.Context(), user)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
@@ -427,40 +359,36 @@ func HandleUpdateUser(client *dynamodb.Client) gin.HandlerFunc {
 	}
 }
 
-func HandleUpdateUserPassword(client *dynamodb.Client) gin.HandlerFunc {
+func HandleUpdateUserPassword(users database.UserRepository) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		authHeader := c.GetHeader("Authorization")
-		if authHeader == "" {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Auth header not found"})
-			return
+		type PasswordRequest struct {
+			ID       string `json:"id"`
+			Password string `json:"password"`
 		}
-		token := strings.TrimPrefix(authHeader, "Bearer ")
-		if token == authHeader {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "API token error"})
+
+		var req PasswordRequest
+		if err := json.NewDecoder(c.Request.Body).Decode(&req); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
-		claims := auth.ParseAccessToken(token)
-		if claims == nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error parsing auth token"})
+		defer c.Request.Body.Close()
+
+		if req.Password == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "password is required"})
 			return
 		}
-
-		var user database.User
-
-		if err := json.NewDecoder(c.Request.Body).Decode(&user); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		id, ok := targetUser(c, req.ID)
+		if !ok {
 			return
 		}
-		defer c.Request.Body.Close()
 
-		hashedPassword, err := auth.HashedPassword(user.Password)
+		hashedPassword, err := auth.HashedPassword(req.Password)
 		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
 
-		user.Password = hashedPassword
-
-		err = database.UpdatePassword(client, "users", user)
+		err = users.UpdatePassword(c.Request.Context(), database.User{ID: id, Password: hashedPassword})
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
@@ -475,26 +403,13 @@ func HandleUpdateUserPassword(client *dynamodb.Client) gin.HandlerFunc {
 	}
 }
 
-func HandleDeleteUserById(client *dynamodb.Client) gin.HandlerFunc {
+func HandleDeleteUserById(users database.UserRepository) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		id := c.Param("id")
-		authHeader := c.GetHeader("Authorization")
-		if authHeader == "" {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Auth header not found"})
-			return
-		}
-		token := strings.TrimPrefix(authHeader, "Bearer ")
-		if token == authHeader {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "API token error"})
+		id, ok := targetUser(c, c.Param("id"))
+		if !ok {
 			return
 		}
-		claims := auth.ParseAccessToken(token)
-		if claims == nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error parsing auth token"})
-			return
-		}
-
-		err := database.DeleteUser(client, "users", id)
+		err := users.DeleteUser(c.Request.Context(), id)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
@@ -509,28 +424,22 @@ func HandleDeleteUserById(client *dynamodb.Client) gin.HandlerFunc {
 	}
 }
 
-func HandleFacialAnalysis(client *rekognition.Client) gin.HandlerFunc {
+func HandleFacialAnalysis(client *rekognition.Client, files database.FileRepository, shares database.ShareRepository, store storage.ObjectStore, vault *Vault) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		file := c.Param("file")
-		fileKey := fmt.Sprintf("uploads/%s", file)
-
-		authHeader := c.GetHeader("Authorization")
-		if authHeader == "" {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Auth header not found"})
-			return
-		}
-		token := strings.TrimPrefix(authHeader, "Bearer ")
-		if token == authHeader {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "API token error"})
+		file, ok := requestedFile(c, files, shares)
+		if !ok {
 			return
 		}
-		claims := auth.ParseAccessToken(token)
-		if claims == nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error parsing auth token"})
+
+		// Rekognition only sees ciphertext in the bucket, so it gets the
+		// image inline
+		image, err := readFaceImage(c.Request.Context(), store, vault, file)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
 
-		analysis, err := AnalyzeFace(client, fileKey)
+		analysis, err := AnalyzeFace(client, image)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
@@ -551,22 +460,6 @@ func HandleFacialComparison(client *rekognition.Client) gin.HandlerFunc {
 		sourceKey := c.Param("source")
 		targetKey := c.Param("target")
 
-		authHeader := c.GetHeader("Authorization")
-		if authHeader == "" {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Auth header not found"})
-			return
-		}
-		token := strings.TrimPrefix(authHeader, "Bearer ")
-		if token == authHeader {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "API token error"})
-			return
-		}
-		claims := auth.ParseAccessToken(token)
-		if claims == nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error parsing auth token"})
-			return
-		}
-
 		result, err := CompareTwoFaces(client, sourceKey, targetKey)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error comparing faces. No faces found?"})
@@ -583,39 +476,88 @@ func HandleFacialComparison(client *rekognition.Client) gin.HandlerFunc {
 	}
 }
 
-func HandleUploadUserFile(dynamodb_client *dynamodb.Client, s3_client *s3.Client) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		authHeader := c.GetHeader("Authorization")
-		if authHeader == "" {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Auth header not found"})
-			return
-		}
-		token := strings.TrimPrefix(authHeader, "Bearer ")
-		if token == authHeader {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "API token error"})
-			return
-		}
-		claims := auth.ParseAccessToken(token)
-		if claims == nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error parsing auth token"})
-			return
+const (
+	maxDescriptionLen = 1000
+	maxTags           = 20
+	maxTagLen         = 50
+)
+
+// fileLabels reads the optional "description" and "tags" form fields.
+func fileLabels(c *gin.Context) (string, []string, error) {
+	return cleanLabels(c.PostForm("description"), c.PostFormArray("tags"))
+}
+
+// cleanLabels checks a file's description and tags. Tags may also be comma
+// separated; they are trimmed, lower cased and deduplicated.
+func cleanLabels(description string, rawTags []string) (string, []string, error) {
+	description = strings.TrimSpace(description)
+	if utf8.RuneCountInString(description) > maxDescriptionLen {
+		return "", nil, fmt.Errorf("description is longer than %d characters", maxDescriptionLen)
+	}
+
+	var tags []string
+	seen := map[string]bool{}
+	for _, field := range rawTags {
+		for _, tag := range strings.Split(field, ",") {
+			tag = strings.ToLower(strings.TrimSpace(tag))
+			if tag == "" || seen[tag] {
+				continue
+			}
+			if utf8.RuneCountInString(tag) > maxTagLen {
+				return "", nil, fmt.Errorf("tag %q is longer than %d characters", tag, maxTagLen)
+			}
+			seen[tag] = true
+			tags = append(tags, tag)
 		}
+	}
+	if len(tags) > maxTags {
+		return "", nil, fmt.Errorf("at most %d tags are allowed", maxTags)
+	}
+	return description, tags, nil
+}
 
-		file, header, err := c.Request.FormFile("file") // "file" is the key in the form-data
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to get file from request"})
+// formFile returns the "file" field of a multipart upload of at most
+// maxSize bytes, writing the error response when there is none.
+func formFile(c *gin.Context, maxSize int64) (multipart.File, *multipart.FileHeader, bool) {
+	// leave room for the rest of the form
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxSize+1<<20)
+	file, header, err := c.Request.FormFile("file") // "file" is the key in the form-data
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Files larger than %d bytes must use chunked uploads", maxSize)})
+		return nil, nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to get file from request"})
+		return nil, nil, false
+	}
+	if header.Size > maxSize {
+		file.Close()
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Files larger than %d bytes must use chunked uploads", maxSize)})
+		return nil, nil, false
+	}
+	return file, header, true
+}
+
+// HandleUploadUserFile stores a file sent in a single request, which may be
+// at most maxSize bytes. Larger files go through the chunked upload API.
+func HandleUploadUserFile(versions *Versioner, maxSize int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		principal := auth.MustPrincipal(c)
+
+		file, header, ok := formFile(c, maxSize)
+		if !ok {
 			return
 		}
 		defer file.Close()
 
-		err = StreamUploadFile(s3_client, header.Filename, file)
+		description, tags, err := fileLabels(c)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
 
-		fileKey := fmt.Sprintf("uploads/%s", header.Filename)
-		userId := claims.ID
+		userId := principal.UserID
 
 		id, err := uuid.NewV1()
 		if err != nil {
@@ -624,15 +566,38 @@ func HandleUploadUserFile(dynamodb_client *dynamodb.Client, s3_client *s3.Client
 		}
 
 		fileId := fmt.Sprintf("FILE_%s", id)
+		fileKey := UserFileKey(userId, fileId)
+
+		info, err := StreamUploadFile(versions.Store, versions.Vault, fileKey, file, header)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
 
-		saveErr := database.CreateFile(dynamodb_client, "files", fileId, fileKey, userId)
+		userFile := database.UserFile{
+			ID:          fileId,
+			FileKey:     fileKey,
+			Filename:    header.Filename,
+			User:        userId,
+			CreatedAt:   time.Now().Unix(),
+			Size:        info.Size,
+			ContentType: info.ContentType,
+			SHA256:      info.SHA256,
+			Description: description,
+			Tags:        tags,
+			Encryption:  info.Encryption,
+		}
+		saveErr := versions.Create(c.Request.Context(), userFile)
 		if saveErr != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error saving file record."})
 			return
 		}
+		userFile.Version = 1
+		versions.Events.Publish(events.FileUploaded, userId, events.FileData{FileID: fileId, FileKey: fileKey, Version: 1})
 
 		response := map[string]interface{}{
 			"message": "file saved",
+			"file":    userFile,
 		}
 
 		c.JSON(http.StatusOK, response)
@@ -640,33 +605,26 @@ func HandleUploadUserFile(dynamodb_client *dynamodb.Client, s3_client *s3.Client
 	}
 }
 
-func HandleGetUserFiles(dynamodb_client *dynamodb.Client) gin.HandlerFunc {
+func HandleGetUserFiles(files database.FileRepository) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		authHeader := c.GetHeader("Authorization")
-		if authHeader == "" {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Auth header not found"})
-			return
-		}
-		token := strings.TrimPrefix(authHeader, "Bearer ")
-		if token == authHeader {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "API token error"})
-			return
-		}
-		claims := auth.ParseAccessToken(token)
-		if claims == nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error parsing auth token"})
-			return
-		}
-
-		userId := claims.ID
+		principal := auth.MustPrincipal(c)
+		userId := principal.UserID
 
 		var userFiles []database.UserFile
 		var err error
-		userFiles, err = database.ListFilesByUserSorted(dynamodb_client, "files", userId)
+		userFiles, err = files.ListFilesByUserSorted(c.Request.Context(), userId)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving files."})
 			return
 		}
+		// trashed files are listed at /users/trash
+		live := userFiles[:0]
+		for _, file := range userFiles {
+			if !file.Trashed() {
+				live = append(live, file)
+			}
+		}
+		userFiles = live
 
 		response := map[string]interface{}{
 			"message":   "user files found",
@@ -677,48 +635,32 @@ func HandleGetUserFiles(dynamodb_client *dynamodb.Client) gin.HandlerFunc {
 	}
 }
 
-func HandleDeleteUserFileById(dynamodb_client *dynamodb.Client, s3_client *s3.Client) gin.HandlerFunc {
+// HandleDeleteUserFileById moves a file to the trash, from which it can be
+// restored until the trash purges it.
+func HandleDeleteUserFileById(files database.FileRepository, bus *events.Bus) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		principal := auth.MustPrincipal(c)
 		id := c.Param("id")
-		authHeader := c.GetHeader("Authorization")
-		if authHeader == "" {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Auth header not found"})
-			return
-		}
-		token := strings.TrimPrefix(authHeader, "Bearer ")
-		if token == authHeader {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "API token error"})
-			return
-		}
-		claims := auth.ParseAccessToken(token)
-		if claims == nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error parsing auth token"})
-			return
-		}
-
-		var userFile *database.UserFile
-		var err error
 
-		userFile, err = database.GetFile(dynamodb_client, "files", id)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		userFile, err := ownedFile(c.Request.Context(), files, principal.UserID, id)
+		if errors.Is(err, storage.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
 			return
 		}
-
-		err = DeleteS3File(s3_client, userFile.FileKey)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
 
-		err = database.DeleteFile(dynamodb_client, "files", id)
+		err = files.TrashFile(c.Request.Context(), id, time.Now().Unix())
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
+		bus.Publish(events.FileTrashed, userFile.User, events.FileData{FileID: id, FileKey: userFile.FileKey})
 
 		response := map[string]interface{}{
-			"message": "File Deleted!",
+			"message": "File moved to trash",
 		}
 
 		c.JSON(http.StatusOK, response)
@@ -1,90 +1,576 @@
 package amazonwebservices
 
 import (
+	"bufio"
 	"context"
+	"crypto/sha256"
+	"effective-invention/server/amazonwebservices/database"
+	"effective-invention/server/envelope"
+	"effective-invention/server/storage"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"log"
 	"mime/multipart"
-	"os"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/gin-gonic/gin"
 )
 
-func StreamUploadFile(client *s3.Client, fileName string, fileContent multipart.File) error {
+// S3Store is the storage.ObjectStore implementation backed by an S3 bucket.
+type S3Store struct {
+	client  *s3.Client
+	presign *s3.PresignClient
+	bucket  string
+}
+
+func NewS3Store(client *s3.Client, bucket string) *S3Store {
+	return &S3Store{
+		client:  client,
+		presign: s3.NewPresignClient(client),
+		bucket:  bucket,
+	}
+}
+
+func isS3NotFound(err error) bool {
+	var noSuchKey *types.NoSuchKey
+	var notFound *types.NotFound
+	return errors.As(err, &noSuchKey) || errors.As(err, &notFound)
+}
 
-	bucketName := os.Getenv("AWS_BUCKET_NAME")
-	fileKey := "uploads/" + fileName
-	log.Printf("DEBUG: Accessing S3 - Bucket: %s, Key: '%s'", bucketName, fileKey)
-	_, err := client.PutObject(context.TODO(), &s3.PutObjectInput{
-		Bucket: aws.String(bucketName),
-		Key:    aws.String(fileKey),
-		Body:   fileContent,
+func (s *S3Store) Put(ctx context.Context, key string, body io.Reader, opts storage.PutOptions) error {
+	log.Printf("DEBUG: Accessing S3 - Bucket: %s, Key: '%s'", s.bucket, key)
+	input := &s3.PutObjectInput{
+		Bucket:   aws.String(s.bucket),
+		Key:      aws.String(key),
+		Body:     body,
+		Metadata: opts.Metadata,
+	}
+	if opts.ContentType != "" {
+		input.ContentType = aws.String(opts.ContentType)
+	}
+	if opts.Size > 0 {
+		input.ContentLength = aws.Int64(opts.Size)
+	}
+	_, err := s.client.PutObject(ctx, input)
+	if err != nil {
+		return fmt.Errorf("failed to put S3 object: %w", err)
+	}
+	return nil
+}
+
+func (s *S3Store) Get(ctx context.Context, key string) (*storage.Object, error) {
+	log.Printf("DEBUG: Accessing S3 - Bucket: %s, Key: '%s'", s.bucket, key)
+	resp, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
 	})
+	if isS3NotFound(err) {
+		return nil, storage.ErrNotFound
+	}
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("failed to get S3 object: %w", err)
 	}
 
+	return &storage.Object{
+		ObjectInfo: storage.ObjectInfo{
+			Key:          key,
+			Size:         aws.ToInt64(resp.ContentLength),
+			ContentType:  aws.ToString(resp.ContentType),
+			ETag:         strings.Trim(aws.ToString(resp.ETag), `"`),
+			LastModified: aws.ToTime(resp.LastModified),
+			Metadata:     resp.Metadata,
+		},
+		Body: resp.Body,
+	}, nil
+}
+
+func (s *S3Store) Stat(ctx context.Context, key string) (*storage.ObjectInfo, error) {
+	resp, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if isS3NotFound(err) {
+		return nil, storage.ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat S3 object: %w", err)
+	}
+
+	return &storage.ObjectInfo{
+		Key:          key,
+		Size:         aws.ToInt64(resp.ContentLength),
+		ContentType:  aws.ToString(resp.ContentType),
+		ETag:         strings.Trim(aws.ToString(resp.ETag), `"`),
+		LastModified: aws.ToTime(resp.LastModified),
+		Metadata:     resp.Metadata,
+	}, nil
+}
+
+func (s *S3Store) Delete(ctx context.Context, key string) error {
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete object from S3: %w", err)
+	}
 	return nil
 }
 
-func StreamDownloadFile(c *gin.Context, client *s3.Client, fileName string) error {
-	bucketName := os.Getenv("AWS_BUCKET_NAME")
+func (s *S3Store) List(ctx context.Context, prefix string, fn func(page []storage.ObjectInfo) error) error {
+	pages := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to list S3 objects: %w", err)
+		}
+		objects := make([]storage.ObjectInfo, 0, len(page.Contents))
+		for _, o := range page.Contents {
+			objects = append(objects, storage.ObjectInfo{
+				Key:          aws.ToString(o.Key),
+				Size:         aws.ToInt64(o.Size),
+				ETag:         strings.Trim(aws.ToString(o.ETag), `"`),
+				LastModified: aws.ToTime(o.LastModified),
+			})
+		}
+		if err := fn(objects); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *S3Store) SignedURL(ctx context.Context, key string, expires time.Duration) (string, error) {
+	req, err := s.presign.PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	}, s3.WithPresignExpires(expires))
+	if err != nil {
+		return "", fmt.Errorf("failed to generate presigned URL: %w", err)
+	}
+	return req.URL, nil
+}
+
+func (s *S3Store) SignedPut(ctx context.Context, key string, opts storage.PutOptions, expires time.Duration) (*storage.DirectUpload, error) {
+	req, err := s.presign.PresignPutObject(ctx, &s3.PutObjectInput{
+		Bucket:        aws.String(s.bucket),
+		Key:           aws.String(key),
+		ContentType:   aws.String(opts.ContentType),
+		ContentLength: aws.Int64(opts.Size),
+		Metadata:      opts.Metadata,
+	}, s3.WithPresignExpires(expires))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate presigned upload URL: %w", err)
+	}
+
+	// the client has to send every signed header but Host as signed
+	headers := make(map[string]string)
+	for name, values := range req.SignedHeader {
+		if !strings.EqualFold(name, "Host") && len(values) > 0 {
+			headers[name] = values[0]
+		}
+	}
+	return &storage.DirectUpload{
+		Method:    req.Method,
+		URL:       req.URL,
+		Headers:   headers,
+		ExpiresAt: time.Now().Add(expires).UTC(),
+	}, nil
+}
 
-	fileKey := "uploads/" + fileName
-	log.Printf("DEBUG: Accessing S3 - Bucket: %s, Key: '%s'", bucketName, fileKey)
-	resp, err := client.GetObject(context.TODO(), &s3.GetObjectInput{
-		Bucket: aws.String(bucketName),
-		Key:    aws.String(fileKey),
+func (s *S3Store) SignedPost(ctx context.Context, key string, opts storage.PutOptions, expires time.Duration) (*storage.DirectUpload, error) {
+	conditions := []interface{}{
+		[]interface{}{"content-length-range", opts.Size, opts.Size},
+		map[string]string{"Content-Type": opts.ContentType},
+	}
+	for name, value := range opts.Metadata {
+		conditions = append(conditions, map[string]string{"x-amz-meta-" + name: value})
+	}
+
+	req, err := s.presign.PresignPostObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	}, func(o *s3.PresignPostOptions) {
+		o.Expires = expires
+		o.Conditions = conditions
 	})
 	if err != nil {
-		return fmt.Errorf("failed to get S3 object: %w", err)
+		return nil, fmt.Errorf("failed to generate presigned upload policy: %w", err)
 	}
-	defer resp.Body.Close()
 
-	c.Header("Content-Disposition", "attachment; filename="+fileName)
-	c.Header("Content-Type", *resp.ContentType)
-	c.Header("Content-Length", fmt.Sprintf("%d", resp.ContentLength))
+	// the policy only checks the fields, the client still has to send them
+	fields := req.Values
+	fields["Content-Type"] = opts.ContentType
+	for name, value := range opts.Metadata {
+		fields["x-amz-meta-"+name] = value
+	}
+	return &storage.DirectUpload{
+		Method:    http.MethodPost,
+		URL:       req.URL,
+		Fields:    fields,
+		ExpiresAt: time.Now().Add(expires).UTC(),
+	}, nil
+}
+
+func isNoSuchUpload(err error) bool {
+	var noSuchUpload *types.NoSuchUpload
+	return errors.As(err, &noSuchUpload)
+}
 
-	_, err = io.Copy(c.Writer, resp.Body)
+func (s *S3Store) CreateMultipart(ctx context.Context, key string, opts storage.PutOptions) (string, error) {
+	input := &s3.CreateMultipartUploadInput{
+		Bucket:   aws.String(s.bucket),
+		Key:      aws.String(key),
+		Metadata: opts.Metadata,
+	}
+	if opts.ContentType != "" {
+		input.ContentType = aws.String(opts.ContentType)
+	}
+	out, err := s.client.CreateMultipartUpload(ctx, input)
 	if err != nil {
-		log.Println("Error streaming S3 object:", err)
-		return fmt.Errorf("failed to stream file")
+		return "", fmt.Errorf("failed to create S3 multipart upload: %w", err)
 	}
+	return aws.ToString(out.UploadId), nil
+}
 
+func (s *S3Store) UploadPart(ctx context.Context, key, uploadId string, number int, body io.Reader, size int64) (*storage.Part, error) {
+	out, err := s.client.UploadPart(ctx, &s3.UploadPartInput{
+		Bucket:        aws.String(s.bucket),
+		Key:           aws.String(key),
+		UploadId:      aws.String(uploadId),
+		PartNumber:    aws.Int32(int32(number)),
+		Body:          body,
+		ContentLength: aws.Int64(size),
+	})
+	if isNoSuchUpload(err) {
+		return nil, storage.ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to upload S3 part: %w", err)
+	}
+	return &storage.Part{
+		Number:       number,
+		Size:         size,
+		ETag:         strings.Trim(aws.ToString(out.ETag), `"`),
+		LastModified: time.Now().UTC(),
+	}, nil
+}
+
+func (s *S3Store) ListParts(ctx context.Context, key, uploadId string) ([]storage.Part, error) {
+	var parts []storage.Part
+	pages := s3.NewListPartsPaginator(s.client, &s3.ListPartsInput{
+		Bucket:   aws.String(s.bucket),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadId),
+	})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if isNoSuchUpload(err) {
+			return nil, storage.ErrNotFound
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list S3 parts: %w", err)
+		}
+		for _, p := range page.Parts {
+			parts = append(parts, storage.Part{
+				Number:       int(aws.ToInt32(p.PartNumber)),
+				Size:         aws.ToInt64(p.Size),
+				ETag:         strings.Trim(aws.ToString(p.ETag), `"`),
+				LastModified: aws.ToTime(p.LastModified),
+			})
+		}
+	}
+	return parts, nil
+}
+
+func (s *S3Store) CompleteMultipart(ctx context.Context, key, uploadId string, parts []storage.Part) error {
+	completed := make([]types.CompletedPart, 0, len(parts))
+	for _, p := range parts {
+		completed = append(completed, types.CompletedPart{
+			PartNumber: aws.Int32(int32(p.Number)),
+			ETag:       aws.String(`"` + p.ETag + `"`),
+		})
+	}
+	_, err := s.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.bucket),
+		Key:             aws.String(key),
+		UploadId:        aws.String(uploadId),
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: completed},
+	})
+	if isNoSuchUpload(err) {
+		return storage.ErrNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to complete S3 multipart upload: %w", err)
+	}
 	return nil
 }
 
-func GeneratePresignedDownloadURL(client *s3.Client, fileKey string) (string, error) {
-	bucketName := os.Getenv("AWS_BUCKET_NAME")
+func (s *S3Store) AbortMultipart(ctx context.Context, key, uploadId string) error {
+	_, err := s.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s.bucket),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadId),
+	})
+	if isNoSuchUpload(err) {
+		return storage.ErrNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to abort S3 multipart upload: %w", err)
+	}
+	return nil
+}
+
+// UserFileKey is where a user's file is stored. Keys are generated by the
+// server, so two users uploading the same filename never collide; the
+// filename itself is kept on the file record and in the object metadata.
+func UserFileKey(userId, fileId string) string {
+	return "users/" + userId + "/" + fileId
+}
+
+// UploadInfo is what StreamUploadFile learned about an upload while storing
+// it.
+type UploadInfo struct {
+	Size        int64
+	ContentType string // sniffed from the content, not taken from the client
+	SHA256      string // hex encoded, of the content before encryption
+	Encryption  *database.FileEncryption
+}
+
+// sniffLen is how much of an upload http.DetectContentType looks at.
+const sniffLen = 512
 
-	presignClient := s3.NewPresignClient(client)
-	expiration := 5 * time.Minute
+// digester is written the content of a file and describes it as an
+// UploadInfo.
+type digester struct {
+	head []byte
+	hash hash.Hash
+	size int64
+}
+
+func newDigester() *digester {
+	return &digester{hash: sha256.New()}
+}
 
-	req, err := presignClient.PresignGetObject(context.TODO(), &s3.GetObjectInput{
-		Bucket: aws.String(bucketName),
-		Key:    aws.String(fileKey),
-	}, s3.WithPresignExpires(expiration))
+func (d *digester) Write(p []byte) (int, error) {
+	if n := min(sniffLen-len(d.head), len(p)); n > 0 {
+		d.head = append(d.head, p[:n]...)
+	}
+	d.hash.Write(p)
+	d.size += int64(len(p))
+	return len(p), nil
+}
+
+func (d *digester) info() *UploadInfo {
+	return &UploadInfo{
+		Size:        d.size,
+		ContentType: http.DetectContentType(d.head),
+		SHA256:      hex.EncodeToString(d.hash.Sum(nil)),
+	}
+}
+
+// StreamUploadFile encrypts an uploaded file into the store under a new
+// data key.
+func StreamUploadFile(store storage.ObjectStore, vault *Vault, fileKey string, fileContent multipart.File, header *multipart.FileHeader) (*UploadInfo, error) {
+	ctx := context.TODO()
+	key, enc, err := vault.newDataKey(ctx)
 	if err != nil {
-		return "", fmt.Errorf("failed to generate presigned URL: %w", err)
+		return nil, err
 	}
 
-	return req.URL, nil
+	d := newDigester()
+	body, err := envelope.NewEncrypter(io.TeeReader(fileContent, d), key)
+	if err != nil {
+		return nil, err
+	}
+	err = store.Put(ctx, fileKey, body, storage.PutOptions{
+		ContentType: encryptedContentType,
+		Size:        envelope.EncryptedSize(header.Size),
+		Metadata:    fileMetadata(header.Filename),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	info := d.info()
+	info.Encryption = enc
+	return info, nil
+}
+
+// fileMetadata is the object metadata stored with a user's file.
+func fileMetadata(filename string) map[string]string {
+	// S3 metadata values must be ASCII
+	return map[string]string{"filename": url.PathEscape(filename)}
+}
+
+// InspectStoredFile reads an object encrypted with enc back to describe
+// it, for content that reached the store in pieces.
+func InspectStoredFile(ctx context.Context, store storage.ObjectStore, vault *Vault, fileKey string, enc *database.FileEncryption) (*UploadInfo, error) {
+	obj, err := vault.open(ctx, store, fileKey, enc)
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Body.Close()
+
+	d := newDigester()
+	if _, err := io.Copy(d, obj.Body); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", fileKey, err)
+	}
+	info := d.info()
+	info.Encryption = enc
+	return info, nil
 }
 
-func DeleteS3File(client *s3.Client, fileKey string) error {
-	bucketName := os.Getenv("AWS_BUCKET_NAME")
+// EncryptStoredFile encrypts a file that reached the store as plaintext at
+// from under a new data key, storing it at fileKey, and describes its
+// content. The plaintext is left for the caller to delete.
+func EncryptStoredFile(ctx context.Context, store storage.ObjectStore, vault *Vault, from, fileKey, filename string) (*UploadInfo, error) {
+	obj, err := store.Get(ctx, from)
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Body.Close()
 
-	_, err := client.DeleteObject(context.TODO(), &s3.DeleteObjectInput{
-		Bucket: aws.String(bucketName),
-		Key:    aws.String(fileKey),
+	key, enc, err := vault.newDataKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	d := newDigester()
+	body, err := envelope.NewEncrypter(io.TeeReader(obj.Body, d), key)
+	if err != nil {
+		return nil, err
+	}
+	err = store.Put(ctx, fileKey, body, storage.PutOptions{
+		ContentType: encryptedContentType,
+		Size:        envelope.EncryptedSize(obj.Size),
+		Metadata:    fileMetadata(filename),
 	})
 	if err != nil {
-		return fmt.Errorf("failed to delete object from S3: %w", err)
+		return nil, fmt.Errorf("failed to encrypt %s: %w", fileKey, err)
+	}
+
+	info := d.info()
+	info.Encryption = enc
+	return info, nil
+}
+
+// contentDisposition formats an RFC 6266 Content-Disposition header. The
+// plain filename parameter is an ASCII fallback for old clients; names that
+// are not plain ASCII are also given in full as an RFC 5987 filename*.
+func contentDisposition(disposition, filename string) string {
+	fallback := strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7e || r == '"' || r == '\\' {
+			return '_'
+		}
+		return r
+	}, filename)
+	header := fmt.Sprintf("%s; filename=\"%s\"", disposition, fallback)
+	if fallback != filename {
+		header += "; filename*=UTF-8''" + extValue(filename)
+	}
+	return header
+}
+
+// extValue percent-encodes every byte of s that is not an RFC 5987
+// attr-char.
+func extValue(s string) string {
+	const attrChars = "!#$&+-.^_`|~"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte(attrChars, c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// etag is the strong validator for a file: its SHA-256 when the record has
+// one, otherwise whatever the store reports.
+func etag(file *database.UserFile, obj *storage.ObjectInfo) string {
+	tag := file.SHA256
+	if tag == "" {
+		tag = strings.Trim(obj.ETag, `"`)
+	}
+	if tag == "" {
+		return ""
+	}
+	return `"` + tag + `"`
+}
+
+// StreamDownloadFile sends the content of file, decrypting it on the way.
+// The first chunk is read before any of the response is written, so
+// content that does not decrypt is reported as an error. An error after
+// that is logged and the handler aborted with http.ErrAbortHandler, so the
+// server drops the connection rather than end the response cleanly.
+func StreamDownloadFile(c *gin.Context, store storage.ObjectStore, vault *Vault, file *database.UserFile) error {
+	obj, err := vault.Open(c.Request.Context(), store, file)
+	if err != nil {
+		return err
+	}
+	defer obj.Body.Close()
+
+	contentType := file.ContentType
+	if contentType == "" {
+		contentType = obj.ContentType
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	size := file.Size
+	if size == 0 {
+		size = obj.Size
+	}
+
+	tag := etag(file, &obj.ObjectInfo)
+	if tag != "" && c.GetHeader("If-None-Match") == tag {
+		c.Header("ETag", tag)
+		c.Status(http.StatusNotModified)
+		return nil
+	}
+
+	body := bufio.NewReaderSize(obj.Body, envelope.ChunkSize)
+	if _, err := body.Peek(1); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	if tag != "" {
+		c.Header("ETag", tag)
+	}
+	c.Header("Content-Disposition", contentDisposition("attachment", file.Name()))
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Length", strconv.FormatInt(size, 10))
+	c.Header("X-Content-Type-Options", "nosniff")
+
+	_, err = io.Copy(c.Writer, body)
+	if err != nil {
+		log.Printf("Error streaming %s: %v", file.FileKey, err)
+		c.Abort()
+		panic(http.ErrAbortHandler)
 	}
 
 	return nil
 }
+
+func GeneratePresignedDownloadURL(store storage.ObjectStore, vault *Vault, file *database.UserFile) (string, error) {
+	return vault.DownloadURL(context.TODO(), store, file, 5*time.Minute)
+}
+
+func DeleteStoredFile(store storage.ObjectStore, fileKey string) error {
+	return store.Delete(context.TODO(), fileKey)
+}
@@ -0,0 +1,487 @@
+package amazonwebservices
+
+import (
+	"context"
+	"effective-invention/server/amazonwebservices/database"
+	"effective-invention/server/envelope"
+	"effective-invention/server/storage"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Fix is what reconciliation does about the problems it finds.
+type Fix string
+
+const (
+	// FixNone only reports.
+	FixNone Fix = ""
+	// FixRepair deletes orphaned objects, corrects records that disagree
+	// with encrypted content that decrypts intact, and moves files whose
+	// content is missing or corrupt to the trash.
+	FixRepair Fix = "repair"
+	// FixQuarantine moves orphaned objects under QuarantinePrefix and moves
+	// files whose content is missing, mismatched or corrupt to the trash.
+	//
+	// Under either fix, old versions whose content is missing have their
+	// records deleted; other problems with old versions are only reported,
+	// as their objects may be shared with other versions.
+	FixQuarantine Fix = "quarantine"
+)
+
+// QuarantinePrefix is where quarantined objects are moved to. Reconciliation
+// leaves objects under it alone.
+const QuarantinePrefix = "quarantine/"
+
+// Problems with stored content.
+const (
+	ProblemMissing  = "missing"
+	ProblemSize     = "size"
+	ProblemChecksum = "checksum"
+	ProblemCorrupt  = "corrupt"
+)
+
+// Reconciler checks the object store against the file and version records.
+// It lists every record first and then pages through the objects, so it is
+// safe to run while the server is live: objects younger than Grace, or
+// still being uploaded, may not have their record yet and are left alone,
+// and records whose object seems missing, or objects that seem to have no
+// record, are read again before anything is reported or fixed.
+type Reconciler struct {
+	Files    database.FileRepository
+	Versions database.VersionRepository
+	Uploads  database.UploadRepository
+	Store    storage.ObjectStore
+	Vault    *Vault
+
+	Prefix    string        // only objects whose keys start with it are checked
+	Grace     time.Duration // how old an object must be to count as orphaned
+	Checksums bool          // read every object, not only those of the wrong size
+	Fix       Fix
+}
+
+// ReconcileReport is what a reconciliation found, and did.
+type ReconcileReport struct {
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+	Prefix     string    `json:"prefix"`
+	Checksums  bool      `json:"checksums"`
+	Fix        Fix       `json:"fix,omitempty"`
+
+	Objects  int `json:"objects"` // checked, under Prefix
+	Files    int `json:"files"`
+	Versions int `json:"versions"`
+
+	OrphanObjects []OrphanObject   `json:"orphanObjects"`
+	Problems      []ContentProblem `json:"problems"`
+	Errors        []string         `json:"errors"`
+}
+
+// OrphanObject is an object no file, version or upload refers to.
+type OrphanObject struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"lastModified"`
+	Action       string    `json:"action,omitempty"`
+}
+
+// ContentProblem is a file or version whose object is missing, or does not
+// match what the record says about it. Version is zero for a file record.
+// Plaintext that does not match its record is corrupt, as nothing shows
+// whether the record or the content is wrong.
+type ContentProblem struct {
+	FileID   string `json:"fileId"`
+	Version  int    `json:"version,omitempty"`
+	Key      string `json:"key"`
+	Problem  string `json:"problem"`
+	Expected string `json:"expected,omitempty"`
+	Actual   string `json:"actual,omitempty"`
+	Action   string `json:"action,omitempty"`
+}
+
+// contentRef is a record that refers to an object: a file, or one of its
+// versions.
+type contentRef struct {
+	file    database.UserFile
+	version *database.FileVersion
+}
+
+func (ref *contentRef) key() string {
+	if ref.version != nil {
+		return ref.version.FileKey
+	}
+	return ref.file.FileKey
+}
+
+func (ref *contentRef) size() int64 {
+	if ref.version != nil {
+		return ref.version.Size
+	}
+	return ref.file.Size
+}
+
+func (ref *contentRef) sha256() string {
+	if ref.version != nil {
+		return ref.version.SHA256
+	}
+	return ref.file.SHA256
+}
+
+func (ref *contentRef) encryption() *database.FileEncryption {
+	if ref.version != nil {
+		return ref.version.Encryption
+	}
+	return ref.file.Encryption
+}
+
+// storedSize is the size the object must have in the store.
+func (ref *contentRef) storedSize() int64 {
+	if ref.encryption() == nil {
+		return ref.size()
+	}
+	return envelope.EncryptedSize(ref.size())
+}
+
+func (ref *contentRef) problem(problem, expected, actual string) ContentProblem {
+	p := ContentProblem{
+		FileID:   ref.file.ID,
+		Key:      ref.key(),
+		Problem:  problem,
+		Expected: expected,
+		Actual:   actual,
+	}
+	if ref.version != nil {
+		p.Version = ref.version.Number
+	}
+	return p
+}
+
+// reconciliation is the state of one run.
+type reconciliation struct {
+	*Reconciler
+	report   *ReconcileReport
+	refs     map[string][]contentRef
+	uploads  map[string]bool
+	seen     map[string]bool
+	orphans  []storage.ObjectInfo // listed without a record
+	youngest time.Time            // objects modified after it may not be recorded yet
+}
+
+func (rc *reconciliation) errorf(format string, args ...any) {
+	rc.report.Errors = append(rc.report.Errors, fmt.Sprintf(format, args...))
+}
+
+// Run reconciles the store with the records once.
+func (r *Reconciler) Run(ctx context.Context) (*ReconcileReport, error) {
+	rc := &reconciliation{
+		Reconciler: r,
+		report: &ReconcileReport{
+			StartedAt:     time.Now().UTC(),
+			Prefix:        r.Prefix,
+			Checksums:     r.Checksums,
+			Fix:           r.Fix,
+			OrphanObjects: []OrphanObject{},
+			Problems:      []ContentProblem{},
+			Errors:        []string{},
+		},
+		refs: make(map[string][]contentRef),
+		seen: make(map[string]bool),
+	}
+	rc.youngest = rc.report.StartedAt.Add(-r.Grace)
+
+	if err := rc.loadRecords(ctx); err != nil {
+		return nil, err
+	}
+	err := r.Store.List(ctx, r.Prefix, func(page []storage.ObjectInfo) error {
+		for _, obj := range page {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			rc.checkObject(ctx, obj)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	rc.checkMissing(ctx)
+	if err := rc.checkOrphans(ctx); err != nil {
+		return nil, err
+	}
+
+	rc.report.FinishedAt = time.Now().UTC()
+	return rc.report, nil
+}
+
+// loadRecords collects the keys every file, version and upload in progress
+// refers to.
+func (rc *reconciliation) loadRecords(ctx context.Context) error {
+	err := rc.scanRefs(ctx, func(ref contentRef) {
+		if ref.version != nil {
+			rc.report.Versions++
+		} else {
+			rc.report.Files++
+		}
+		if strings.HasPrefix(ref.key(), rc.Prefix) {
+			rc.refs[ref.key()] = append(rc.refs[ref.key()], ref)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	rc.uploads, err = rc.uploadKeys(ctx)
+	return err
+}
+
+// scanRefs calls fn with every file record and every version record.
+func (rc *reconciliation) scanRefs(ctx context.Context, fn func(ref contentRef)) error {
+	return rc.Files.ScanFiles(ctx, func(page []database.UserFile) error {
+		for _, file := range page {
+			fn(contentRef{file: file})
+
+			versions, err := rc.Versions.ListVersions(ctx, file.ID)
+			if err != nil {
+				return err
+			}
+			for _, v := range versions {
+				fn(contentRef{file: file, version: &v})
+			}
+		}
+		return nil
+	})
+}
+
+// uploadKeys returns the keys uploads in progress write to.
+func (rc *reconciliation) uploadKeys(ctx context.Context) (map[string]bool, error) {
+	// every upload, however recent
+	uploads, err := rc.Uploads.ListStaleUploads(ctx, math.MaxInt64)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]bool)
+	for _, upload := range uploads {
+		keys[upload.FileKey] = true
+		if upload.StagingKey != "" {
+			keys[upload.StagingKey] = true
+		}
+	}
+	return keys, nil
+}
+
+// checkObject checks one listed object against the records that refer to
+// it.
+func (rc *reconciliation) checkObject(ctx context.Context, obj storage.ObjectInfo) {
+	if strings.HasPrefix(obj.Key, QuarantinePrefix) {
+		return
+	}
+	rc.report.Objects++
+	rc.seen[obj.Key] = true
+
+	refs := rc.refs[obj.Key]
+	if len(refs) == 0 {
+		if rc.uploads[obj.Key] || obj.LastModified.After(rc.youngest) {
+			return
+		}
+		rc.orphans = append(rc.orphans, obj)
+		return
+	}
+
+	inspect := rc.Checksums
+	for _, ref := range refs {
+		inspect = inspect || obj.Size != ref.storedSize()
+	}
+	if !inspect {
+		return
+	}
+
+	info, err := InspectStoredFile(ctx, rc.Store, rc.Vault, obj.Key, refs[0].encryption())
+	if errors.Is(err, storage.ErrNotFound) {
+		// deleted since it was listed
+		return
+	}
+	if errors.Is(err, envelope.ErrCorrupt) {
+		for _, ref := range refs {
+			rc.content(ctx, ref, ref.problem(ProblemCorrupt, "", ""), nil)
+		}
+		return
+	}
+	if err != nil {
+		rc.errorf("reading %s: %v", obj.Key, err)
+		return
+	}
+
+	for _, ref := range refs {
+		var p ContentProblem
+		switch {
+		case ref.size() != info.Size:
+			p = ref.problem(ProblemSize, strconv.FormatInt(ref.size(), 10), strconv.FormatInt(info.Size, 10))
+		case ref.sha256() != "" && ref.sha256() != info.SHA256:
+			p = ref.problem(ProblemChecksum, ref.sha256(), info.SHA256)
+		default:
+			continue
+		}
+		if ref.encryption() == nil {
+			p.Problem = ProblemCorrupt
+			rc.content(ctx, ref, p, nil)
+			continue
+		}
+		rc.content(ctx, ref, p, info)
+	}
+}
+
+// checkMissing reports the records whose object was not listed, once they
+// are read again and still refer to an object that is not there.
+func (rc *reconciliation) checkMissing(ctx context.Context) {
+	keys := make([]string, 0, len(rc.refs))
+	for key := range rc.refs {
+		if !rc.seen[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		_, err := rc.Store.Stat(ctx, key)
+		if err == nil {
+			// stored since the listing passed it
+			continue
+		}
+		if !errors.Is(err, storage.ErrNotFound) {
+			rc.errorf("checking %s: %v", key, err)
+			continue
+		}
+		for _, ref := range rc.refs[key] {
+			current, err := rc.stillAt(ctx, ref)
+			if err != nil {
+				rc.errorf("reading %s: %v", ref.file.ID, err)
+				continue
+			}
+			if current {
+				rc.content(ctx, ref, ref.problem(ProblemMissing, "", ""), nil)
+			}
+		}
+	}
+}
+
+// stillAt reports whether ref's record still exists and refers to the same
+// object.
+func (rc *reconciliation) stillAt(ctx context.Context, ref contentRef) (bool, error) {
+	if ref.version != nil {
+		v, err := rc.Versions.GetVersion(ctx, ref.version.FileID, ref.version.Number)
+		return v != nil && v.FileKey == ref.key(), err
+	}
+	file, err := rc.Files.GetFile(ctx, ref.file.ID)
+	return file != nil && file.FileKey == ref.key(), err
+}
+
+// checkOrphans reads every record again and reports, and fixes, the
+// objects listed without a record that still have none. A restore, an
+// upload or a key rotation may have come to refer to one since the records
+// were first read.
+func (rc *reconciliation) checkOrphans(ctx context.Context) error {
+	if len(rc.orphans) == 0 {
+		return nil
+	}
+	referenced, err := rc.uploadKeys(ctx)
+	if err != nil {
+		return err
+	}
+	err = rc.scanRefs(ctx, func(ref contentRef) {
+		referenced[ref.key()] = true
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, obj := range rc.orphans {
+		if !referenced[obj.Key] {
+			rc.orphan(ctx, obj)
+		}
+	}
+	return nil
+}
+
+// orphan reports, and fixes, an object nothing refers to.
+func (rc *reconciliation) orphan(ctx context.Context, obj storage.ObjectInfo) {
+	o := OrphanObject{Key: obj.Key, Size: obj.Size, LastModified: obj.LastModified}
+	var err error
+	switch rc.Fix {
+	case FixRepair:
+		err = rc.Store.Delete(ctx, obj.Key)
+		o.Action = "deleted"
+	case FixQuarantine:
+		err = rc.quarantine(ctx, obj.Key)
+		o.Action = "quarantined"
+	}
+	if err != nil {
+		rc.errorf("fixing orphaned object %s: %v", obj.Key, err)
+		o.Action = "failed"
+	}
+	rc.report.OrphanObjects = append(rc.report.OrphanObjects, o)
+}
+
+// quarantine moves the object at key under QuarantinePrefix.
+func (rc *reconciliation) quarantine(ctx context.Context, key string) error {
+	obj, err := rc.Store.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer obj.Body.Close()
+
+	err = rc.Store.Put(ctx, QuarantinePrefix+key, obj.Body, storage.PutOptions{
+		ContentType: obj.ContentType,
+		Size:        obj.Size,
+		Metadata:    obj.Metadata,
+	})
+	if err != nil {
+		return err
+	}
+	return rc.Store.Delete(ctx, key)
+}
+
+// content reports, and fixes, a problem with the content a record refers
+// to. info is what the object actually holds, when it was read and
+// decrypted intact.
+func (rc *reconciliation) content(ctx context.Context, ref contentRef, p ContentProblem, info *UploadInfo) {
+	var err error
+	switch {
+	case rc.Fix == FixNone:
+
+	case rc.Fix == FixRepair && info != nil:
+		// the content decrypted and so is intact; the record is wrong
+		if ref.version != nil {
+			err = rc.Versions.UpdateVersionContentInfo(ctx, ref.version.FileID, ref.version.Number, info.Size, info.SHA256)
+		} else {
+			err = rc.Files.UpdateContentInfo(ctx, ref.file.ID, ref.key(), info.Size, info.SHA256)
+		}
+		p.Action = "record corrected"
+
+	case ref.version == nil:
+		var current bool
+		current, err = rc.stillAt(ctx, ref)
+		switch {
+		case err != nil:
+		case !current:
+			p.Action = "skipped, file changed"
+		case ref.file.Trashed():
+			p.Action = "already in trash"
+		default:
+			err = rc.Files.TrashFile(ctx, ref.file.ID, time.Now().Unix())
+			p.Action = "moved to trash"
+		}
+
+	case p.Problem == ProblemMissing && ref.version.Number != ref.file.Version:
+		// an old version with nothing left to restore
+		err = rc.Versions.DeleteVersion(ctx, ref.version.FileID, ref.version.Number)
+		p.Action = "version deleted"
+	}
+	if err != nil {
+		rc.errorf("fixing %s of %s: %v", p.Problem, ref.file.ID, err)
+		p.Action = "failed"
+	}
+	rc.report.Problems = append(rc.report.Problems, p)
+}
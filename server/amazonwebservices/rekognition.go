@@ -35,22 +35,9 @@ type FaceAnalysis struct {
 	LandmarkCount int
 }
 
-func AnalyzeFace(client *rekognition.Client, fileKey string) ([]FaceAnalysis, error) {
-	bucketName := os.Getenv("AWS_BUCKET_NAME")
-	region := os.Getenv("AWS_REGION")
-
-	// DEBUG LOGS
-	log.Printf("DEBUG: Looking in Bucket: %s", bucketName)
-	log.Printf("DEBUG: Looking for Key: %s", fileKey)
-	log.Printf("DEBUG: Using Region: %s", region)
-
+func AnalyzeFace(client *rekognition.Client, image []byte) ([]FaceAnalysis, error) {
 	input := &rekognition.DetectFacesInput{
-		Image: &types.Image{
-			S3Object: &types.S3Object{
-				Bucket: aws.String(bucketName),
-				Name:   aws.String(fileKey),
-			},
-		},
+		Image:      &types.Image{Bytes: image},
 		Attributes: []types.Attribute{types.AttributeAll},
 	}
 
@@ -121,6 +108,10 @@ func CompareTwoFaces(client *rekognition.Client, sourceKey, targetKey string) (C
 		return ComparisonResult{}, fmt.Errorf("comparison failed: %w", err)
 	}
 
+	return comparisonResult(result), nil
+}
+
+func comparisonResult(result *rekognition.CompareFacesOutput) ComparisonResult {
 	res := ComparisonResult{
 		UnmatchedCount: len(result.UnmatchedFaces),
 	}
@@ -132,5 +123,40 @@ func CompareTwoFaces(client *rekognition.Client, sourceKey, targetKey string) (C
 		res.FaceLocation = topMatch.Face.BoundingBox
 	}
 
+	return res
+}
+
+// FaceMatcher compares the face in a reference image against a probe image.
+// Similarity is reported even when it is below the threshold, and IsMatch is
+// only set when it reaches it.
+type FaceMatcher interface {
+	CompareFaces(ctx context.Context, reference, probe []byte, threshold float32) (ComparisonResult, error)
+}
+
+// RekognitionMatcher is the FaceMatcher backed by Rekognition CompareFaces.
+// Images are sent inline, so they do not have to be in the bucket.
+type RekognitionMatcher struct {
+	client *rekognition.Client
+}
+
+func NewRekognitionMatcher(client *rekognition.Client) *RekognitionMatcher {
+	return &RekognitionMatcher{client: client}
+}
+
+func (m *RekognitionMatcher) CompareFaces(ctx context.Context, reference, probe []byte, threshold float32) (ComparisonResult, error) {
+	result, err := m.client.CompareFaces(ctx, &rekognition.CompareFacesInput{
+		SourceImage: &types.Image{Bytes: reference},
+		TargetImage: &types.Image{Bytes: probe},
+		// ask for every candidate so the score can be recorded, the
+		// threshold is applied below
+		SimilarityThreshold: aws.Float32(0),
+		QualityFilter:       types.QualityFilterAuto,
+	})
+	if err != nil {
+		return ComparisonResult{}, fmt.Errorf("comparison failed: %w", err)
+	}
+
+	res := comparisonResult(result)
+	res.IsMatch = res.IsMatch && res.Similarity >= threshold
 	return res, nil
 }
@@ -2,18 +2,19 @@ package amazonwebservices
 
 import (
 	"context"
+	"fmt"
 	"log"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 )
 
-func ConnectS3(cfg aws.Config) *s3.Client {
+func ConnectS3(cfg aws.Config) (*s3.Client, error) {
 	s3Client := s3.NewFromConfig(cfg)
 	_, err := s3Client.ListBuckets(context.TODO(), &s3.ListBucketsInput{})
 	if err != nil {
-		log.Fatalf("unable to load S3 buckets, %v", err)
+		return nil, fmt.Errorf("unable to load S3 buckets, %w", err)
 	}
 	log.Printf("Connected to S3\n")
-	return s3Client
+	return s3Client, nil
 }
@@ -0,0 +1,394 @@
+package amazonwebservices
+
+import (
+	"context"
+	"crypto/rand"
+	"effective-invention/server/amazonwebservices/auth"
+	"effective-invention/server/amazonwebservices/database"
+	"effective-invention/server/email"
+	"effective-invention/server/events"
+	"effective-invention/server/storage"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	DefaultShareTTL = 24 * time.Hour
+	MaxShareTTL     = 30 * 24 * time.Hour
+	// shareRedirectTTL is how long the storage URL behind /s/{token} lives.
+	// It only has to survive the redirect.
+	shareRedirectTTL = time.Minute
+)
+
+func newShareToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// ShareURL is the public link for a share token.
+func ShareURL(baseURL, token string) string {
+	return strings.TrimSuffix(baseURL, "/") + "/s/" + token
+}
+
+// ShareOptions describe a new share. MaxUses of 1 gives a burn-on-read link.
+type ShareOptions struct {
+	TTL     time.Duration
+	MaxUses int
+	Mode    string
+	// face mode only
+	ReferenceFileID string
+	FaceThreshold   float32
+}
+
+// ownedFile returns the caller's file, or storage.ErrNotFound when it does
+// not exist, is in the trash or belongs to someone else.
+func ownedFile(ctx context.Context, files database.FileRepository, userId, fileId string) (*database.UserFile, error) {
+	file, err := files.GetFile(ctx, fileId)
+	if err != nil {
+		return nil, err
+	}
+	if file == nil || file.Trashed() || file.User != userId {
+		return nil, storage.ErrNotFound
+	}
+	return file, nil
+}
+
+// readableFile returns a file the caller may read: one they own, or the file
+// behind a usable link share whose token they hold. Reading through a share
+// uses it up just as opening /s/{token} does. Anything else is
+// storage.ErrNotFound, so callers cannot probe for other users' files.
+func readableFile(ctx context.Context, files database.FileRepository, shares database.ShareRepository, userId, fileId, token string) (*database.UserFile, error) {
+	file, err := files.GetFile(ctx, fileId)
+	if err != nil {
+		return nil, err
+	}
+	if file == nil || file.Trashed() {
+		return nil, storage.ErrNotFound
+	}
+	if file.User == userId {
+		return file, nil
+	}
+	if token == "" {
+		return nil, storage.ErrNotFound
+	}
+
+	share, err := shares.GetShare(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	if share == nil || share.FileID != file.ID || share.Mode != database.ShareModeLink || !share.Usable(time.Now().Unix()) {
+		return nil, storage.ErrNotFound
+	}
+	share, err = shares.ConsumeShare(ctx, token)
+	if errors.Is(err, database.ErrShareUnavailable) || (err == nil && share == nil) {
+		return nil, storage.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// CreateShare validates the request against the caller's files and stores a
+// new share.
+func CreateShare(ctx context.Context, files database.FileRepository, shares database.ShareRepository, userId, fileId string, opts ShareOptions) (*database.Share, error) {
+	file, err := ownedFile(ctx, files, userId, fileId)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Mode == "" {
+		opts.Mode = database.ShareModeLink
+	}
+	if opts.Mode == database.ShareModeFace {
+		if _, err := ownedFile(ctx, files, userId, opts.ReferenceFileID); err != nil {
+			return nil, err
+		}
+	}
+
+	token, err := newShareToken()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	share := database.Share{
+		Token:         token,
+		FileID:        file.ID,
+		CreatedBy:     userId,
+		Mode:          opts.Mode,
+		ReferenceID:   opts.ReferenceFileID,
+		FaceThreshold: opts.FaceThreshold,
+		MaxUses:       opts.MaxUses,
+		RemainingUses: opts.MaxUses,
+		CreatedAt:     now.Unix(),
+		ExpiresAt:     now.Add(opts.TTL).Unix(),
+	}
+	if err := shares.CreateShare(ctx, share); err != nil {
+		return nil, err
+	}
+	return &share, nil
+}
+
+const maxShareRecipients = 10
+
+// notifyRecipients emails the share link, or a QR code for it, to each
+// recipient.
+func notifyRecipients(ctx context.Context, mailer email.Mailer, principal *auth.Principal, share *database.Share, url string, recipients []string, note string, asQR bool) error {
+	var msg *email.Message
+	var err error
+	if asQR {
+		msg, err = email.NewQRCodeMessage(recipients, email.QRCodeData{
+			SenderName: principal.Name,
+			URL:        url,
+			Note:       note,
+			ExpiresAt:  time.Unix(share.ExpiresAt, 0),
+		})
+	} else {
+		msg, err = email.NewShareLinkMessage(recipients, email.ShareLinkData{
+			SenderName:   principal.Name,
+			URL:          url,
+			Note:         note,
+			ExpiresAt:    time.Unix(share.ExpiresAt, 0),
+			MaxUses:      share.MaxUses,
+			FaceRequired: share.Mode == database.ShareModeFace,
+		})
+	}
+	if err != nil {
+		return err
+	}
+	msg.UserID = principal.UserID
+	_, err = mailer.Send(ctx, msg)
+	return err
+}
+
+// HandleCreateShare creates a share of one of the caller's files. When
+// recipients are given the link is emailed to them, as a QR code if qr is set.
+func HandleCreateShare(files database.FileRepository, shares database.ShareRepository, mailer email.Mailer, baseURL string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		principal := auth.MustPrincipal(c)
+
+		type ShareRequest struct {
+			FileID    string `json:"file_id"`
+			ExpiresIn int64  `json:"expires_in"` // seconds
+			MaxUses   *int   `json:"max_uses"`
+			Mode      string `json:"mode"`
+			// face mode only
+			ReferenceFileID string  `json:"reference_file_id"`
+			FaceThreshold   float32 `json:"face_threshold"`
+			// optional email delivery
+			Recipients []string `json:"recipients"`
+			Note       string   `json:"note"`
+			QR         bool     `json:"qr"`
+		}
+
+		var req ShareRequest
+		if err := c.ShouldBindJSON(&req); err != nil || req.FileID == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "file_id is required"})
+			return
+		}
+
+		ttl := DefaultShareTTL
+		if req.ExpiresIn > 0 {
+			ttl = time.Duration(req.ExpiresIn) * time.Second
+		}
+		if ttl > MaxShareTTL {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "expires_in is longer than " + MaxShareTTL.String()})
+			return
+		}
+
+		// burn-on-read unless the caller asks otherwise, 0 means unlimited
+		maxUses := 1
+		if req.MaxUses != nil {
+			maxUses = *req.MaxUses
+		}
+		if maxUses < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "max_uses cannot be negative"})
+			return
+		}
+
+		if len(req.Recipients) > maxShareRecipients {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("at most %d recipients are allowed", maxShareRecipients)})
+			return
+		}
+		for i, recipient := range req.Recipients {
+			addr, err := mail.ParseAddress(recipient)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid recipient %q", recipient)})
+				return
+			}
+			req.Recipients[i] = addr.Address
+		}
+
+		switch req.Mode {
+		case "", database.ShareModeLink:
+		case database.ShareModeFace:
+			if req.ReferenceFileID == "" {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "reference_file_id is required for face shares"})
+				return
+			}
+			if req.FaceThreshold < 0 || req.FaceThreshold > 100 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "face_threshold must be between 0 and 100"})
+				return
+			}
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "mode must be link or face"})
+			return
+		}
+
+		share, err := CreateShare(c.Request.Context(), files, shares, principal.UserID, req.FileID, ShareOptions{
+			TTL:             ttl,
+			MaxUses:         maxUses,
+			Mode:            req.Mode,
+			ReferenceFileID: req.ReferenceFileID,
+			FaceThreshold:   req.FaceThreshold,
+		})
+		if errors.Is(err, storage.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error creating share"})
+			return
+		}
+
+		url := ShareURL(baseURL, share.Token)
+		response := gin.H{
+			"message": "share created",
+			"share":   share,
+			"url":     url,
+		}
+		if len(req.Recipients) > 0 {
+			err := notifyRecipients(c.Request.Context(), mailer, principal, share, url, req.Recipients, req.Note, req.QR)
+			if err != nil {
+				log.Printf("Error emailing share %s...: %v", share.Token[:6], err)
+				response["email_error"] = "The share was created but the email could not be sent"
+			} else {
+				response["emailed"] = req.Recipients
+			}
+		}
+
+		c.JSON(http.StatusCreated, response)
+	}
+}
+
+func HandleGetShares(shares database.ShareRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		principal := auth.MustPrincipal(c)
+
+		userShares, err := shares.ListSharesByUser(c.Request.Context(), principal.UserID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving shares."})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message": "user shares found",
+			"shares":  userShares,
+		})
+	}
+}
+
+func HandleRevokeShare(shares database.ShareRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		principal := auth.MustPrincipal(c)
+		token := c.Param("token")
+
+		share, err := shares.GetShare(c.Request.Context(), token)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if share == nil || share.CreatedBy != principal.UserID {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Share not found"})
+			return
+		}
+
+		if err := shares.RevokeShare(c.Request.Context(), token); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Share revoked"})
+	}
+}
+
+// HandleOpenShare is the public /s/{token} endpoint. Every successful visit
+// uses up one of the share's uses and redirects to a download URL that is
+// only valid for a minute, so the link behind the share is never handed out.
+func HandleOpenShare(files database.FileRepository, shares database.ShareRepository, store storage.ObjectStore, vault *Vault, bus *events.Bus) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		token := c.Param("token")
+
+		c.Header("Cache-Control", "no-store")
+		c.Header("Referrer-Policy", "no-referrer")
+
+		share, err := shares.GetShare(ctx, token)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error reading share"})
+			return
+		}
+		if share == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Share not found"})
+			return
+		}
+		if !share.Usable(time.Now().Unix()) {
+			c.JSON(http.StatusGone, gin.H{"error": "This link has expired"})
+			return
+		}
+		if share.Mode == database.ShareModeFace {
+			c.JSON(http.StatusForbidden, gin.H{
+				"error":         "Face verification required",
+				"face_required": true,
+				"verify_url":    c.Request.URL.Path + "/verify",
+			})
+			return
+		}
+
+		file, err := files.GetFile(ctx, share.FileID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error reading file"})
+			return
+		}
+		if file == nil || file.Trashed() {
+			c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+			return
+		}
+
+		share, err = shares.ConsumeShare(ctx, token)
+		if errors.Is(err, database.ErrShareUnavailable) {
+			// someone else used the last visit between the read and now
+			c.JSON(http.StatusGone, gin.H{"error": "This link has expired"})
+			return
+		}
+		if err != nil || share == nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error reading share"})
+			return
+		}
+
+		url, err := vault.DownloadURL(ctx, store, file, shareRedirectTTL)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate download link"})
+			return
+		}
+
+		log.Printf("Share %s... opened by %s, %d uses so far", token[:6], c.ClientIP(), share.UseCount)
+		bus.Publish(events.ShareOpened, share.CreatedBy, events.ShareData{
+			Token:    token,
+			FileID:   share.FileID,
+			UseCount: share.UseCount,
+			ClientIP: c.ClientIP(),
+		})
+		c.Redirect(http.StatusFound, url)
+	}
+}
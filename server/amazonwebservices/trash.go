@@ -0,0 +1,190 @@
+package amazonwebservices
+
+import (
+	"context"
+	"effective-invention/server/amazonwebservices/auth"
+	"effective-invention/server/amazonwebservices/database"
+	"effective-invention/server/events"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Trash holds deleted files for Retention before they are purged for good,
+// so a delete can be undone until then. Purging a file deletes its objects
+// and versions before its record, so a purge cut short leaves the file in
+// the trash to be purged again on the next pass.
+type Trash struct {
+	Files    database.FileRepository
+	Versions *Versioner
+	Events   *events.Bus
+
+	Retention time.Duration
+	// Run purges the files whose retention is up every PurgeInterval.
+	PurgeInterval time.Duration
+}
+
+// purgeAt is when file leaves the trash for good.
+func (t *Trash) purgeAt(file *database.UserFile) int64 {
+	return time.Unix(file.DeletedAt, 0).Add(t.Retention).Unix()
+}
+
+// expired reports whether file is due to be purged, after which it can no
+// longer be restored.
+func (t *Trash) expired(file *database.UserFile, now time.Time) bool {
+	return t.purgeAt(file) <= now.Unix()
+}
+
+// trashedFile loads the caller's :id file from the trash, writing the error
+// response when there is none.
+func (t *Trash) trashedFile(c *gin.Context) (*database.UserFile, bool) {
+	principal := auth.MustPrincipal(c)
+
+	file, err := t.Files.GetFile(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error reading file"})
+		return nil, false
+	}
+	if file == nil || !file.Trashed() || file.User != principal.UserID {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found in trash"})
+		return nil, false
+	}
+	return file, true
+}
+
+// trashedFileResponse is a file in the trash, with when it will be purged.
+type trashedFileResponse struct {
+	database.UserFile
+	PurgeAt int64 `json:"purgeAt"`
+}
+
+// HandleList is GET /users/trash, the caller's trashed files, most
+// recently deleted first.
+func (t *Trash) HandleList() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		principal := auth.MustPrincipal(c)
+
+		userFiles, err := t.Files.ListFilesByUserSorted(c.Request.Context(), principal.UserID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving files."})
+			return
+		}
+		trashed := []trashedFileResponse{}
+		for _, file := range userFiles {
+			if file.Trashed() {
+				trashed = append(trashed, trashedFileResponse{UserFile: file, PurgeAt: t.purgeAt(&file)})
+			}
+		}
+		sort.SliceStable(trashed, func(i, j int) bool {
+			return trashed[i].DeletedAt > trashed[j].DeletedAt
+		})
+
+		c.JSON(http.StatusOK, gin.H{"message": "trashed files found", "files": trashed})
+	}
+}
+
+// HandleRestore is POST /users/trash/{id}/restore, which puts a file back
+// where it was.
+func (t *Trash) HandleRestore() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// a purge of the file under way finishes first
+		defer t.Versions.locks.lock(c.Param("id"))()
+
+		file, ok := t.trashedFile(c)
+		if !ok {
+			return
+		}
+		if t.expired(file, time.Now()) {
+			c.JSON(http.StatusGone, gin.H{"error": "File is being purged"})
+			return
+		}
+
+		if err := t.Files.RestoreFile(c.Request.Context(), file.ID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error restoring file"})
+			return
+		}
+		file.DeletedAt = 0
+		t.Events.Publish(events.FileUntrashed, file.User, events.FileData{FileID: file.ID, FileKey: file.FileKey})
+
+		c.JSON(http.StatusOK, gin.H{"message": "file restored", "file": file})
+	}
+}
+
+// HandleDelete is DELETE /users/trash/{id}, which purges a file now rather
+// than waiting out its retention.
+func (t *Trash) HandleDelete() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		file, ok := t.trashedFile(c)
+		if !ok {
+			return
+		}
+		err := t.purge(c.Request.Context(), file)
+		if errors.Is(err, database.ErrFileNotTrashed) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "File not found in trash"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error deleting file"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "File Deleted!"})
+	}
+}
+
+// purge deletes a trashed file for good, unless it has been restored.
+func (t *Trash) purge(ctx context.Context, file *database.UserFile) error {
+	if err := t.Versions.Delete(ctx, file); err != nil {
+		return err
+	}
+	t.Events.Publish(events.FileDeleted, file.User, events.FileData{FileID: file.ID, FileKey: file.FileKey})
+	return nil
+}
+
+// Purge deletes the files whose retention is up and returns how many it
+// deleted. Files it fails on stay in the trash for the next pass.
+func (t *Trash) Purge(ctx context.Context) (int, error) {
+	expired, err := t.Files.ListTrashedFiles(ctx, time.Now().Add(-t.Retention).Unix())
+	if err != nil {
+		return 0, err
+	}
+	purged := 0
+	for _, file := range expired {
+		err := t.purge(ctx, &file)
+		if errors.Is(err, database.ErrFileNotTrashed) {
+			// restored since it was listed
+			continue
+		}
+		if err != nil {
+			log.Printf("Error purging trashed file %s: %v", file.ID, err)
+			continue
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// Run purges expired files until ctx is cancelled.
+func (t *Trash) Run(ctx context.Context) {
+	ticker := time.NewTicker(t.PurgeInterval)
+	defer ticker.Stop()
+
+	for {
+		purged, err := t.Purge(ctx)
+		if err != nil {
+			log.Printf("Error purging trash: %v", err)
+		}
+		if purged > 0 {
+			log.Printf("Purged %d files from the trash", purged)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,348 @@
+package amazonwebservices
+
+import (
+	"context"
+	"effective-invention/server/amazonwebservices/auth"
+	"effective-invention/server/amazonwebservices/database"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"slices"
+
+	"github.com/gin-gonic/gin"
+)
+
+type twoFactorRequest struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// checkSecondFactor accepts either a TOTP code or one of the user's recovery
+// codes, and uses up the step or code so neither works twice, even for
+// requests made at the same time.
+func checkSecondFactor(ctx context.Context, users database.UserRepository, user *database.User, req twoFactorRequest) (bool, error) {
+	if req.RecoveryCode != "" {
+		return useRecoveryCode(ctx, users, user, req.RecoveryCode)
+	}
+
+	secret, err := auth.DecryptSecret(user.TOTPSecret)
+	if err != nil {
+		return false, err
+	}
+	step, ok := auth.VerifyTOTP(secret, req.Code, user.TOTPLastStep)
+	if !ok {
+		return false, nil
+	}
+	used, err := users.UseTOTPStep(ctx, user.ID, step)
+	if err != nil || !used {
+		return false, err
+	}
+	user.TOTPLastStep = step
+	return true, nil
+}
+
+// useRecoveryCode removes code from user's recovery codes. Using another
+// code at the same time moves this one, so it is looked for again then.
+func useRecoveryCode(ctx context.Context, users database.UserRepository, user *database.User, code string) (bool, error) {
+	for range 3 {
+		i := auth.FindRecoveryCode(user.RecoveryCodes, code)
+		if i < 0 {
+			return false, nil
+		}
+		used, err := users.UseRecoveryCode(ctx, user.ID, i, user.RecoveryCodes[i])
+		if err != nil {
+			return false, err
+		}
+		if used {
+			user.RecoveryCodes = slices.Delete(slices.Clone(user.RecoveryCodes), i, i+1)
+			return true, nil
+		}
+
+		fresh, err := users.GetUserById(ctx, user.ID)
+		if err != nil || fresh == nil {
+			return false, err
+		}
+		*user = *fresh
+	}
+	return false, nil
+}
+
+// HandleTOTPEnroll generates a new secret for the caller and returns the
+// provisioning URI and QR code. Two-factor stays off until the first code is
+// confirmed. Pass ?format=png to get the QR code as an image.
+func HandleTOTPEnroll(users database.UserRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		principal := auth.MustPrincipal(c)
+
+		user, err := users.GetUserById(c.Request.Context(), principal.UserID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if user == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		if user.TOTPEnabled {
+			c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is already enabled"})
+			return
+		}
+
+		secret, err := auth.NewTOTPSecret()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		encrypted, err := auth.EncryptSecret(secret)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error encrypting secret"})
+			return
+		}
+
+		user.TOTPSecret = encrypted
+		user.TOTPLastStep = 0
+		user.RecoveryCodes = nil
+		if err := users.UpdateTOTP(c.Request.Context(), *user); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		uri := auth.TOTPProvisioningURI(secret, user.Email)
+		qr, err := auth.TOTPQRCode(uri)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate QR code"})
+			return
+		}
+
+		if c.Query("format") == "png" {
+			c.Header("Cache-Control", "no-store")
+			c.Data(http.StatusOK, "image/png", qr)
+			return
+		}
+
+		c.Header("Cache-Control", "no-store")
+		c.JSON(http.StatusOK, gin.H{
+			"secret": secret,
+			"uri":    uri,
+			"qrcode": "data:image/png;base64," + base64.StdEncoding.EncodeToString(qr),
+		})
+	}
+}
+
+// HandleTOTPConfirm enables two-factor once the caller proves their
+// authenticator produces valid codes, and returns the recovery codes. This
+// is the only time the recovery codes are shown.
+func HandleTOTPConfirm(users database.UserRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		principal := auth.MustPrincipal(c)
+
+		var req twoFactorRequest
+		if err := c.ShouldBindJSON(&req); err != nil || req.Code == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "code is required"})
+			return
+		}
+
+		user, err := users.GetUserById(c.Request.Context(), principal.UserID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if user == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		if user.TOTPEnabled {
+			c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is already enabled"})
+			return
+		}
+		if user.TOTPSecret == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Start enrollment first"})
+			return
+		}
+
+		secret, err := auth.DecryptSecret(user.TOTPSecret)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error reading secret"})
+			return
+		}
+		step, ok := auth.VerifyTOTP(secret, req.Code, user.TOTPLastStep)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid code"})
+			return
+		}
+
+		codes, hashes, err := auth.NewRecoveryCodes()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error generating recovery codes"})
+			return
+		}
+
+		user.TOTPEnabled = true
+		user.TOTPLastStep = step
+		user.RecoveryCodes = hashes
+		if err := users.UpdateTOTP(c.Request.Context(), *user); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.Header("Cache-Control", "no-store")
+		c.JSON(http.StatusOK, gin.H{
+			"message":        "Two-factor authentication enabled",
+			"recovery_codes": codes,
+		})
+	}
+}
+
+// HandleTOTPVerify is the second step of a login for users with two-factor
+// enabled. It trades the mfa_token from /users/login and a code for a session.
+func HandleTOTPVerify(users database.UserRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		type VerifyRequest struct {
+			MFAToken string `json:"mfa_token"`
+			twoFactorRequest
+		}
+
+		var req VerifyRequest
+		if err := c.ShouldBindJSON(&req); err != nil || req.MFAToken == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "mfa_token is required"})
+			return
+		}
+		if req.Code == "" && req.RecoveryCode == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "code or recovery_code is required"})
+			return
+		}
+
+		claims, err := auth.VerifyMFAPendingToken(req.MFAToken)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "MFA token is invalid or expired"})
+			return
+		}
+		err = auth.CountMFAAttempt(c.Request.Context(), claims)
+		if errors.Is(err, auth.ErrMFATokenUsed) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "MFA token is invalid or expired"})
+			return
+		}
+		if errors.Is(err, auth.ErrTooManyAttempts) {
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many invalid codes, please log in again"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		user, err := users.GetUserById(c.Request.Context(), claims.ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if user == nil || !user.TOTPEnabled {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "MFA token is invalid or expired"})
+			return
+		}
+
+		ok, err := checkSecondFactor(c.Request.Context(), users, user, req.twoFactorRequest)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid code"})
+			return
+		}
+		if err := auth.ConsumeMFAToken(c.Request.Context(), claims); err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "MFA token is invalid or expired"})
+			return
+		}
+
+		session, err := auth.IssueSession(c.Request.Context(), user)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error generating tokens"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message":                  "Success",
+			"token":                    session.AccessToken,
+			"refresh_token":            session.RefreshToken,
+			"expires_in":               session.ExpiresIn,
+			"user":                     user,
+			"recovery_codes_remaining": len(user.RecoveryCodes),
+		})
+	}
+}
+
+// HandleTOTPDisable turns two-factor off. It needs a current code or a
+// recovery code, not just an access token, and only takes a few codes per
+// auth.CodeAttemptWindow, so a stolen access token cannot guess one.
+func HandleTOTPDisable(users database.UserRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		principal := auth.MustPrincipal(c)
+
+		var req twoFactorRequest
+		if err := c.ShouldBindJSON(&req); err != nil || (req.Code == "" && req.RecoveryCode == "") {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "code or recovery_code is required"})
+			return
+		}
+
+		user, err := users.GetUserById(c.Request.Context(), principal.UserID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if user == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		if !user.TOTPEnabled {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Two-factor authentication is not enabled"})
+			return
+		}
+		err = auth.CountCodeAttempt(c.Request.Context(), user.ID)
+		if errors.Is(err, auth.ErrTooManyAttempts) {
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many invalid codes, please try again later"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		ok, err := checkSecondFactor(c.Request.Context(), users, user, req)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid code"})
+			return
+		}
+
+		user.TOTPEnabled = false
+		user.TOTPSecret = ""
+		user.TOTPLastStep = 0
+		user.RecoveryCodes = nil
+		if err := users.UpdateTOTP(c.Request.Context(), *user); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication disabled"})
+	}
+}
+
+// startTwoFactorLogin answers the password step of a login for users with
+// two-factor enabled.
+func startTwoFactorLogin(c *gin.Context, user *database.User) {
+	token, err := auth.NewMFAPendingToken(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error generating tokens"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message":      "MFA required",
+		"mfa_required": true,
+		"mfa_token":    token,
+		"expires_in":   int64(auth.MFAPendingTTL.Seconds()),
+	})
+}
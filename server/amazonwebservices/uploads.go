@@ -0,0 +1,777 @@
+package amazonwebservices
+
+import (
+	"context"
+	"crypto/sha256"
+	"effective-invention/server/amazonwebservices/auth"
+	"effective-invention/server/amazonwebservices/database"
+	"effective-invention/server/envelope"
+	"effective-invention/server/events"
+	"effective-invention/server/storage"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gofrs/uuid"
+)
+
+// Uploader runs uploads of files too large, or connections too flaky, for a
+// single request. In a chunked upload the client starts an upload with the
+// file's size, sends its parts in any order, resending any that fail, and
+// then completes the upload to get the file. Every part is PartSize bytes
+// except the last, which holds the rest. In a direct upload the client gets
+// a signed request that sends the file straight to the object store, and
+// then finalizes the upload once the store has it.
+//
+// Parts are encrypted on their way to the store with the upload's data key,
+// each continuing the stream where the previous part left off, so PartSize
+// must be a multiple of envelope.ChunkSize. A direct upload reaches the
+// store as plaintext at a staging key of its own, which its signed request
+// keeps working for until it expires, and is encrypted from there into the
+// file's key when it is finalized.
+//
+// Either kind of upload may instead add a new version of one of the
+// caller's files, given its fileId.
+type Uploader struct {
+	Files    database.FileRepository
+	Uploads  database.UploadRepository
+	Versions *Versioner
+	Store    storage.ObjectStore
+	Vault    *Vault
+	Events   *events.Bus
+
+	MaxSize       int64 // largest file a chunked or direct upload may create
+	MaxSimpleSize int64 // largest file accepted in a single request
+	PartSize      int64
+	DirectExpiry  time.Duration // how long a signed direct upload request works
+
+	// Run aborts uploads that have had no activity for StaleAfter, checking
+	// every SweepInterval.
+	StaleAfter    time.Duration
+	SweepInterval time.Duration
+}
+
+const maxFilenameLen = 255
+
+// partCount is how many parts make up upload.
+func partCount(upload *database.Upload) int {
+	return int((upload.Size + upload.PartSize - 1) / upload.PartSize)
+}
+
+// partLength is the exact size part number of upload must have.
+func partLength(upload *database.Upload, number int) int64 {
+	if number < partCount(upload) {
+		return upload.PartSize
+	}
+	return upload.Size - int64(number-1)*upload.PartSize
+}
+
+// storedPartLength is the size part number of upload has in the store.
+func storedPartLength(upload *database.Upload, number int) int64 {
+	if upload.Encryption == nil {
+		return partLength(upload, number)
+	}
+	return envelope.EncryptedSize(partLength(upload, number))
+}
+
+// missingParts lists the part numbers of upload that are not among parts
+// with the right size.
+func missingParts(upload *database.Upload, parts []storage.Part) []int {
+	stored := make(map[int]bool, len(parts))
+	for _, p := range parts {
+		stored[p.Number] = p.Size == storedPartLength(upload, p.Number)
+	}
+	missing := []int{}
+	for number := 1; number <= partCount(upload); number++ {
+		if !stored[number] {
+			missing = append(missing, number)
+		}
+	}
+	return missing
+}
+
+// ownUpload loads the :id upload, writing the error response unless it
+// belongs to the caller.
+func (u *Uploader) ownUpload(c *gin.Context) (*database.Upload, bool) {
+	principal := auth.MustPrincipal(c)
+
+	upload, err := u.Uploads.GetUpload(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error reading upload"})
+		return nil, false
+	}
+	if upload == nil || upload.User != principal.UserID {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Upload not found"})
+		return nil, false
+	}
+	return upload, true
+}
+
+// ownUploadOfKind is ownUpload for the endpoints that only apply to direct,
+// or only to chunked, uploads.
+func (u *Uploader) ownUploadOfKind(c *gin.Context, direct bool) (*database.Upload, bool) {
+	upload, ok := u.ownUpload(c)
+	if !ok {
+		return nil, false
+	}
+	if upload.Direct != direct {
+		kind := "a chunked"
+		if upload.Direct {
+			kind = "a direct"
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "This is " + kind + " upload"})
+		return nil, false
+	}
+	return upload, true
+}
+
+// uploadRequest is the part of a request to start an upload that describes
+// the file. With FileID it describes a new version of that file, and the
+// filename defaults to the file's.
+type uploadRequest struct {
+	FileID      string   `json:"fileId"`
+	Filename    string   `json:"filename"`
+	Size        int64    `json:"size"`
+	Description string   `json:"description"`
+	Tags        []string `json:"tags"`
+}
+
+// newUpload checks req and returns an upload for it, with the file ID and
+// key assigned. It writes the error response when req is invalid.
+func (u *Uploader) newUpload(c *gin.Context, req uploadRequest) (*database.Upload, bool) {
+	principal := auth.MustPrincipal(c)
+
+	var existing *database.UserFile
+	if req.FileID != "" {
+		file, err := ownedFile(c.Request.Context(), u.Files, principal.UserID, req.FileID)
+		if errors.Is(err, storage.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+			return nil, false
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error reading file"})
+			return nil, false
+		}
+		existing = file
+		if req.Filename == "" {
+			req.Filename = file.Name()
+		}
+	}
+
+	req.Filename = strings.TrimSpace(req.Filename)
+	if req.Filename == "" || len(req.Filename) > maxFilenameLen {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("filename is required and at most %d bytes", maxFilenameLen)})
+		return nil, false
+	}
+	if req.Size <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "size must be positive"})
+		return nil, false
+	}
+	if req.Size > u.MaxSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Files may be at most %d bytes", u.MaxSize)})
+		return nil, false
+	}
+	description, tags, err := cleanLabels(req.Description, req.Tags)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	}
+
+	uploadUUID, err := uuid.NewV4()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	var fileId, fileKey string
+	if existing != nil {
+		fileId = existing.ID
+		fileKey, err = newVersionKey(existing.User)
+	} else {
+		var fileUUID uuid.UUID
+		fileUUID, err = uuid.NewV1()
+		fileId = fmt.Sprintf("FILE_%s", fileUUID)
+		fileKey = UserFileKey(principal.UserID, fileId)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+
+	now := time.Now().Unix()
+	return &database.Upload{
+		ID:          fmt.Sprintf("UPLOAD_%s", uploadUUID),
+		User:        principal.UserID,
+		FileID:      fileId,
+		FileKey:     fileKey,
+		NewVersion:  existing != nil,
+		Filename:    req.Filename,
+		Description: description,
+		Tags:        tags,
+		Size:        req.Size,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}, true
+}
+
+// HandleCreate is POST /uploads. It takes the file's name and exact size,
+// with an optional description and tags, and returns the upload with the
+// part size and count to send.
+func (u *Uploader) HandleCreate() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+
+		var req uploadRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+			return
+		}
+		upload, ok := u.newUpload(c, req)
+		if !ok {
+			return
+		}
+
+		_, enc, err := u.Vault.newDataKey(ctx)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start upload"})
+			return
+		}
+		upload.Encryption = enc
+
+		storeUploadId, err := u.Store.CreateMultipart(ctx, upload.FileKey, storage.PutOptions{
+			ContentType: encryptedContentType,
+			Metadata:    fileMetadata(upload.Filename),
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start upload"})
+			return
+		}
+		upload.StoreUploadID = storeUploadId
+		upload.PartSize = u.PartSize
+
+		if err := u.Uploads.CreateUpload(ctx, *upload); err != nil {
+			u.Store.AbortMultipart(ctx, upload.FileKey, storeUploadId)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error saving upload"})
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{
+			"message": "upload started",
+			"upload":  upload,
+			"parts":   partCount(upload),
+		})
+	}
+}
+
+// HandleDirect is POST /uploads/direct. Besides what HandleCreate takes it
+// needs the file's SHA-256, hex encoded, and optionally its content type
+// and "method": "put" (the default) or "post" for a browser form upload. It
+// returns the signed request to send the file with, which only accepts a
+// file of that exact size and content type.
+func (u *Uploader) HandleDirect() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+
+		var req struct {
+			uploadRequest
+			ContentType string `json:"contentType"`
+			SHA256      string `json:"sha256"`
+			Method      string `json:"method"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+			return
+		}
+		checksum, err := hex.DecodeString(req.SHA256)
+		if err != nil || len(checksum) != sha256.Size {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "sha256 must be the hex encoded SHA-256 of the file"})
+			return
+		}
+		if req.ContentType == "" {
+			req.ContentType = "application/octet-stream"
+		}
+		if _, _, err := mime.ParseMediaType(req.ContentType); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "contentType is not a valid media type"})
+			return
+		}
+		upload, ok := u.newUpload(c, req.uploadRequest)
+		if !ok {
+			return
+		}
+		upload.Direct = true
+		upload.StagingKey = "staging/" + upload.ID
+		upload.ContentType = req.ContentType
+		upload.SHA256 = hex.EncodeToString(checksum)
+
+		opts := storage.PutOptions{
+			ContentType: upload.ContentType,
+			Size:        upload.Size,
+			Metadata:    fileMetadata(upload.Filename),
+		}
+		var signed *storage.DirectUpload
+		switch strings.ToLower(req.Method) {
+		case "", "put":
+			signed, err = u.Store.SignedPut(ctx, upload.StagingKey, opts, u.DirectExpiry)
+		case "post":
+			signed, err = u.Store.SignedPost(ctx, upload.StagingKey, opts, u.DirectExpiry)
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": `method must be "put" or "post"`})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign upload"})
+			return
+		}
+
+		if err := u.Uploads.CreateUpload(ctx, *upload); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error saving upload"})
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{
+			"message": "upload started",
+			"upload":  upload,
+			"request": signed,
+		})
+	}
+}
+
+// stagingKey is where the client sends a direct upload. Uploads started
+// before staging keys were sent straight to FileKey.
+func stagingKey(upload *database.Upload) string {
+	if upload.StagingKey == "" {
+		return upload.FileKey
+	}
+	return upload.StagingKey
+}
+
+// HandleFinalize is POST /uploads/{id}/finalize, called once a direct
+// upload has reached the store. It claims the upload, so only one call
+// finalizes it, and encrypts the file from its staging key into its own,
+// checking it on the way. A file whose size or checksum is not what the
+// upload declared is deleted, and the upload with it.
+func (u *Uploader) HandleFinalize() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		upload, ok := u.ownUploadOfKind(c, true)
+		if !ok {
+			return
+		}
+		staging := stagingKey(upload)
+
+		stat, err := u.Store.Stat(ctx, staging)
+		if errors.Is(err, storage.ErrNotFound) {
+			c.JSON(http.StatusConflict, gin.H{"error": "The file has not been uploaded yet"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error reading upload"})
+			return
+		}
+
+		claimed, err := u.Uploads.ClaimUpload(ctx, upload.ID, time.Now().Unix())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error claiming upload"})
+			return
+		}
+		if !claimed {
+			c.JSON(http.StatusConflict, gin.H{"error": "The upload is already being finalized"})
+			return
+		}
+		upload.ClaimedAt = time.Now().Unix()
+
+		var info *UploadInfo
+		if stat.Size == upload.Size {
+			info, err = EncryptStoredFile(ctx, u.Store, u.Vault, staging, upload.FileKey, upload.Filename)
+			if err != nil {
+				u.release(ctx, upload)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read uploaded file"})
+				return
+			}
+		}
+		if info == nil || info.SHA256 != upload.SHA256 {
+			if err := u.abort(ctx, upload); err != nil {
+				log.Printf("Error discarding upload %s: %v", upload.ID, err)
+			}
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "The uploaded file does not match its declared size and checksum"})
+			return
+		}
+
+		if !u.finish(c, upload, info) {
+			u.release(ctx, upload)
+			return
+		}
+		if upload.StagingKey != "" {
+			if err := u.Store.Delete(ctx, upload.StagingKey); err != nil && !errors.Is(err, storage.ErrNotFound) {
+				log.Printf("Error deleting %s of finalized upload %s: %v", upload.StagingKey, upload.ID, err)
+			}
+		}
+	}
+}
+
+// release gives up the claim on upload, so that finalizing it can be tried
+// again.
+func (u *Uploader) release(ctx context.Context, upload *database.Upload) {
+	if err := u.Uploads.ReleaseUpload(ctx, upload.ID); err != nil {
+		log.Printf("Error releasing upload %s: %v", upload.ID, err)
+	}
+}
+
+// finish records the file or version an upload created and ends the
+// upload, reporting whether it did. When it did not, it has written the
+// error response and the upload is left as it was.
+func (u *Uploader) finish(c *gin.Context, upload *database.Upload, info *UploadInfo) bool {
+	ctx := c.Request.Context()
+
+	if upload.NewVersion {
+		return u.finishVersion(c, upload, info)
+	}
+
+	userFile := database.UserFile{
+		ID:          upload.FileID,
+		FileKey:     upload.FileKey,
+		Filename:    upload.Filename,
+		User:        upload.User,
+		CreatedAt:   time.Now().Unix(),
+		Size:        info.Size,
+		ContentType: info.ContentType,
+		SHA256:      info.SHA256,
+		Description: upload.Description,
+		Tags:        upload.Tags,
+		Encryption:  info.Encryption,
+	}
+	if err := u.Versions.Create(ctx, userFile); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error saving file record."})
+		return false
+	}
+	userFile.Version = 1
+	if err := u.Uploads.DeleteUpload(ctx, upload.ID); err != nil {
+		log.Printf("Error deleting completed upload %s: %v", upload.ID, err)
+	}
+	u.Events.Publish(events.FileUploaded, upload.User, events.FileData{FileID: userFile.ID, FileKey: userFile.FileKey, Version: 1})
+
+	c.JSON(http.StatusOK, gin.H{"message": "file saved", "file": userFile})
+	return true
+}
+
+// finishVersion adds the version an upload created to its file.
+func (u *Uploader) finishVersion(c *gin.Context, upload *database.Upload, info *UploadInfo) bool {
+	ctx := c.Request.Context()
+
+	file, err := u.Files.GetFile(ctx, upload.FileID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error reading file"})
+		return false
+	}
+	if file == nil || file.Trashed() {
+		// deleted while the upload ran
+		if err := u.Store.Delete(ctx, upload.FileKey); err != nil && !errors.Is(err, storage.ErrNotFound) {
+			log.Printf("Error deleting %s of orphaned upload %s: %v", upload.FileKey, upload.ID, err)
+		}
+		if err := u.Uploads.DeleteUpload(ctx, upload.ID); err != nil {
+			log.Printf("Error deleting orphaned upload %s: %v", upload.ID, err)
+		}
+		c.JSON(http.StatusGone, gin.H{"error": "The file this upload was a version of is gone"})
+		return true
+	}
+
+	v, err := u.Versions.Add(ctx, file, database.FileVersion{
+		FileKey:     upload.FileKey,
+		Size:        info.Size,
+		ContentType: info.ContentType,
+		SHA256:      info.SHA256,
+		Encryption:  info.Encryption,
+		UploadedBy:  upload.User,
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error saving version"})
+		return false
+	}
+	if err := u.Uploads.DeleteUpload(ctx, upload.ID); err != nil {
+		log.Printf("Error deleting completed upload %s: %v", upload.ID, err)
+	}
+	u.Events.Publish(events.FileUploaded, file.User, events.FileData{FileID: file.ID, FileKey: v.FileKey, Version: v.Number})
+
+	c.JSON(http.StatusOK, gin.H{"message": "version saved", "version": v})
+	return true
+}
+
+// HandlePart is PUT /uploads/{id}/parts/{number}. The body is the raw part
+// and its Content-Length must be the part's exact size.
+func (u *Uploader) HandlePart() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		upload, ok := u.ownUploadOfKind(c, false)
+		if !ok {
+			return
+		}
+
+		number, err := strconv.Atoi(c.Param("number"))
+		if err != nil || number < 1 || number > partCount(upload) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("part number must be between 1 and %d", partCount(upload))})
+			return
+		}
+		size := partLength(upload, number)
+		if c.Request.ContentLength != size {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("part %d must be exactly %d bytes", number, size)})
+			return
+		}
+
+		body, err := u.partBody(ctx, upload, number, http.MaxBytesReader(c.Writer, c.Request.Body, size))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store part"})
+			return
+		}
+		part, err := u.Store.UploadPart(ctx, upload.FileKey, upload.StoreUploadID, number, body, storedPartLength(upload, number))
+		if errors.Is(err, storage.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Upload not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store part"})
+			return
+		}
+		if err := u.Uploads.TouchUpload(ctx, upload.ID, time.Now().Unix()); err != nil {
+			log.Printf("Error touching upload %s: %v", upload.ID, err)
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "part stored", "part": part})
+	}
+}
+
+// partBody encrypts part number of upload as it is read from body.
+func (u *Uploader) partBody(ctx context.Context, upload *database.Upload, number int, body io.Reader) (io.Reader, error) {
+	if upload.Encryption == nil {
+		return body, nil
+	}
+	key, err := u.Vault.dataKey(ctx, upload.Encryption)
+	if err != nil {
+		return nil, err
+	}
+	firstChunk := uint64(int64(number-1) * upload.PartSize / envelope.ChunkSize)
+	return envelope.NewPartEncrypter(body, key, firstChunk, number == partCount(upload))
+}
+
+// HandleParts is GET /uploads/{id}/parts. Besides the stored parts it lists
+// the numbers still missing, which is what a client resuming an upload
+// needs to send.
+func (u *Uploader) HandleParts() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		upload, ok := u.ownUploadOfKind(c, false)
+		if !ok {
+			return
+		}
+
+		parts, err := u.Store.ListParts(c.Request.Context(), upload.FileKey, upload.StoreUploadID)
+		if errors.Is(err, storage.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Upload not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error listing parts"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message": "Success",
+			"upload":  upload,
+			"parts":   parts,
+			"missing": missingParts(upload, parts),
+		})
+	}
+}
+
+// HandleComplete is POST /uploads/{id}/complete. It joins the parts into
+// the file once every one of them has arrived. Like HandleFinalize it
+// claims the upload first, so only one call completes it. If recording the
+// file fails the claim is given up, and calling it again picks up the
+// already joined file.
+func (u *Uploader) HandleComplete() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		upload, ok := u.ownUploadOfKind(c, false)
+		if !ok {
+			return
+		}
+
+		claimed, err := u.Uploads.ClaimUpload(ctx, upload.ID, time.Now().Unix())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error claiming upload"})
+			return
+		}
+		if !claimed {
+			c.JSON(http.StatusConflict, gin.H{"error": "The upload is already being completed"})
+			return
+		}
+		upload.ClaimedAt = time.Now().Unix()
+
+		if !u.complete(c, upload) {
+			u.release(ctx, upload)
+			return
+		}
+
+		info, err := InspectStoredFile(ctx, u.Store, u.Vault, upload.FileKey, upload.Encryption)
+		if err != nil {
+			u.release(ctx, upload)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read completed upload"})
+			return
+		}
+
+		if !u.finish(c, upload, info) {
+			u.release(ctx, upload)
+		}
+	}
+}
+
+// complete joins the parts of a claimed upload into its file, reporting
+// whether it did. When it did not, it has written the error response. A
+// file joined by an earlier call is taken as it is.
+func (u *Uploader) complete(c *gin.Context, upload *database.Upload) bool {
+	ctx := c.Request.Context()
+
+	parts, err := u.Store.ListParts(ctx, upload.FileKey, upload.StoreUploadID)
+	if errors.Is(err, storage.ErrNotFound) {
+		_, err := u.Store.Stat(ctx, upload.FileKey)
+		if err == nil {
+			return true
+		}
+		if errors.Is(err, storage.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Upload not found"})
+			return false
+		}
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error listing parts"})
+		return false
+	}
+	if missing := missingParts(upload, parts); len(missing) > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Upload is missing parts", "missing": missing})
+		return false
+	}
+
+	if err := u.Store.CompleteMultipart(ctx, upload.FileKey, upload.StoreUploadID, parts); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to complete upload"})
+		return false
+	}
+	return true
+}
+
+// HandleAbort is DELETE /uploads/{id}, for either kind of upload.
+func (u *Uploader) HandleAbort() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		upload, ok := u.ownUpload(c)
+		if !ok {
+			return
+		}
+		if upload.ClaimedAt != 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": "The upload is being finalized"})
+			return
+		}
+		if err := u.abort(c.Request.Context(), upload); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Upload aborted"})
+	}
+}
+
+// abort discards an upload, along with whatever of the file reached the
+// store. A claimed upload may have been finished up to recording its file,
+// and then its content is left to the file.
+func (u *Uploader) abort(ctx context.Context, upload *database.Upload) error {
+	var keys []string
+	if upload.Direct {
+		keys = append(keys, stagingKey(upload))
+	} else {
+		err := u.Store.AbortMultipart(ctx, upload.FileKey, upload.StoreUploadID)
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return err
+		}
+	}
+	if !upload.Direct || upload.StagingKey != "" {
+		recorded, err := u.recorded(ctx, upload)
+		if err != nil {
+			return err
+		}
+		if !recorded {
+			keys = append(keys, upload.FileKey)
+		}
+	}
+	for _, key := range keys {
+		if err := u.Store.Delete(ctx, key); err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return err
+		}
+	}
+	return u.Uploads.DeleteUpload(ctx, upload.ID)
+}
+
+// recorded reports whether a file or version refers to upload's content.
+func (u *Uploader) recorded(ctx context.Context, upload *database.Upload) (bool, error) {
+	if upload.ClaimedAt == 0 {
+		return false, nil
+	}
+	file, err := u.Files.GetFile(ctx, upload.FileID)
+	if err != nil || file == nil {
+		return false, err
+	}
+	if file.FileKey == upload.FileKey {
+		return true, nil
+	}
+	versions, err := u.Versions.Versions.ListVersions(ctx, file.ID)
+	if err != nil {
+		return false, err
+	}
+	for _, v := range versions {
+		if v.FileKey == upload.FileKey {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Sweep aborts the uploads that have gone stale and returns how many it
+// aborted.
+func (u *Uploader) Sweep(ctx context.Context) (int, error) {
+	stale, err := u.Uploads.ListStaleUploads(ctx, time.Now().Add(-u.StaleAfter).Unix())
+	if err != nil {
+		return 0, err
+	}
+	aborted := 0
+	for _, upload := range stale {
+		if err := u.abort(ctx, &upload); err != nil {
+			log.Printf("Error aborting stale upload %s: %v", upload.ID, err)
+			continue
+		}
+		aborted++
+	}
+	return aborted, nil
+}
+
+// Run sweeps stale uploads until ctx is cancelled.
+func (u *Uploader) Run(ctx context.Context) {
+	ticker := time.NewTicker(u.SweepInterval)
+	defer ticker.Stop()
+
+	for {
+		aborted, err := u.Sweep(ctx)
+		if err != nil {
+			log.Printf("Error sweeping stale uploads: %v", err)
+		}
+		if aborted > 0 {
+			log.Printf("Aborted %d stale uploads", aborted)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package amazonwebservices
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"effective-invention/server/amazonwebservices/database"
+	"effective-invention/server/envelope"
+	"effective-invention/server/storage"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// encryptedContentType is what the store is told an encrypted file is; the
+// real content type is on the file record.
+const encryptedContentType = "application/octet-stream"
+
+// Vault encrypts user files on their way into the object store and
+// decrypts them on the way out, so the store only ever holds ciphertext.
+// Every file gets a data key of its own, which Keys wraps for the file
+// record. Since the store cannot serve an encrypted file itself, download
+// links to one point back at this server, at BaseURL/files/{id}/content,
+// and are signed with Secret.
+type Vault struct {
+	Keys    envelope.KeyProvider
+	BaseURL string
+	Secret  []byte
+}
+
+// newDataKey returns a data key for a new file, and the encryption
+// metadata to keep on its record.
+func (v *Vault) newDataKey(ctx context.Context) ([]byte, *database.FileEncryption, error) {
+	key, err := envelope.NewDataKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	wrapped, keyID, err := v.Keys.WrapKey(ctx, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to wrap data key: %w", err)
+	}
+	return key, &database.FileEncryption{
+		Algorithm:  envelope.Algorithm,
+		KeyID:      keyID,
+		WrappedKey: wrapped,
+	}, nil
+}
+
+// dataKey unwraps the data key of enc.
+func (v *Vault) dataKey(ctx context.Context, enc *database.FileEncryption) ([]byte, error) {
+	if enc.Algorithm != envelope.Algorithm {
+		return nil, fmt.Errorf("unsupported encryption %q", enc.Algorithm)
+	}
+	return v.Keys.UnwrapKey(ctx, enc.WrappedKey, enc.KeyID)
+}
+
+// Rewrap wraps the data key of enc again under the current master key. The
+// content it encrypts stays as it is.
+func (v *Vault) Rewrap(ctx context.Context, enc database.FileEncryption) (database.FileEncryption, error) {
+	key, err := v.dataKey(ctx, &enc)
+	if err != nil {
+		return enc, err
+	}
+	enc.WrappedKey, enc.KeyID, err = v.Keys.WrapKey(ctx, key)
+	if err != nil {
+		return enc, fmt.Errorf("failed to wrap data key: %w", err)
+	}
+	return enc, nil
+}
+
+// open gets the object at fileKey and decrypts it with enc, or leaves it
+// as it is when enc is nil. The object's Size is that of the content.
+func (v *Vault) open(ctx context.Context, store storage.ObjectStore, fileKey string, enc *database.FileEncryption) (*storage.Object, error) {
+	obj, err := store.Get(ctx, fileKey)
+	if err != nil || enc == nil {
+		return obj, err
+	}
+	key, err := v.dataKey(ctx, enc)
+	if err == nil {
+		var plain io.Reader
+		plain, err = envelope.NewDecrypter(obj.Body, key)
+		obj.Body = struct {
+			io.Reader
+			io.Closer
+		}{plain, obj.Body}
+	}
+	if err != nil {
+		obj.Body.Close()
+		return nil, err
+	}
+	obj.Size = envelope.DecryptedSize(obj.Size)
+	return obj, nil
+}
+
+// Open returns the content of file.
+func (v *Vault) Open(ctx context.Context, store storage.ObjectStore, file *database.UserFile) (*storage.Object, error) {
+	return v.open(ctx, store, file.FileKey, file.Encryption)
+}
+
+func (v *Vault) sign(fileId string, expires int64) string {
+	mac := hmac.New(sha256.New, v.Secret)
+	fmt.Fprintf(mac, "CONTENT\n%s\n%d", fileId, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// DownloadURL returns a link to file that works for ttl without an access
+// token. Files stored before encryption are linked in the store directly.
+func (v *Vault) DownloadURL(ctx context.Context, store storage.ObjectStore, file *database.UserFile, ttl time.Duration) (string, error) {
+	if file.Encryption == nil {
+		return store.SignedURL(ctx, file.FileKey, ttl)
+	}
+	expires := time.Now().Add(ttl).Unix()
+	q := url.Values{}
+	q.Set("expires", strconv.FormatInt(expires, 10))
+	q.Set("signature", v.sign(file.ID, expires))
+	return fmt.Sprintf("%s/files/%s/content?%s", v.BaseURL, url.PathEscape(file.ID), q.Encode()), nil
+}
+
+// HandleSignedDownload serves files for links created by DownloadURL.
+// Register it as GET /files/:id/content, outside access token checks.
+func (v *Vault) HandleSignedDownload(files database.FileRepository, store storage.ObjectStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		fileId := c.Param("id")
+
+		expires, err := strconv.ParseInt(c.Query("expires"), 10, 64)
+		if err != nil || time.Now().Unix() > expires ||
+			!hmac.Equal([]byte(v.sign(fileId, expires)), []byte(c.Query("signature"))) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Link is invalid or has expired"})
+			return
+		}
+
+		file, err := files.GetFile(c.Request.Context(), fileId)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error reading file"})
+			return
+		}
+		if file == nil || file.Trashed() {
+			c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+			return
+		}
+
+		err = StreamDownloadFile(c, store, v, file)
+		if errors.Is(err, storage.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+			return
+		}
+		if err != nil {
+			log.Printf("Error serving file %s: %v", fileId, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+	}
+}
@@ -0,0 +1,552 @@
+package amazonwebservices
+
+import (
+	"context"
+	"effective-invention/server/amazonwebservices/auth"
+	"effective-invention/server/amazonwebservices/database"
+	"effective-invention/server/events"
+	"effective-invention/server/storage"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gofrs/uuid"
+)
+
+// maxVersionAttempts bounds how often adding a version retries when another
+// upload took the number it wanted.
+const maxVersionAttempts = 5
+
+var errAlreadyCurrent = errors.New("version is already current")
+
+// VersionPolicy says which old versions of a file to prune: those that are
+// not among the KeepLast newest, and those older than MaxAge. Zero values
+// keep everything, and the current version is always kept.
+type VersionPolicy struct {
+	KeepLast int
+	MaxAge   time.Duration
+}
+
+// prunes reports whether v, the index-th newest version, goes.
+func (p VersionPolicy) prunes(v *database.FileVersion, index int, now time.Time) bool {
+	if p.KeepLast > 0 && index >= p.KeepLast {
+		return true
+	}
+	return p.MaxAge > 0 && time.Unix(v.CreatedAt, 0).Before(now.Add(-p.MaxAge))
+}
+
+// Versioner keeps the history of files' content. Every upload to an
+// existing file adds an immutable version with an object of its own, and
+// the file record always describes the current one. Policy is applied
+// after every new version.
+type Versioner struct {
+	Files    database.FileRepository
+	Versions database.VersionRepository
+	Store    storage.ObjectStore
+	Vault    *Vault
+	Events   *events.Bus
+	Policy   VersionPolicy
+
+	locks fileLocks
+}
+
+// fileLocks serializes the changes to each file's versions, so that a
+// prune cannot delete an object that a restore is about to share.
+type fileLocks struct {
+	mu    sync.Mutex
+	files map[string]*fileLock
+}
+
+type fileLock struct {
+	sync.Mutex
+	holders int
+}
+
+// lock locks file id and returns the function that unlocks it.
+func (l *fileLocks) lock(id string) func() {
+	l.mu.Lock()
+	if l.files == nil {
+		l.files = make(map[string]*fileLock)
+	}
+	fl := l.files[id]
+	if fl == nil {
+		fl = &fileLock{}
+		l.files[id] = fl
+	}
+	fl.holders++
+	l.mu.Unlock()
+
+	fl.Lock()
+	return func() {
+		fl.Unlock()
+		l.mu.Lock()
+		fl.holders--
+		if fl.holders == 0 {
+			delete(l.files, id)
+		}
+		l.mu.Unlock()
+	}
+}
+
+// newVersionKey returns a fresh key for a version of a user's file.
+func newVersionKey(userId string) (string, error) {
+	id, err := uuid.NewV1()
+	if err != nil {
+		return "", err
+	}
+	return UserFileKey(userId, fmt.Sprintf("VERSION_%s", id)), nil
+}
+
+// currentVersion describes the current content of file as a version. Files
+// stored before versions have it as their only version, number 1.
+func currentVersion(file *database.UserFile) database.FileVersion {
+	v := database.FileVersion{
+		FileID:      file.ID,
+		Number:      max(file.Version, 1),
+		FileKey:     file.FileKey,
+		Size:        file.Size,
+		ContentType: file.ContentType,
+		SHA256:      file.SHA256,
+		Encryption:  file.Encryption,
+		UploadedBy:  file.User,
+		CreatedAt:   file.CreatedAt,
+	}
+	if v.Number == 1 {
+		compareVersions(&v, nil)
+	}
+	return v
+}
+
+// compareVersions sets how v differs from prev, the version before it, or
+// from nothing when prev is nil. Versions sharing an object have the same
+// content; otherwise it is told apart by checksum, when there is one.
+func compareVersions(v, prev *database.FileVersion) {
+	if prev == nil {
+		v.SizeDelta = v.Size
+		v.ContentChanged = true
+		return
+	}
+	v.SizeDelta = v.Size - prev.Size
+	v.ContentChanged = v.FileKey != prev.FileKey && (v.SHA256 == "" || v.SHA256 != prev.SHA256)
+}
+
+// atVersion is file as it was at version v.
+func atVersion(file *database.UserFile, v *database.FileVersion) *database.UserFile {
+	old := *file
+	old.FileKey = v.FileKey
+	old.Size = v.Size
+	old.ContentType = v.ContentType
+	old.SHA256 = v.SHA256
+	old.Encryption = v.Encryption
+	old.Version = v.Number
+	return &old
+}
+
+// Create records a new file as version 1 of itself.
+func (vr *Versioner) Create(ctx context.Context, file database.UserFile) error {
+	file.Version = 1
+	if err := vr.Versions.CreateVersion(ctx, currentVersion(&file)); err != nil {
+		return err
+	}
+	return vr.Files.CreateFile(ctx, file)
+}
+
+// Add makes v, whose content is already stored, the new current version of
+// file and returns it numbered.
+func (vr *Versioner) Add(ctx context.Context, file *database.UserFile, v database.FileVersion) (*database.FileVersion, error) {
+	defer vr.locks.lock(file.ID)()
+	return vr.add(ctx, file, v)
+}
+
+// add is Add with file locked.
+func (vr *Versioner) add(ctx context.Context, file *database.UserFile, v database.FileVersion) (*database.FileVersion, error) {
+	if file.Version == 0 {
+		err := vr.Versions.CreateVersion(ctx, currentVersion(file))
+		if err != nil && !errors.Is(err, database.ErrVersionExists) {
+			return nil, err
+		}
+	}
+
+	v.FileID = file.ID
+	v.Number = max(file.Version, 1) + 1
+	if v.CreatedAt == 0 {
+		v.CreatedAt = time.Now().Unix()
+	}
+	prev := currentVersion(file)
+	compareVersions(&v, &prev)
+	for attempt := 1; ; attempt++ {
+		err := vr.Versions.CreateVersion(ctx, v)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, database.ErrVersionExists) || attempt == maxVersionAttempts {
+			return nil, err
+		}
+		v.Number++
+		// another upload took the number, so compare with its version
+		taken, err := vr.Versions.GetVersion(ctx, file.ID, v.Number-1)
+		if err != nil {
+			return nil, err
+		}
+		if taken != nil {
+			compareVersions(&v, taken)
+		}
+	}
+	if err := vr.Files.SetCurrentVersion(ctx, file.ID, v); err != nil {
+		return nil, err
+	}
+
+	current := atVersion(file, &v)
+	if _, err := vr.prune(ctx, current, vr.Policy); err != nil {
+		log.Printf("Error pruning versions of %s: %v", file.ID, err)
+	}
+	return &v, nil
+}
+
+// list returns the versions of file, newest first.
+func (vr *Versioner) list(ctx context.Context, file *database.UserFile) ([]database.FileVersion, error) {
+	versions, err := vr.Versions.ListVersions(ctx, file.ID)
+	if err != nil {
+		return nil, err
+	}
+	if len(versions) == 0 {
+		versions = []database.FileVersion{currentVersion(file)}
+	}
+	return versions, nil
+}
+
+// get returns version number of file, or nil when there is none.
+func (vr *Versioner) get(ctx context.Context, file *database.UserFile, number int) (*database.FileVersion, error) {
+	v, err := vr.Versions.GetVersion(ctx, file.ID, number)
+	if err != nil || v != nil {
+		return v, err
+	}
+	if file.Version == 0 && number == 1 {
+		current := currentVersion(file)
+		return &current, nil
+	}
+	return nil, nil
+}
+
+// Restore adds a version of file with the content of version number,
+// sharing its object.
+func (vr *Versioner) Restore(ctx context.Context, file *database.UserFile, number int, by string) (*database.FileVersion, error) {
+	if number == max(file.Version, 1) {
+		return nil, errAlreadyCurrent
+	}
+	defer vr.locks.lock(file.ID)()
+
+	old, err := vr.get(ctx, file, number)
+	if err != nil {
+		return nil, err
+	}
+	if old == nil {
+		return nil, storage.ErrNotFound
+	}
+
+	restored := *old
+	restored.UploadedBy = by
+	restored.RestoredFrom = old.Number
+	restored.CreatedAt = 0
+	return vr.add(ctx, file, restored)
+}
+
+// Prune deletes the versions of file that policy lets go and returns them.
+// An object is only deleted once no version left uses it.
+func (vr *Versioner) Prune(ctx context.Context, file *database.UserFile, policy VersionPolicy) ([]database.FileVersion, error) {
+	defer vr.locks.lock(file.ID)()
+	return vr.prune(ctx, file, policy)
+}
+
+// prune is Prune with file locked.
+func (vr *Versioner) prune(ctx context.Context, file *database.UserFile, policy VersionPolicy) ([]database.FileVersion, error) {
+	if policy == (VersionPolicy{}) {
+		return nil, nil
+	}
+	versions, err := vr.Versions.ListVersions(ctx, file.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	kept := map[string]bool{file.FileKey: true}
+	var pruned []database.FileVersion
+	for i, v := range versions {
+		if v.Number == file.Version || !policy.prunes(&v, i, now) {
+			kept[v.FileKey] = true
+			continue
+		}
+		pruned = append(pruned, v)
+	}
+
+	for i, v := range pruned {
+		if err := vr.Versions.DeleteVersion(ctx, v.FileID, v.Number); err != nil {
+			return pruned[:i], err
+		}
+		if kept[v.FileKey] {
+			continue
+		}
+		kept[v.FileKey] = true
+		if err := vr.Store.Delete(ctx, v.FileKey); err != nil && !errors.Is(err, storage.ErrNotFound) {
+			log.Printf("Error deleting %s of pruned version %d of %s: %v", v.FileKey, v.Number, v.FileID, err)
+		}
+	}
+	return pruned, nil
+}
+
+// Delete deletes file, which is in the trash, with all its versions and
+// their objects. The file is read again first, and when it has been taken
+// out of the trash since, database.ErrFileNotTrashed is returned and
+// nothing is deleted. The file record goes last, and only while the file
+// is still in the trash, so when any step fails the file is still there to
+// delete again, and steps already done are skipped over.
+func (vr *Versioner) Delete(ctx context.Context, file *database.UserFile) error {
+	defer vr.locks.lock(file.ID)()
+
+	file, err := vr.Files.GetFile(ctx, file.ID)
+	if err != nil || file == nil {
+		return err
+	}
+	if !file.Trashed() {
+		return database.ErrFileNotTrashed
+	}
+
+	versions, err := vr.list(ctx, file)
+	if err != nil {
+		return err
+	}
+
+	deleted := make(map[string]bool)
+	for _, key := range append([]string{file.FileKey}, versionKeys(versions)...) {
+		if deleted[key] {
+			continue
+		}
+		deleted[key] = true
+		if err := vr.Store.Delete(ctx, key); err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return err
+		}
+	}
+	for _, v := range versions {
+		if err := vr.Versions.DeleteVersion(ctx, v.FileID, v.Number); err != nil {
+			return err
+		}
+	}
+	return vr.Files.DeleteTrashedFile(ctx, file.ID)
+}
+
+func versionKeys(versions []database.FileVersion) []string {
+	keys := make([]string, len(versions))
+	for i, v := range versions {
+		keys[i] = v.FileKey
+	}
+	return keys
+}
+
+// ownFile loads the caller's :id file, writing the error response when
+// there is none.
+func (vr *Versioner) ownFile(c *gin.Context) (*database.UserFile, bool) {
+	principal := auth.MustPrincipal(c)
+
+	file, err := ownedFile(c.Request.Context(), vr.Files, principal.UserID, c.Param("id"))
+	if errors.Is(err, storage.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error reading file"})
+		return nil, false
+	}
+	return file, true
+}
+
+// version loads the :number version of file, writing the error response
+// when there is none.
+func (vr *Versioner) version(c *gin.Context, file *database.UserFile) (*database.FileVersion, bool) {
+	number, err := strconv.Atoi(c.Param("number"))
+	if err != nil || number < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "version must be a positive number"})
+		return nil, false
+	}
+	v, err := vr.get(c.Request.Context(), file, number)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error reading version"})
+		return nil, false
+	}
+	if v == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Version not found"})
+		return nil, false
+	}
+	return v, true
+}
+
+// HandleList is GET /files/{id}/versions, newest first. Each version says
+// how its size and content differ from the one before it.
+func (vr *Versioner) HandleList() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		file, ok := vr.ownFile(c)
+		if !ok {
+			return
+		}
+		versions, err := vr.list(c.Request.Context(), file)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error listing versions"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"message":  "Success",
+			"file":     file,
+			"versions": versions,
+		})
+	}
+}
+
+// HandleDownload is GET /files/{id}/versions/{number}, which streams the
+// content of one version.
+func (vr *Versioner) HandleDownload() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		file, ok := vr.ownFile(c)
+		if !ok {
+			return
+		}
+		v, ok := vr.version(c, file)
+		if !ok {
+			return
+		}
+
+		err := StreamDownloadFile(c, vr.Store, vr.Vault, atVersion(file, v))
+		if errors.Is(err, storage.ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Version content not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+	}
+}
+
+// HandleUpload is POST /files/{id}/versions. It takes the new content in
+// the "file" form field, like POST /upload, and makes it current.
+func (vr *Versioner) HandleUpload(maxSize int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		principal := auth.MustPrincipal(c)
+		ctx := c.Request.Context()
+
+		file, ok := vr.ownFile(c)
+		if !ok {
+			return
+		}
+		content, header, ok := formFile(c, maxSize)
+		if !ok {
+			return
+		}
+		defer content.Close()
+
+		fileKey, err := newVersionKey(file.User)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		info, err := StreamUploadFile(vr.Store, vr.Vault, fileKey, content, header)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		v, err := vr.Add(ctx, file, database.FileVersion{
+			FileKey:     fileKey,
+			Size:        info.Size,
+			ContentType: info.ContentType,
+			SHA256:      info.SHA256,
+			Encryption:  info.Encryption,
+			UploadedBy:  principal.UserID,
+		})
+		if err != nil {
+			DeleteStoredFile(vr.Store, fileKey)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error saving version"})
+			return
+		}
+		vr.Events.Publish(events.FileUploaded, file.User, events.FileData{FileID: file.ID, FileKey: fileKey, Version: v.Number})
+
+		c.JSON(http.StatusOK, gin.H{"message": "version saved", "version": v})
+	}
+}
+
+// HandleRestore is POST /files/{id}/versions/{number}/restore. The old
+// content comes back as a new version, so the history in between is kept.
+func (vr *Versioner) HandleRestore() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		principal := auth.MustPrincipal(c)
+
+		file, ok := vr.ownFile(c)
+		if !ok {
+			return
+		}
+		old, ok := vr.version(c, file)
+		if !ok {
+			return
+		}
+
+		v, err := vr.Restore(c.Request.Context(), file, old.Number, principal.UserID)
+		if errors.Is(err, errAlreadyCurrent) {
+			c.JSON(http.StatusConflict, gin.H{"error": "That version is already current"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error restoring version"})
+			return
+		}
+		vr.Events.Publish(events.FileRestored, file.User, events.FileData{FileID: file.ID, FileKey: v.FileKey, Version: v.Number})
+
+		c.JSON(http.StatusOK, gin.H{"message": "version restored", "version": v})
+	}
+}
+
+// HandlePrune is POST /files/{id}/versions/prune. The body is the policy:
+// "keepLast", a number of newest versions to keep, and/or "maxAge", a
+// duration such as "720h" past which versions go.
+func (vr *Versioner) HandlePrune() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		file, ok := vr.ownFile(c)
+		if !ok {
+			return
+		}
+
+		var req struct {
+			KeepLast int    `json:"keepLast"`
+			MaxAge   string `json:"maxAge"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload"})
+			return
+		}
+		policy := VersionPolicy{KeepLast: req.KeepLast}
+		if req.MaxAge != "" {
+			maxAge, err := time.ParseDuration(req.MaxAge)
+			if err != nil || maxAge <= 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "maxAge must be a positive duration, e.g. 720h"})
+				return
+			}
+			policy.MaxAge = maxAge
+		}
+		if policy.KeepLast < 0 || policy == (VersionPolicy{}) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Give keepLast, a positive number, or maxAge"})
+			return
+		}
+
+		pruned, err := vr.Prune(c.Request.Context(), file, policy)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error pruning versions"})
+			return
+		}
+		numbers := make([]int, len(pruned))
+		for i, v := range pruned {
+			numbers[i] = v.Number
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "versions pruned", "pruned": numbers})
+	}
+}
@@ -0,0 +1,520 @@
+package server
+
+import (
+	"crypto/rand"
+	"effective-invention/server/amazonwebservices"
+	"effective-invention/server/amazonwebservices/database"
+	"effective-invention/server/email"
+	"effective-invention/server/envelope"
+	"effective-invention/server/events"
+	"effective-invention/server/outbox"
+	"effective-invention/server/storage"
+	"effective-invention/server/websocket"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/gin-gonic/gin"
+)
+
+var aws_client aws.Config
+var awsOnce sync.Once
+
+// backends holds the storage implementations selected at startup.
+type backends struct {
+	store    storage.ObjectStore
+	users    database.UserRepository
+	files    database.FileRepository
+	tokens   database.TokenRepository
+	shares   database.ShareRepository
+	attempts database.FaceAttemptRepository
+	jobs     database.OutboxRepository
+	mailbox  database.MailboxRepository
+	uploads  database.UploadRepository
+	versions database.VersionRepository
+
+	// vault encrypts files on their way into the store
+	vault *amazonwebservices.Vault
+
+	// versioner keeps the history of files' content
+	versioner *amazonwebservices.Versioner
+
+	// mailer queues email in the outbox, which delivers it with the
+	// configured provider
+	mailer email.Mailer
+	outbox *outbox.Outbox
+
+	// events carries domain events from the handlers to the websocket hub
+	events *events.Bus
+
+	s3 bool // objects live in the AWS bucket
+}
+
+func getenv(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// awsConfig loads the AWS configuration the first time a backend needs it,
+// so a fully local setup never touches AWS credentials.
+func awsConfig() aws.Config {
+	awsOnce.Do(func() {
+		aws_client = amazonwebservices.StartAws()
+	})
+	return aws_client
+}
+
+// publicURL is the address clients use to reach this server, used when
+// building signed links. PUBLIC_URL wins over BASE_URL:PORT.
+func publicURL() string {
+	if u := os.Getenv("PUBLIC_URL"); u != "" {
+		return u
+	}
+	return fmt.Sprintf("%s:%s", os.Getenv("BASE_URL"), os.Getenv("PORT"))
+}
+
+// allowedOrigins is the WS_ALLOWED_ORIGINS allowlist of browser origins that
+// may open a websocket, comma separated, e.g.
+// "https://app.example.com,http://localhost:5173".
+func allowedOrigins() []string {
+	var origins []string
+	for _, origin := range strings.Split(os.Getenv("WS_ALLOWED_ORIGINS"), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	return origins
+}
+
+// newHub reads the websocket keepalive and size settings: WS_PING_INTERVAL,
+// WS_PONG_TIMEOUT, WS_WRITE_TIMEOUT and WS_MAILBOX_RETENTION as durations
+// (e.g. "30s"), WS_MAX_MESSAGE_BYTES and the rate limit, and connects the
+// backplane.
+func newHub() (*websocket.Hub, error) {
+	hub := websocket.NewHub()
+	durations := []struct {
+		key string
+		dst *time.Duration
+	}{
+		{"WS_PING_INTERVAL", &hub.PingInterval},
+		{"WS_PONG_TIMEOUT", &hub.PongWait},
+		{"WS_WRITE_TIMEOUT", &hub.WriteWait},
+		{"WS_MAILBOX_RETENTION", &hub.Retention},
+	}
+	for _, d := range durations {
+		v := os.Getenv(d.key)
+		if v == "" {
+			continue
+		}
+		parsed, err := time.ParseDuration(v)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("invalid %s %q", d.key, v)
+		}
+		*d.dst = parsed
+	}
+	if hub.PingInterval >= hub.PongWait {
+		return nil, fmt.Errorf("WS_PING_INTERVAL (%s) must be shorter than WS_PONG_TIMEOUT (%s)", hub.PingInterval, hub.PongWait)
+	}
+
+	if v := os.Getenv("WS_MAX_MESSAGE_BYTES"); v != "" {
+		size, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || size <= 0 {
+			return nil, fmt.Errorf("invalid WS_MAX_MESSAGE_BYTES %q", v)
+		}
+		hub.MaxMessageSize = size
+	}
+
+	// every connection may send WS_RATE_LIMIT frames a second on average,
+	// in bursts of up to WS_RATE_BURST
+	rateLimit, err := strconv.ParseFloat(getenv("WS_RATE_LIMIT", "20"), 64)
+	if err != nil || rateLimit <= 0 {
+		return nil, fmt.Errorf("WS_RATE_LIMIT must be a positive number")
+	}
+	rateBurst, err := strconv.Atoi(getenv("WS_RATE_BURST", "40"))
+	if err != nil || rateBurst < 1 {
+		return nil, fmt.Errorf("WS_RATE_BURST must be a positive number")
+	}
+	hub.Router.Use(websocket.RateLimit(rateLimit, rateBurst))
+
+	// WS_BACKPLANE=tcp links the hubs of several instances through a relay
+	// at WS_RELAY_ADDR. One instance can host the relay by setting
+	// WS_RELAY_LISTEN, e.g. ":7070".
+	switch backplane := os.Getenv("WS_BACKPLANE"); backplane {
+	case "":
+	case "tcp":
+		addr := os.Getenv("WS_RELAY_ADDR")
+		if listen := os.Getenv("WS_RELAY_LISTEN"); listen != "" {
+			relay, err := websocket.ListenRelay(listen)
+			if err != nil {
+				return nil, fmt.Errorf("failed to start websocket relay: %w", err)
+			}
+			if addr == "" {
+				addr = relay.Addr().String()
+			}
+		}
+		if addr == "" {
+			return nil, fmt.Errorf("WS_BACKPLANE=tcp needs WS_RELAY_ADDR or WS_RELAY_LISTEN")
+		}
+		hub.Backplane = websocket.DialBackplane(addr)
+	default:
+		return nil, fmt.Errorf("unknown WS_BACKPLANE %q", backplane)
+	}
+	return hub, nil
+}
+
+func newBackends(r *gin.Engine) (*backends, error) {
+	b := &backends{events: events.NewBus()}
+
+	secret, err := signingSecret()
+	if err != nil {
+		return nil, err
+	}
+	store, err := newObjectStore(r, secret)
+	if err != nil {
+		return nil, err
+	}
+	b.store = store
+	_, b.s3 = store.(*amazonwebservices.S3Store)
+
+	keys, err := newKeyProvider()
+	if err != nil {
+		return nil, err
+	}
+	b.vault = &amazonwebservices.Vault{Keys: keys, BaseURL: publicURL(), Secret: secret}
+
+	if err := newRepositories(b); err != nil {
+		return nil, err
+	}
+	if b.versioner, err = newVersioner(b); err != nil {
+		return nil, err
+	}
+
+	provider, err := newMailer()
+	if err != nil {
+		return nil, err
+	}
+	if b.outbox, err = newOutbox(b.jobs, provider); err != nil {
+		return nil, err
+	}
+	b.outbox.Events = b.events
+	b.mailer = b.outbox
+	return b, nil
+}
+
+// signingSecret is STORAGE_SIGNING_SECRET, which signs the links this
+// server serves files and takes uploads at.
+func signingSecret() ([]byte, error) {
+	secret := []byte(os.Getenv("STORAGE_SIGNING_SECRET"))
+	if len(secret) == 0 {
+		log.Println("STORAGE_SIGNING_SECRET not set, signed links will not survive a restart")
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+	}
+	return secret, nil
+}
+
+// newKeyProvider reads the master keys that wrap the data keys of files.
+// VAULT_KEYS is a comma separated list of ID:key pairs, each key 32 bytes
+// base64 encoded (as made by "openssl rand -base64 32"), and
+// VAULT_ACTIVE_KEY the ID of the key new files use, which may be left out
+// when there is only one. Keys that were rotated out stay in the list
+// until "rotate-keys" has moved every file off them.
+func newKeyProvider() (*envelope.Keyring, error) {
+	spec := os.Getenv("VAULT_KEYS")
+	if spec == "" {
+		return nil, fmt.Errorf("VAULT_KEYS must be set to encrypt stored files")
+	}
+	keys, err := envelope.ParseKeyring(spec, os.Getenv("VAULT_ACTIVE_KEY"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid VAULT_KEYS: %w", err)
+	}
+	return keys, nil
+}
+
+// newObjectStore picks the storage backend from STORAGE_BACKEND ("s3" or
+// "local"). The local backend serves its signed URLs, and takes signed
+// uploads, at /objects on r, which commands that serve nothing leave nil.
+func newObjectStore(r *gin.Engine, secret []byte) (storage.ObjectStore, error) {
+	switch os.Getenv("STORAGE_BACKEND") {
+	case "local":
+		dir := getenv("LOCAL_STORAGE_DIR", "data/objects")
+		local, err := storage.NewLocalStore(dir, publicURL(), secret)
+		if err != nil {
+			return nil, err
+		}
+		if r != nil {
+			r.GET("/objects/*key", local.HandleSignedGet())
+			r.PUT("/objects/*key", local.HandleSignedPut())
+			r.POST("/objects", local.HandleSignedPost())
+		}
+		return local, nil
+	case "", "s3":
+		s3_client, err := amazonwebservices.ConnectS3(awsConfig())
+		if err != nil {
+			return nil, err
+		}
+		return amazonwebservices.NewS3Store(s3_client, os.Getenv("AWS_BUCKET_NAME")), nil
+	default:
+		return nil, fmt.Errorf("unknown STORAGE_BACKEND %q", os.Getenv("STORAGE_BACKEND"))
+	}
+}
+
+// newMailer picks the email backend from MAIL_BACKEND ("resend" or "dir").
+// By default mail goes through Resend when RESEND_API_KEY is set and is
+// written to MAIL_DIR (default data/mail) otherwise.
+func newMailer() (email.Mailer, error) {
+	backend := os.Getenv("MAIL_BACKEND")
+	if backend == "" {
+		backend = "dir"
+		if os.Getenv("RESEND_API_KEY") != "" {
+			backend = "resend"
+		}
+	}
+
+	switch backend {
+	case "resend":
+		return email.NewResendMailer(email.InitResendClient()), nil
+	case "dir":
+		dir := getenv("MAIL_DIR", "data/mail")
+		log.Printf("Writing outgoing email to %s\n", dir)
+		return email.NewDirMailer(dir)
+	default:
+		return nil, fmt.Errorf("unknown MAIL_BACKEND %q", backend)
+	}
+}
+
+// newOutbox configures email delivery. OUTBOX_WORKERS sets the number of
+// concurrent deliveries (default 4) and OUTBOX_MAX_ATTEMPTS the attempts
+// before a message is dead-lettered (default 8).
+func newOutbox(jobs database.OutboxRepository, provider email.Mailer) (*outbox.Outbox, error) {
+	ob := outbox.New(jobs, provider)
+	workers, err := strconv.Atoi(getenv("OUTBOX_WORKERS", "4"))
+	if err != nil || workers < 1 {
+		return nil, fmt.Errorf("OUTBOX_WORKERS must be a positive number")
+	}
+	maxAttempts, err := strconv.Atoi(getenv("OUTBOX_MAX_ATTEMPTS", "8"))
+	if err != nil || maxAttempts < 1 {
+		return nil, fmt.Errorf("OUTBOX_MAX_ATTEMPTS must be a positive number")
+	}
+	ob.Workers = workers
+	ob.MaxAttempts = maxAttempts
+	return ob, nil
+}
+
+// newRepositories picks the database from DATABASE_BACKEND ("dynamodb" or
+// "embedded"). Table names can be overridden with USERS_TABLE, FILES_TABLE,
+// TOKENS_TABLE, SHARES_TABLE, FACE_ATTEMPTS_TABLE, OUTBOX_TABLE,
+// MAILBOX_TABLE, UPLOADS_TABLE and VERSIONS_TABLE.
+func newRepositories(b *backends) error {
+	usersTable := getenv("USERS_TABLE", "users")
+	filesTable := getenv("FILES_TABLE", "files")
+	tokensTable := getenv("TOKENS_TABLE", "tokens")
+	sharesTable := getenv("SHARES_TABLE", "shares")
+	attemptsTable := getenv("FACE_ATTEMPTS_TABLE", "face_attempts")
+	outboxTable := getenv("OUTBOX_TABLE", "outbox")
+	mailboxTable := getenv("MAILBOX_TABLE", "mailbox")
+	uploadsTable := getenv("UPLOADS_TABLE", "uploads")
+	versionsTable := getenv("VERSIONS_TABLE", "file_versions")
+
+	switch os.Getenv("DATABASE_BACKEND") {
+	case "embedded":
+		db, err := database.OpenEmbeddedDB(getenv("EMBEDDED_DB_PATH", "data/effective-invention.db"))
+		if err != nil {
+			return err
+		}
+		log.Printf("Using embedded database\n")
+		b.users = database.NewEmbeddedUserRepository(db, usersTable)
+		b.files = database.NewEmbeddedFileRepository(db, filesTable)
+		b.tokens = database.NewEmbeddedTokenRepository(db, tokensTable)
+		b.shares = database.NewEmbeddedShareRepository(db, sharesTable)
+		b.attempts = database.NewEmbeddedFaceAttemptRepository(db, attemptsTable)
+		b.jobs = database.NewEmbeddedOutboxRepository(db, outboxTable)
+		b.mailbox = database.NewEmbeddedMailboxRepository(db, mailboxTable)
+		b.uploads = database.NewEmbeddedUploadRepository(db, uploadsTable)
+		b.versions = database.NewEmbeddedVersionRepository(db, versionsTable)
+	case "", "dynamodb":
+		dynamodb_client := amazonwebservices.ConnectDB(awsConfig())
+		if err := database.CreateFilesTable(dynamodb_client, filesTable); err != nil {
+			return err
+		}
+		if err := database.CreateUsersTable(dynamodb_client, usersTable); err != nil {
+			return err
+		}
+		if err := database.CreateTokensTable(dynamodb_client, tokensTable); err != nil {
+			return err
+		}
+		if err := database.CreateSharesTable(dynamodb_client, sharesTable); err != nil {
+			return err
+		}
+		if err := database.CreateFaceAttemptsTable(dynamodb_client, attemptsTable); err != nil {
+			return err
+		}
+		if err := database.CreateOutboxTable(dynamodb_client, outboxTable); err != nil {
+			return err
+		}
+		if err := database.CreateMailboxTable(dynamodb_client, mailboxTable); err != nil {
+			return err
+		}
+		if err := database.CreateUploadsTable(dynamodb_client, uploadsTable); err != nil {
+			return err
+		}
+		if err := database.CreateVersionsTable(dynamodb_client, versionsTable); err != nil {
+			return err
+		}
+		b.users = database.NewDynamoUserRepository(dynamodb_client, usersTable)
+		b.files = database.NewDynamoFileRepository(dynamodb_client, filesTable)
+		b.tokens = database.NewDynamoTokenRepository(dynamodb_client, tokensTable)
+		b.shares = database.NewDynamoShareRepository(dynamodb_client, sharesTable)
+		b.attempts = database.NewDynamoFaceAttemptRepository(dynamodb_client, attemptsTable)
+		b.jobs = database.NewDynamoOutboxRepository(dynamodb_client, outboxTable)
+		b.mailbox = database.NewDynamoMailboxRepository(dynamodb_client, mailboxTable)
+		b.uploads = database.NewDynamoUploadRepository(dynamodb_client, uploadsTable)
+		b.versions = database.NewDynamoVersionRepository(dynamodb_client, versionsTable)
+	default:
+		return fmt.Errorf("unknown DATABASE_BACKEND %q", os.Getenv("DATABASE_BACKEND"))
+	}
+	return nil
+}
+
+// newVersioner configures file versions. Each time a file gets a new
+// version, those beyond the FILE_VERSIONS_KEEP newest (default 0, keep
+// them all) and those older than FILE_VERSIONS_MAX_AGE (default unset,
+// keep them forever) are pruned.
+func newVersioner(b *backends) (*amazonwebservices.Versioner, error) {
+	vr := &amazonwebservices.Versioner{
+		Files:    b.files,
+		Versions: b.versions,
+		Store:    b.store,
+		Vault:    b.vault,
+		Events:   b.events,
+	}
+	keep, err := strconv.Atoi(getenv("FILE_VERSIONS_KEEP", "0"))
+	if err != nil || keep < 0 {
+		return nil, fmt.Errorf("FILE_VERSIONS_KEEP must be a number, 0 to keep every version")
+	}
+	vr.Policy.KeepLast = keep
+	if v := os.Getenv("FILE_VERSIONS_MAX_AGE"); v != "" {
+		maxAge, err := time.ParseDuration(v)
+		if err != nil || maxAge <= 0 {
+			return nil, fmt.Errorf("FILE_VERSIONS_MAX_AGE must be a positive duration")
+		}
+		vr.Policy.MaxAge = maxAge
+	}
+	return vr, nil
+}
+
+// newTrash configures the trash. Deleted files are kept for TRASH_RETENTION
+// (default 720h, 30 days) before they are purged.
+func newTrash(b *backends) (*amazonwebservices.Trash, error) {
+	retention, err := time.ParseDuration(getenv("TRASH_RETENTION", "720h"))
+	if err != nil || retention <= 0 {
+		return nil, fmt.Errorf("TRASH_RETENTION must be a positive duration")
+	}
+	return &amazonwebservices.Trash{
+		Files:         b.files,
+		Versions:      b.versioner,
+		Events:        b.events,
+		Retention:     retention,
+		PurgeInterval: min(retention/2, time.Hour),
+	}, nil
+}
+
+// newFaceGate configures face shares. FACE_MATCH_THRESHOLD is the minimum
+// similarity (default 90) and FACE_MAX_ATTEMPTS the failed selfies allowed
+// before a share is locked (default 5). Without a matcher, face shares can
+// be created but not opened.
+func newFaceGate(b *backends, matcher amazonwebservices.FaceMatcher) (*amazonwebservices.FaceGate, error) {
+	threshold, err := strconv.ParseFloat(getenv("FACE_MATCH_THRESHOLD", "90"), 32)
+	if err != nil || threshold < 0 || threshold > 100 {
+		return nil, fmt.Errorf("FACE_MATCH_THRESHOLD must be a number between 0 and 100")
+	}
+	maxAttempts, err := strconv.Atoi(getenv("FACE_MAX_ATTEMPTS", "5"))
+	if err != nil || maxAttempts < 1 {
+		return nil, fmt.Errorf("FACE_MAX_ATTEMPTS must be a number, at least 1")
+	}
+	return &amazonwebservices.FaceGate{
+		Files:       b.files,
+		Shares:      b.shares,
+		Attempts:    b.attempts,
+		Tokens:      b.tokens,
+		Store:       b.store,
+		Vault:       b.vault,
+		Matcher:     matcher,
+		Threshold:   float32(threshold),
+		MaxAttempts: maxAttempts,
+		Events:      b.events,
+	}, nil
+}
+
+// newUploader configures uploads. UPLOAD_SIMPLE_MAX_BYTES caps files sent in
+// one request (default 32 MiB) and UPLOAD_MAX_BYTES those sent in parts
+// or straight to storage (default 5 GiB). UPLOAD_PART_BYTES is the part
+// size (default 8 MiB, at least 5 MiB on S3, in whole 64 KiB encryption
+// chunks), UPLOAD_DIRECT_EXPIRY how long
+// a signed direct upload works (default 15m) and UPLOAD_STALE_AFTER how long
+// an upload may go unused before it is aborted (default 24h).
+func newUploader(b *backends) (*amazonwebservices.Uploader, error) {
+	up := &amazonwebservices.Uploader{
+		Files:    b.files,
+		Uploads:  b.uploads,
+		Versions: b.versioner,
+		Store:    b.store,
+		Vault:    b.vault,
+		Events:   b.events,
+	}
+	sizes := []struct {
+		key      string
+		fallback int64
+		dst      *int64
+	}{
+		{"UPLOAD_SIMPLE_MAX_BYTES", 32 << 20, &up.MaxSimpleSize},
+		{"UPLOAD_MAX_BYTES", 5 << 30, &up.MaxSize},
+		{"UPLOAD_PART_BYTES", 8 << 20, &up.PartSize},
+	}
+	for _, size := range sizes {
+		v, err := strconv.ParseInt(getenv(size.key, strconv.FormatInt(size.fallback, 10)), 10, 64)
+		if err != nil || v <= 0 {
+			return nil, fmt.Errorf("%s must be a positive number of bytes", size.key)
+		}
+		*size.dst = v
+	}
+	if b.s3 && up.PartSize < 5<<20 {
+		return nil, fmt.Errorf("UPLOAD_PART_BYTES must be at least 5 MiB on S3")
+	}
+	if up.PartSize%envelope.ChunkSize != 0 {
+		return nil, fmt.Errorf("UPLOAD_PART_BYTES must be a multiple of %d, the encryption chunk size", envelope.ChunkSize)
+	}
+	if parts := (up.MaxSize + up.PartSize - 1) / up.PartSize; parts > storage.MaxParts {
+		return nil, fmt.Errorf("UPLOAD_MAX_BYTES needs %d parts of UPLOAD_PART_BYTES, more than the %d allowed", parts, storage.MaxParts)
+	}
+
+	durations := []struct {
+		key      string
+		fallback string
+		dst      *time.Duration
+	}{
+		{"UPLOAD_DIRECT_EXPIRY", "15m", &up.DirectExpiry},
+		{"UPLOAD_STALE_AFTER", "24h", &up.StaleAfter},
+	}
+	for _, d := range durations {
+		v, err := time.ParseDuration(getenv(d.key, d.fallback))
+		if err != nil || v <= 0 {
+			return nil, fmt.Errorf("%s must be a positive duration", d.key)
+		}
+		*d.dst = v
+	}
+	if up.DirectExpiry >= up.StaleAfter {
+		return nil, fmt.Errorf("UPLOAD_DIRECT_EXPIRY (%s) must be shorter than UPLOAD_STALE_AFTER (%s)", up.DirectExpiry, up.StaleAfter)
+	}
+	up.SweepInterval = min(up.StaleAfter/2, 15*time.Minute)
+	return up, nil
+}
@@ -0,0 +1,61 @@
+package email
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// DirMailer writes each message to its own directory under Dir instead of
+// sending it, for tests and offline development. A message directory holds
+// message.json (headers), body.html, body.txt and the attachments.
+type DirMailer struct {
+	Dir string
+}
+
+func NewDirMailer(dir string) (*DirMailer, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create mail directory: %w", err)
+	}
+	return &DirMailer{Dir: dir}, nil
+}
+
+func (m *DirMailer) Send(ctx context.Context, msg *Message) (string, error) {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	// sortable by time, and unique when two messages share a timestamp
+	id := fmt.Sprintf("%s-%s-%s", time.Now().UTC().Format("20060102T150405.000000000"), msg.Kind, hex.EncodeToString(suffix))
+	dir := filepath.Join(m.Dir, id)
+	if err := os.MkdirAll(filepath.Join(dir, "attachments"), 0o755); err != nil {
+		return "", err
+	}
+
+	header, err := json.MarshalIndent(msg, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	files := map[string][]byte{
+		"message.json": header,
+		"body.html":    []byte(msg.HTML),
+		"body.txt":     []byte(msg.Text),
+	}
+	for _, a := range msg.Attachments {
+		files[filepath.Join("attachments", filepath.Base(a.Filename))] = a.Data
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o644); err != nil {
+			return "", fmt.Errorf("failed to write %s: %w", name, err)
+		}
+	}
+
+	log.Printf("Email %s to %v written to %s", msg.Kind, msg.To, dir)
+	return id, nil
+}
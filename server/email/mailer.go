@@ -0,0 +1,223 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"fmt"
+	htmltemplate "html/template"
+	"os"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// Message kinds. Each has a <kind>.html and <kind>.txt template, and its own
+// sender settings (see SenderFor).
+const (
+	KindShareLink     = "share_link"
+	KindQRCode        = "qr_code"
+	KindVerification  = "verification"
+	KindPasswordReset = "password_reset"
+)
+
+var kinds = []string{KindShareLink, KindQRCode, KindVerification, KindPasswordReset}
+
+const defaultFrom = "effective-invention <onboarding@resend.dev>"
+
+//go:embed templates
+var templateFS embed.FS
+
+type Attachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"contentType"`
+	// ContentID makes the attachment inline, referenced from the HTML body
+	// as cid:<ContentID>.
+	ContentID string `json:"contentId,omitempty"`
+	Data      []byte `json:"-"`
+}
+
+type Message struct {
+	Kind        string       `json:"kind"`
+	From        string       `json:"from"`
+	ReplyTo     string       `json:"replyTo,omitempty"`
+	To          []string     `json:"to"`
+	Subject     string       `json:"subject"`
+	HTML        string       `json:"-"`
+	Text        string       `json:"-"`
+	Attachments []Attachment `json:"attachments,omitempty"`
+	// IdempotencyKey lets a retried send be recognised as the same message.
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
+	// UserID is the user the message is sent on behalf of, if any.
+	UserID string `json:"userId,omitempty"`
+}
+
+// Mailer delivers a rendered message and returns the provider's message ID.
+type Mailer interface {
+	Send(ctx context.Context, msg *Message) (string, error)
+}
+
+// Sender is the From and Reply-To used for one kind of message.
+type Sender struct {
+	From    string
+	ReplyTo string
+}
+
+// SenderFor reads the sender for kind from the environment. EMAIL_FROM and
+// EMAIL_REPLY_TO apply to every kind, and EMAIL_FROM_<KIND> and
+// EMAIL_REPLY_TO_<KIND> (e.g. EMAIL_FROM_PASSWORD_RESET) override them.
+func SenderFor(kind string) Sender {
+	suffix := "_" + strings.ToUpper(kind)
+	sender := Sender{
+		From:    os.Getenv("EMAIL_FROM" + suffix),
+		ReplyTo: os.Getenv("EMAIL_REPLY_TO" + suffix),
+	}
+	if sender.From == "" {
+		sender.From = os.Getenv("EMAIL_FROM")
+	}
+	if sender.From == "" {
+		sender.From = defaultFrom
+	}
+	if sender.ReplyTo == "" {
+		sender.ReplyTo = os.Getenv("EMAIL_REPLY_TO")
+	}
+	return sender
+}
+
+// Data passed to each template.
+type (
+	ShareLinkData struct {
+		SenderName   string
+		URL          string
+		Note         string
+		ExpiresAt    time.Time
+		MaxUses      int
+		FaceRequired bool
+	}
+
+	QRCodeData struct {
+		SenderName string
+		URL        string
+		Note       string
+		ExpiresAt  time.Time
+		// ContentID is set by NewQRCodeMessage.
+		ContentID string
+	}
+
+	VerificationData struct {
+		Name      string
+		Code      string
+		URL       string
+		ExpiresIn time.Duration
+	}
+
+	PasswordResetData struct {
+		Name      string
+		URL       string
+		ExpiresIn time.Duration
+	}
+)
+
+var funcs = map[string]any{
+	"duration": humanDuration,
+}
+
+func humanDuration(d time.Duration) string {
+	plural := func(n int, unit string) string {
+		if n == 1 {
+			return "1 " + unit
+		}
+		return fmt.Sprintf("%d %ss", n, unit)
+	}
+	switch {
+	case d >= 24*time.Hour:
+		return plural(int(d/(24*time.Hour)), "day")
+	case d >= time.Hour:
+		return plural(int(d/time.Hour), "hour")
+	default:
+		return plural(max(int(d/time.Minute), 1), "minute")
+	}
+}
+
+type templates struct {
+	html *htmltemplate.Template
+	text *texttemplate.Template
+}
+
+var parsed = map[string]templates{}
+
+func init() {
+	for _, kind := range kinds {
+		html := htmltemplate.Must(htmltemplate.New("layout.html").Funcs(funcs).
+			ParseFS(templateFS, "templates/layout.html", "templates/"+kind+".html"))
+		text := texttemplate.Must(texttemplate.New(kind+".txt").Funcs(funcs).
+			ParseFS(templateFS, "templates/"+kind+".txt"))
+		parsed[kind] = templates{html: html, text: text}
+	}
+}
+
+// Render builds a message of the given kind from its templates. The sender
+// comes from SenderFor.
+func Render(kind string, to []string, data any) (*Message, error) {
+	tmpl, ok := parsed[kind]
+	if !ok {
+		return nil, fmt.Errorf("unknown message kind %q", kind)
+	}
+
+	var subject, text, html bytes.Buffer
+	if err := tmpl.text.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return nil, fmt.Errorf("failed to render %s subject: %w", kind, err)
+	}
+	if err := tmpl.text.ExecuteTemplate(&text, "body", data); err != nil {
+		return nil, fmt.Errorf("failed to render %s text: %w", kind, err)
+	}
+	if err := tmpl.html.Execute(&html, data); err != nil {
+		return nil, fmt.Errorf("failed to render %s html: %w", kind, err)
+	}
+
+	sender := SenderFor(kind)
+	return &Message{
+		Kind:    kind,
+		From:    sender.From,
+		ReplyTo: sender.ReplyTo,
+		To:      to,
+		Subject: strings.TrimSpace(subject.String()),
+		HTML:    html.String(),
+		Text:    text.String(),
+	}, nil
+}
+
+func NewShareLinkMessage(to []string, data ShareLinkData) (*Message, error) {
+	return Render(KindShareLink, to, data)
+}
+
+// NewQRCodeMessage renders the QR code for data.URL and attaches it inline.
+func NewQRCodeMessage(to []string, data QRCodeData) (*Message, error) {
+	png, err := qrcode.Encode(data.URL, qrcode.Medium, 256)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate QR code: %w", err)
+	}
+	data.ContentID = "qr-code"
+
+	msg, err := Render(KindQRCode, to, data)
+	if err != nil {
+		return nil, err
+	}
+	msg.Attachments = append(msg.Attachments, Attachment{
+		Filename:    "qr-code.png",
+		ContentType: "image/png",
+		ContentID:   data.ContentID,
+		Data:        png,
+	})
+	return msg, nil
+}
+
+func NewVerificationMessage(to []string, data VerificationData) (*Message, error) {
+	return Render(KindVerification, to, data)
+}
+
+func NewPasswordResetMessage(to []string, data PasswordResetData) (*Message, error) {
+	return Render(KindPasswordReset, to, data)
+}
@@ -1,53 +1,125 @@
-package resend
+package email
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"time"
 
 	"github.com/resend/resend-go/v2"
 )
 
+// statusKey carries a *int through the request context so the transport
+// can report the HTTP status, which resend-go does not expose on errors.
+type statusKey struct{}
+
+type statusTransport struct {
+	base http.RoundTripper
+}
+
+func (t statusTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if status, ok := req.Context().Value(statusKey{}).(*int); ok && resp != nil {
+		*status = resp.StatusCode
+	}
+	return resp, err
+}
+
 func InitResendClient() *resend.Client {
 	apiKey := os.Getenv("RESEND_API_KEY")
-	return resend.NewClient(apiKey)
+	httpClient := &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: statusTransport{base: http.DefaultTransport},
+	}
+	return resend.NewCustomClient(httpClient, apiKey)
+}
+
+// ResendMailer is the Mailer that delivers through the Resend API.
+type ResendMailer struct {
+	client *resend.Client
 }
 
-func SendURL(client *resend.Client, toEmail []string, presignedURL string) error {
-	// Implementation for sending email via Resend API
+func NewResendMailer(client *resend.Client) *ResendMailer {
+	return &ResendMailer{client: client}
+}
+
+// SendError is a failed delivery with the provider's HTTP status, when
+// there was a response at all.
+type SendError struct {
+	StatusCode int
+	Err        error
+}
+
+func (e *SendError) Error() string { return e.Err.Error() }
+func (e *SendError) Unwrap() error { return e.Err }
+
+// IsPermanent reports whether retrying err cannot help: the provider
+// rejected the message itself, as opposed to timing out, rate limiting or
+// failing on its side.
+func IsPermanent(err error) bool {
+	var sendErr *SendError
+	if !errors.As(err, &sendErr) {
+		return false
+	}
+	switch code := sendErr.StatusCode; {
+	case code == http.StatusRequestTimeout, code == http.StatusConflict, code == http.StatusTooManyRequests:
+		return false
+	default:
+		return code >= 400 && code < 500
+	}
+}
+
+func (m *ResendMailer) Send(ctx context.Context, msg *Message) (string, error) {
 	params := &resend.SendEmailRequest{
-		From:    "Acme <onboarding@peterjohnbishop.com>",
-		To:      toEmail,
-		Html:    "<strong>hello world</strong>",
-		Subject: "Hello from Golang",
-		Cc:      []string{""},
-		Bcc:     []string{""},
-		ReplyTo: "replyto@example.com",
+		From:    msg.From,
+		To:      msg.To,
+		Subject: msg.Subject,
+		Html:    msg.HTML,
+		Text:    msg.Text,
+		ReplyTo: msg.ReplyTo,
+		Tags:    []resend.Tag{{Name: "kind", Value: msg.Kind}},
+	}
+	for _, a := range msg.Attachments {
+		params.Attachments = append(params.Attachments, &resend.Attachment{
+			Content:     a.Data,
+			Filename:    a.Filename,
+			ContentType: a.ContentType,
+			ContentId:   a.ContentID,
+		})
 	}
 
-	sent, err := client.Emails.Send(params)
+	var status int
+	ctx = context.WithValue(ctx, statusKey{}, &status)
+	sent, err := m.client.Emails.SendWithOptions(ctx, params, &resend.SendEmailOptions{
+		IdempotencyKey: msg.IdempotencyKey,
+	})
 	if err != nil {
-		return err
+		return "", &SendError{
+			StatusCode: status,
+			Err:        fmt.Errorf("failed to send %s email: %w", msg.Kind, err),
+		}
 	}
 	log.Printf("Email sent with ID: %s", sent.Id)
-	return nil
+	return sent.Id, nil
 }
 
-func SendQR(client *resend.Client, toEmail, qrCodeData string) error {
-	// Implementation for sending QR code via Resend API
-	params := &resend.SendEmailRequest{
-		From:    "Acme <onboarding@resend.dev>",
-		To:      []string{"delivered@resend.dev"},
-		Html:    "<strong>hello world</strong>",
-		Subject: "Hello from Golang",
-		Cc:      []string{"cc@example.com"},
-		Bcc:     []string{"bcc@example.com"},
-		ReplyTo: "replyto@example.com",
+// SendURL emails a share link to the recipients.
+func SendURL(ctx context.Context, mailer Mailer, toEmail []string, data ShareLinkData) (string, error) {
+	msg, err := NewShareLinkMessage(toEmail, data)
+	if err != nil {
+		return "", err
 	}
+	return mailer.Send(ctx, msg)
+}
 
-	sent, err := client.Emails.Send(params)
+// SendQR emails a QR code for data.URL, embedded in the message body.
+func SendQR(ctx context.Context, mailer Mailer, toEmail []string, data QRCodeData) (string, error) {
+	msg, err := NewQRCodeMessage(toEmail, data)
 	if err != nil {
-		return err
+		return "", err
 	}
-	log.Printf("Email sent with ID: %s", sent.Id)
-	return nil
+	return mailer.Send(ctx, msg)
 }
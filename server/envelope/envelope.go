@@ -0,0 +1,36 @@
+// Package envelope encrypts file content with envelope encryption: every
+// file is encrypted with a random data key of its own, and only the data
+// key, wrapped by a master key, is kept next to the file's record. Master
+// keys are rotated by re-wrapping data keys, without touching the content.
+package envelope
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+)
+
+// DataKeySize is the size of a data key, for AES-256.
+const DataKeySize = 32
+
+var ErrUnknownKey = errors.New("unknown master key")
+
+// KeyProvider wraps and unwraps data keys with master keys it holds.
+// WrapKey always uses the current master key, KeyID; UnwrapKey also
+// accepts keys wrapped by master keys that have since been rotated out, as
+// long as the provider still has them, and fails with ErrUnknownKey when
+// it does not.
+type KeyProvider interface {
+	KeyID() string
+	WrapKey(ctx context.Context, dataKey []byte) (wrapped []byte, keyID string, err error)
+	UnwrapKey(ctx context.Context, wrapped []byte, keyID string) ([]byte, error)
+}
+
+// NewDataKey returns a random data key.
+func NewDataKey() ([]byte, error) {
+	key := make([]byte, DataKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
@@ -0,0 +1,112 @@
+package envelope
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// Keyring is the KeyProvider for master keys held in memory, usually read
+// from configuration. Data keys are wrapped with AES-256-GCM under the
+// active key, with the key ID as additional data.
+type Keyring struct {
+	keys   map[string]cipher.AEAD
+	active string
+}
+
+// NewKeyring returns a keyring of 32 byte master keys by ID that wraps
+// with the active one.
+func NewKeyring(keys map[string][]byte, active string) (*Keyring, error) {
+	k := &Keyring{keys: make(map[string]cipher.AEAD, len(keys)), active: active}
+	for id, key := range keys {
+		if id == "" || strings.ContainsAny(id, ":,") {
+			return nil, fmt.Errorf("invalid master key ID %q", id)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("master key %s must be 32 bytes, not %d", id, len(key))
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		k.keys[id] = aead
+	}
+	if _, ok := k.keys[active]; !ok {
+		return nil, fmt.Errorf("active master key %q is not in the keyring", active)
+	}
+	return k, nil
+}
+
+// ParseKeyring reads a keyring from a comma separated list of ID:key
+// pairs, with the keys base64 encoded, e.g. "2024:q83v...,2025:Zm9v...".
+// When active is empty the list must hold a single key, which is used.
+func ParseKeyring(spec, active string) (*Keyring, error) {
+	keys := make(map[string][]byte)
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		id, encoded, ok := strings.Cut(pair, ":")
+		if !ok {
+			return nil, fmt.Errorf("master key %q must be written as ID:key", pair)
+		}
+		if _, dup := keys[id]; dup {
+			return nil, fmt.Errorf("master key %s is listed twice", id)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("master key %s is not valid base64: %w", id, err)
+		}
+		keys[id] = key
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no master keys given")
+	}
+	if active == "" {
+		if len(keys) > 1 {
+			return nil, fmt.Errorf("the active master key must be named when there are several")
+		}
+		for id := range keys {
+			active = id
+		}
+	}
+	return NewKeyring(keys, active)
+}
+
+func (k *Keyring) KeyID() string {
+	return k.active
+}
+
+func (k *Keyring) WrapKey(ctx context.Context, dataKey []byte) ([]byte, string, error) {
+	aead := k.keys[k.active]
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(dataKey)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, "", err
+	}
+	return aead.Seal(nonce, nonce, dataKey, []byte(k.active)), k.active, nil
+}
+
+func (k *Keyring) UnwrapKey(ctx context.Context, wrapped []byte, keyID string) ([]byte, error) {
+	aead, ok := k.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownKey, keyID)
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, fmt.Errorf("wrapped key is too short")
+	}
+	nonce, sealed := wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():]
+	dataKey, err := aead.Open(nil, nonce, sealed, []byte(keyID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key with master key %s: %w", keyID, err)
+	}
+	return dataKey, nil
+}
@@ -0,0 +1,236 @@
+package envelope
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Algorithm names the content encryption done here, for records to say how
+// their content was encrypted.
+//
+// Content is split into chunks of ChunkSize bytes, each sealed on its own
+// with AES-256-GCM under the data key, so it can be encrypted and
+// decrypted as a stream. A chunk's nonce is its index, with a flag set on
+// the last chunk, so chunks that are reordered, dropped or cut off at the
+// end fail to open. Empty content is a single empty chunk.
+const Algorithm = "AES-256-GCM-CHUNKED-64K"
+
+const (
+	// ChunkSize is the plaintext size of every chunk but the last.
+	ChunkSize = 64 << 10
+	// Overhead is what sealing adds to each chunk.
+	Overhead = 16
+
+	sealedChunkSize = ChunkSize + Overhead
+	nonceSize       = 12
+)
+
+var ErrCorrupt = errors.New("encrypted content is corrupt or truncated")
+
+// EncryptedSize is the size content of n bytes has once encrypted.
+func EncryptedSize(n int64) int64 {
+	chunks := max((n+ChunkSize-1)/ChunkSize, 1)
+	return n + chunks*Overhead
+}
+
+// DecryptedSize is the size of the content encrypted into n bytes.
+func DecryptedSize(n int64) int64 {
+	chunks := (n + sealedChunkSize - 1) / sealedChunkSize
+	return n - chunks*Overhead
+}
+
+func newAEAD(dataKey []byte) (cipher.AEAD, error) {
+	if len(dataKey) != DataKeySize {
+		return nil, fmt.Errorf("data key must be %d bytes, not %d", DataKeySize, len(dataKey))
+	}
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce writes the nonce of chunk index into nonce: the index in bytes
+// 3 to 10 and the last chunk flag in byte 11.
+func chunkNonce(nonce *[nonceSize]byte, index uint64, last bool) {
+	binary.BigEndian.PutUint64(nonce[3:11], index)
+	nonce[11] = 0
+	if last {
+		nonce[11] = 1
+	}
+}
+
+// endReader tells the end of its reader apart from a failure: it notes
+// when the reader returns io.EOF, so that a read of the source failing with
+// io.ErrUnexpectedEOF of its own is not taken for a short last chunk.
+type endReader struct {
+	r   io.Reader
+	eof bool
+}
+
+func (e *endReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err == io.EOF {
+		e.eof = true
+	}
+	return n, err
+}
+
+// readChunk reads the next size bytes from src into buf, which holds what
+// was read ahead of the previous chunk. It reads one byte past the chunk
+// to learn whether this chunk is the last, and returns the chunk. Only the
+// end of src ends the chunks; any other error is returned.
+func readChunk(src *endReader, buf *[]byte, size int) (chunk []byte, last bool, err error) {
+	have := len(*buf)
+	*buf = (*buf)[:size+1]
+	n, err := io.ReadFull(src, (*buf)[have:])
+	*buf = (*buf)[:have+n]
+	if src.eof && (err == io.EOF || err == io.ErrUnexpectedEOF) {
+		return *buf, true, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return (*buf)[:size], false, nil
+}
+
+// carry keeps the byte read past a chunk for the next one.
+func carry(buf *[]byte, size int) {
+	(*buf)[0] = (*buf)[size]
+	*buf = (*buf)[:1]
+}
+
+type encrypter struct {
+	aead  cipher.AEAD
+	src   *endReader
+	index uint64
+	last  bool // the content ends the stream
+	nonce [nonceSize]byte
+	buf   []byte
+	out   []byte // sealed chunk not read yet
+	err   error
+}
+
+// NewEncrypter encrypts src with dataKey.
+func NewEncrypter(src io.Reader, dataKey []byte) (io.Reader, error) {
+	return NewPartEncrypter(src, dataKey, 0, true)
+}
+
+// NewPartEncrypter encrypts one part of content that is encrypted in
+// pieces, such as a part of a multipart upload, starting at chunk
+// firstChunk of the whole. Every part but the last must be a whole number
+// of chunks. Encrypted parts joined in order are what NewEncrypter makes of
+// the whole content.
+func NewPartEncrypter(src io.Reader, dataKey []byte, firstChunk uint64, last bool) (io.Reader, error) {
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &encrypter{
+		aead:  aead,
+		src:   &endReader{r: src},
+		index: firstChunk,
+		last:  last,
+		buf:   make([]byte, 0, ChunkSize+1),
+		out:   make([]byte, 0, sealedChunkSize),
+	}, nil
+}
+
+func (e *encrypter) Read(p []byte) (int, error) {
+	for len(e.out) == 0 {
+		if e.err != nil {
+			return 0, e.err
+		}
+		e.err = e.seal()
+	}
+	n := copy(p, e.out)
+	e.out = e.out[n:]
+	return n, nil
+}
+
+// seal seals the next chunk into out. It returns io.EOF with the last one.
+func (e *encrypter) seal() error {
+	chunk, last, err := readChunk(e.src, &e.buf, ChunkSize)
+	if err != nil {
+		return err
+	}
+	if last && !e.last {
+		if len(chunk) == 0 {
+			return io.EOF
+		}
+		if len(chunk) != ChunkSize {
+			return fmt.Errorf("a part that does not end the content must be a whole number of %d byte chunks", ChunkSize)
+		}
+	}
+
+	chunkNonce(&e.nonce, e.index, last && e.last)
+	e.out = e.aead.Seal(e.out[:0], e.nonce[:], chunk, nil)
+	e.index++
+	if last {
+		return io.EOF
+	}
+	carry(&e.buf, ChunkSize)
+	return nil
+}
+
+type decrypter struct {
+	aead  cipher.AEAD
+	src   *endReader
+	index uint64
+	nonce [nonceSize]byte
+	buf   []byte
+	out   []byte // opened chunk not read yet
+	err   error
+}
+
+// NewDecrypter decrypts src, which NewEncrypter encrypted with dataKey.
+// Reads fail with ErrCorrupt when the content has been tampered with or
+// cut short.
+func NewDecrypter(src io.Reader, dataKey []byte) (io.Reader, error) {
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &decrypter{
+		aead: aead,
+		src:  &endReader{r: src},
+		buf:  make([]byte, 0, sealedChunkSize+1),
+		out:  make([]byte, 0, ChunkSize),
+	}, nil
+}
+
+func (d *decrypter) Read(p []byte) (int, error) {
+	for len(d.out) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		d.err = d.open()
+	}
+	n := copy(p, d.out)
+	d.out = d.out[n:]
+	return n, nil
+}
+
+// open opens the next chunk into out. It returns io.EOF with the last one.
+func (d *decrypter) open() error {
+	chunk, last, err := readChunk(d.src, &d.buf, sealedChunkSize)
+	if err != nil {
+		return err
+	}
+
+	chunkNonce(&d.nonce, d.index, last)
+	d.out, err = d.aead.Open(d.out[:0], d.nonce[:], chunk, nil)
+	if err != nil {
+		return ErrCorrupt
+	}
+	d.index++
+	if last {
+		return io.EOF
+	}
+	carry(&d.buf, sealedChunkSize)
+	return nil
+}
@@ -0,0 +1,120 @@
+// Package events is an in-process bus for domain events. Handlers publish
+// what happened and subscribers, such as the websocket hub, decide who
+// hears about it.
+package events
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Event types.
+const (
+	FileUploaded   = "file.uploaded"
+	FileDeleted    = "file.deleted"
+	FileRestored   = "file.restored" // an old version made current again
+	FileTrashed    = "file.trashed"
+	FileUntrashed  = "file.untrashed"
+	ShareOpened    = "share.opened"
+	FaceVerified   = "face.verified"
+	FaceRejected   = "face.rejected"
+	EmailDelivered = "email.delivered"
+)
+
+// Event is something that happened to a user's data. UserID is the user it
+// concerns, usually the owner, and Data is one of the payload types below.
+type Event struct {
+	Type   string    `json:"type"`
+	UserID string    `json:"userId"`
+	Data   any       `json:"data,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// Payloads.
+type (
+	FileData struct {
+		FileID  string `json:"fileId"`
+		FileKey string `json:"fileKey"`
+		Version int    `json:"version,omitempty"`
+	}
+
+	ShareData struct {
+		Token    string `json:"token"`
+		FileID   string `json:"fileId"`
+		UseCount int    `json:"useCount"`
+		ClientIP string `json:"clientIp"`
+	}
+
+	FaceData struct {
+		Token      string  `json:"token"`
+		FileID     string  `json:"fileId"`
+		Similarity float32 `json:"similarity"`
+		Threshold  float32 `json:"threshold"`
+		ClientIP   string  `json:"clientIp"`
+	}
+
+	EmailData struct {
+		JobID      string   `json:"jobId"`
+		Kind       string   `json:"kind"`
+		To         []string `json:"to"`
+		ProviderID string   `json:"providerId"`
+	}
+)
+
+// Handler receives published events. It runs on the publisher's goroutine,
+// so it must not block.
+type Handler func(Event)
+
+type Bus struct {
+	mu     sync.RWMutex
+	nextID int
+	subs   map[int]Handler
+}
+
+func NewBus() *Bus {
+	return &Bus{subs: make(map[int]Handler)}
+}
+
+// Subscribe registers h for every event and returns a function that removes
+// it again.
+func (b *Bus) Subscribe(h Handler) func() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	id := b.nextID
+	b.nextID++
+	b.subs[id] = h
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.subs, id)
+	}
+}
+
+// Publish delivers an event of type typ about userId to every subscriber.
+// A nil Bus drops events, so publishers need not check for one.
+func (b *Bus) Publish(typ, userId string, data any) {
+	if b == nil {
+		return
+	}
+	e := Event{Type: typ, UserID: userId, Data: data, Time: time.Now().UTC()}
+
+	b.mu.RLock()
+	handlers := make([]Handler, 0, len(b.subs))
+	for _, h := range b.subs {
+		handlers = append(handlers, h)
+	}
+	b.mu.RUnlock()
+
+	for _, h := range handlers {
+		func() {
+			// one broken subscriber must not fail the request that published
+			defer func() {
+				if r := recover(); r != nil {
+					log.Printf("Event subscriber panicked on %s: %v", e.Type, r)
+				}
+			}()
+			h(e)
+		}()
+	}
+}
@@ -0,0 +1,262 @@
+package outbox
+
+import (
+	"context"
+	"effective-invention/server/amazonwebservices/database"
+	"effective-invention/server/email"
+	"effective-invention/server/events"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid"
+)
+
+// Outbox queues email in a repository and delivers it from a pool of
+// background workers. It implements email.Mailer, so handlers hand it
+// messages exactly as they would a real mailer and never wait on the
+// provider.
+type Outbox struct {
+	jobs   database.OutboxRepository
+	mailer email.Mailer
+	wake   chan struct{}
+
+	// Events hears about each delivered email sent for a user
+	Events *events.Bus
+
+	Workers      int
+	MaxAttempts  int           // attempts before a job is dead-lettered
+	PollInterval time.Duration // how often to look for due jobs when idle
+	BaseDelay    time.Duration // retry delay after the first failure, doubled each time
+	MaxDelay     time.Duration
+	Lease        time.Duration // how long a worker may hold a job before it is retried
+}
+
+func New(jobs database.OutboxRepository, mailer email.Mailer) *Outbox {
+	return &Outbox{
+		jobs:         jobs,
+		mailer:       mailer,
+		wake:         make(chan struct{}, 1),
+		Workers:      4,
+		MaxAttempts:  8,
+		PollInterval: 5 * time.Second,
+		BaseDelay:    30 * time.Second,
+		MaxDelay:     time.Hour,
+		Lease:        2 * time.Minute,
+	}
+}
+
+// payload is the stored form of an email.Message, including the bodies and
+// attachment data that the message's own JSON leaves out.
+type payload struct {
+	Kind        string       `json:"kind"`
+	UserID      string       `json:"userId,omitempty"`
+	From        string       `json:"from"`
+	ReplyTo     string       `json:"replyTo,omitempty"`
+	To          []string     `json:"to"`
+	Subject     string       `json:"subject"`
+	HTML        string       `json:"html"`
+	Text        string       `json:"text"`
+	Attachments []attachment `json:"attachments,omitempty"`
+}
+
+type attachment struct {
+	email.Attachment
+	Data []byte `json:"data"`
+}
+
+func encodeMessage(msg *email.Message) ([]byte, error) {
+	p := payload{
+		Kind:    msg.Kind,
+		UserID:  msg.UserID,
+		From:    msg.From,
+		ReplyTo: msg.ReplyTo,
+		To:      msg.To,
+		Subject: msg.Subject,
+		HTML:    msg.HTML,
+		Text:    msg.Text,
+	}
+	for _, a := range msg.Attachments {
+		p.Attachments = append(p.Attachments, attachment{Attachment: a, Data: a.Data})
+	}
+	return json.Marshal(p)
+}
+
+func decodeMessage(data []byte) (*email.Message, error) {
+	var p payload
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, err
+	}
+	msg := &email.Message{
+		Kind:    p.Kind,
+		UserID:  p.UserID,
+		From:    p.From,
+		ReplyTo: p.ReplyTo,
+		To:      p.To,
+		Subject: p.Subject,
+		HTML:    p.HTML,
+		Text:    p.Text,
+	}
+	for _, a := range p.Attachments {
+		a.Attachment.Data = a.Data
+		msg.Attachments = append(msg.Attachments, a.Attachment)
+	}
+	return msg, nil
+}
+
+// Send enqueues msg and returns the outbox job ID.
+func (o *Outbox) Send(ctx context.Context, msg *email.Message) (string, error) {
+	data, err := encodeMessage(msg)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode %s email: %w", msg.Kind, err)
+	}
+	id, err := uuid.NewV4()
+	if err != nil {
+		return "", err
+	}
+
+	job := database.OutboxJob{
+		ID:      fmt.Sprintf("OUTBOX_%s", id),
+		Kind:    msg.Kind,
+		UserID:  msg.UserID,
+		To:      msg.To,
+		Subject: msg.Subject,
+		Payload: data,
+	}
+	if err := o.jobs.EnqueueJob(ctx, job); err != nil {
+		return "", err
+	}
+
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+	return job.ID, nil
+}
+
+// Run delivers jobs until ctx is cancelled, then waits for the deliveries in
+// flight to finish.
+func (o *Outbox) Run(ctx context.Context) {
+	queue := make(chan database.OutboxJob)
+	var wg sync.WaitGroup
+	for range o.Workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range queue {
+				o.deliver(job)
+			}
+		}()
+	}
+
+	ticker := time.NewTicker(o.PollInterval)
+	defer ticker.Stop()
+
+	log.Printf("Outbox running with %d workers\n", o.Workers)
+	for {
+		o.dispatch(ctx, queue)
+
+		select {
+		case <-ctx.Done():
+			close(queue)
+			wg.Wait()
+			return
+		case <-ticker.C:
+		case <-o.wake:
+		}
+	}
+}
+
+// dispatch hands due jobs to the workers, claiming no more than there are
+// workers to take them so leases do not run out while jobs sit in line.
+func (o *Outbox) dispatch(ctx context.Context, queue chan<- database.OutboxJob) {
+	for ctx.Err() == nil {
+		jobs, err := o.jobs.ClaimJobs(ctx, o.Workers, o.Lease)
+		if err != nil {
+			log.Printf("Error claiming outbox jobs: %v", err)
+		}
+		for _, job := range jobs {
+			queue <- job
+		}
+		if err != nil || len(jobs) < o.Workers {
+			return
+		}
+	}
+}
+
+// deliver sends one claimed job. It does not take the Run context, so a
+// shutdown does not abandon a send half way.
+func (o *Outbox) deliver(job database.OutboxJob) {
+	ctx, cancel := context.WithTimeout(context.Background(), o.Lease)
+	defer cancel()
+
+	msg, err := decodeMessage(job.Payload)
+	if err != nil {
+		o.fail(ctx, job, fmt.Errorf("corrupt payload: %w", err), true)
+		return
+	}
+	// the provider drops duplicates, so a retry after a lost response does
+	// not send the email twice
+	msg.IdempotencyKey = job.ID
+
+	providerID, err := o.mailer.Send(ctx, msg)
+	if err != nil {
+		o.fail(ctx, job, err, email.IsPermanent(err))
+		return
+	}
+	if err := o.jobs.CompleteJob(ctx, job.ID, providerID); err != nil {
+		log.Printf("Error completing outbox job %s: %v", job.ID, err)
+	}
+	if job.UserID != "" {
+		o.Events.Publish(events.EmailDelivered, job.UserID, events.EmailData{
+			JobID:      job.ID,
+			Kind:       job.Kind,
+			To:         job.To,
+			ProviderID: providerID,
+		})
+	}
+}
+
+func (o *Outbox) fail(ctx context.Context, job database.OutboxJob, cause error, permanent bool) {
+	dead := permanent || job.Attempts >= o.MaxAttempts
+	retryAt := time.Now().Add(o.backoff(job.Attempts)).Unix()
+	if dead {
+		log.Printf("Outbox job %s (%s) is dead after %d attempts: %v", job.ID, job.Kind, job.Attempts, cause)
+	} else {
+		log.Printf("Outbox job %s (%s) failed, retrying at %s: %v", job.ID, job.Kind, time.Unix(retryAt, 0).Format(time.RFC3339), cause)
+	}
+	if err := o.jobs.FailJob(ctx, job.ID, cause.Error(), retryAt, dead); err != nil {
+		log.Printf("Error updating outbox job %s: %v", job.ID, err)
+	}
+}
+
+// backoff doubles BaseDelay for every attempt made so far, up to MaxDelay,
+// with up to 20% jitter so failed jobs do not retry in lockstep.
+func (o *Outbox) backoff(attempts int) time.Duration {
+	delay := o.BaseDelay
+	for i := 1; i < attempts && delay < o.MaxDelay; i++ {
+		delay *= 2
+	}
+	delay = min(delay, o.MaxDelay)
+	return delay + time.Duration(rand.Int64N(int64(delay)/5+1))
+}
+
+// Jobs is the repository behind the outbox, for inspecting jobs.
+func (o *Outbox) Jobs() database.OutboxRepository {
+	return o.jobs
+}
+
+// Replay moves a dead job back to the queue and wakes the workers.
+func (o *Outbox) Replay(ctx context.Context, id string) (*database.OutboxJob, error) {
+	job, err := o.jobs.ReplayJob(ctx, id)
+	if err == nil && job != nil {
+		select {
+		case o.wake <- struct{}{}:
+		default:
+		}
+	}
+	return job, err
+}
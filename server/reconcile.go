@@ -0,0 +1,90 @@
+package server
+
+import (
+	"context"
+	"effective-invention/server/amazonwebservices"
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Reconcile is the reconcile command. It checks the object store against
+// the file and version records and writes a JSON report of the objects no
+// record refers to, the records whose object is missing and the objects
+// that do not match their record, to standard output or -o. With -fix it
+// also repairs or quarantines what it finds; see amazonwebservices.Fix.
+// It is safe to run against DynamoDB while the server is live, but the
+// embedded database is only safe to fix with the server stopped.
+func Reconcile(args []string) {
+	flags := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	prefix := flags.String("prefix", "", "only check objects whose keys start with this")
+	fix := flags.String("fix", "", `"repair" or "quarantine" what is found, instead of only reporting it`)
+	checksums := flags.Bool("checksums", false, "read every object to check its checksum, not only its size")
+	grace := flags.Duration("grace", time.Hour, "leave objects younger than this alone, as their records may not be written yet")
+	out := flags.String("o", "", "write the report to this file instead of standard output")
+	flags.Parse(args)
+
+	r := &amazonwebservices.Reconciler{
+		Prefix:    *prefix,
+		Grace:     *grace,
+		Checksums: *checksums,
+		Fix:       amazonwebservices.Fix(*fix),
+	}
+	switch r.Fix {
+	case amazonwebservices.FixNone, amazonwebservices.FixRepair, amazonwebservices.FixQuarantine:
+	default:
+		log.Fatalf("Unknown -fix %q, it must be repair or quarantine", *fix)
+	}
+	if r.Grace < 0 {
+		log.Fatalf("-grace must not be negative")
+	}
+
+	keys, err := newKeyProvider()
+	if err != nil {
+		log.Fatalf("Error reading master keys: %v", err)
+	}
+	b := &backends{}
+	if err := newRepositories(b); err != nil {
+		log.Fatalf("Error configuring database: %v", err)
+	}
+	store, err := newObjectStore(nil, nil)
+	if err != nil {
+		log.Fatalf("Error configuring storage: %v", err)
+	}
+	r.Files = b.files
+	r.Versions = b.versions
+	r.Uploads = b.uploads
+	r.Store = store
+	r.Vault = &amazonwebservices.Vault{Keys: keys}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	report, err := r.Run(ctx)
+	if err != nil {
+		log.Fatalf("Error reconciling: %v", err)
+	}
+
+	w := os.Stdout
+	if *out != "" {
+		if w, err = os.Create(*out); err != nil {
+			log.Fatalf("Error writing report: %v", err)
+		}
+		defer w.Close()
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		log.Fatalf("Error writing report: %v", err)
+	}
+
+	log.Printf("Checked %d objects against %d files and %d versions: %d orphaned objects, %d content problems, %d errors",
+		report.Objects, report.Files, report.Versions, len(report.OrphanObjects), len(report.Problems), len(report.Errors))
+	if len(report.Errors) > 0 {
+		os.Exit(1)
+	}
+}
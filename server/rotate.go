@@ -0,0 +1,89 @@
+package server
+
+import (
+	"context"
+	"effective-invention/server/amazonwebservices"
+	"effective-invention/server/amazonwebservices/database"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+)
+
+// RotateKeys is the rotate-keys command. It wraps the data key of every file
+// and file version again under the active master key (VAULT_ACTIVE_KEY), leaving the
+// encrypted content as it is. Uploads in flight finish under the key they
+// started with, and files that get new content while it runs are skipped,
+// so run it again once UPLOAD_STALE_AFTER has passed; when it finds nothing
+// left to rotate, the old key can be removed from VAULT_KEYS. DynamoDB can
+// be rotated with the server running, but the server holds the embedded
+// database in memory and rewrites it whole, so stop the server first.
+func RotateKeys() {
+	ctx := context.Background()
+
+	keys, err := newKeyProvider()
+	if err != nil {
+		log.Fatalf("Error reading master keys: %v", err)
+	}
+	b := &backends{}
+	if err := newRepositories(b); err != nil {
+		log.Fatalf("Error configuring database: %v", err)
+	}
+	vault := &amazonwebservices.Vault{Keys: keys}
+
+	files, err := b.files.ListFiles(ctx)
+	if err != nil {
+		log.Fatalf("Error listing files: %v", err)
+	}
+
+	var rotated, current, plaintext, changed, failed int
+	rotate := func(name string, old *database.FileEncryption, update func(database.FileEncryption) error) {
+		switch {
+		case old == nil:
+			plaintext++
+			return
+		case old.KeyID == keys.KeyID():
+			current++
+			return
+		}
+
+		enc, err := vault.Rewrap(ctx, *old)
+		if err == nil {
+			err = update(enc)
+		}
+		if errors.Is(err, database.ErrFileChanged) {
+			changed++
+			return
+		}
+		if err != nil {
+			log.Printf("Error rotating the data key of %s (master key %s): %v", name, old.KeyID, err)
+			failed++
+			return
+		}
+		rotated++
+	}
+
+	for _, file := range files {
+		rotate(file.ID, file.Encryption, func(enc database.FileEncryption) error {
+			return b.files.UpdateEncryption(ctx, file.ID, file.FileKey, enc)
+		})
+
+		versions, err := b.versions.ListVersions(ctx, file.ID)
+		if err != nil {
+			log.Printf("Error listing versions of %s: %v", file.ID, err)
+			failed++
+			continue
+		}
+		for _, v := range versions {
+			rotate(fmt.Sprintf("version %d of %s", v.Number, file.ID), v.Encryption, func(enc database.FileEncryption) error {
+				return b.versions.UpdateVersionEncryption(ctx, v.FileID, v.Number, enc)
+			})
+		}
+	}
+
+	log.Printf("Rotated %d data keys to master key %s, %d already used it, %d files and versions are not encrypted, %d files changed while rotating, %d failed",
+		rotated, keys.KeyID(), current, plaintext, changed, failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
@@ -2,34 +2,92 @@ package server
 
 import (
 	"effective-invention/server/amazonwebservices"
+	"effective-invention/server/amazonwebservices/auth"
+	"effective-invention/server/websocket"
 
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/rekognition"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/gin-gonic/gin"
 )
 
-func addS3Routes(s3client *s3.Client, dynamodbClient *dynamodb.Client, r *gin.Engine) {
-	r.POST("/upload", amazonwebservices.HandleFileUpload(s3client))
-	r.GET("/download/link/:filename", amazonwebservices.HandleFileDOwnloadLink(s3client))
-	r.GET("/download/:filename", amazonwebservices.HandleFileDownloadStream(s3client))
-	r.POST("/user/upload", amazonwebservices.HandleUploadUserFile(dynamodbClient, s3client))
-	r.GET("/download/qrlink/:filename", amazonwebservices.HandleFileDOwnloadLinkQR(s3client))
+func addStorageRoutes(b *backends, up *amazonwebservices.Uploader, r *gin.RouterGroup) {
+	r.POST("/upload", amazonwebservices.HandleUploadUserFile(b.versioner, up.MaxSimpleSize))
+	r.GET("/download/link/:id", amazonwebservices.HandleFileDOwnloadLink(b.files, b.shares, b.store, b.vault))
+	r.GET("/download/:id", amazonwebservices.HandleFileDownloadStream(b.files, b.shares, b.store, b.vault))
+	r.POST("/user/upload", amazonwebservices.HandleUploadUserFile(b.versioner, up.MaxSimpleSize))
+	r.GET("/download/qrlink/:id", amazonwebservices.HandleFileDOwnloadLinkQR(b.files, b.shares, b.store, b.vault))
+	r.GET("/files/:id/content", b.vault.HandleSignedDownload(b.files, b.store))
 }
 
-func addDynamoDbRoutes(s3client *s3.Client, dynamodbClient *dynamodb.Client, r *gin.Engine) {
-	r.POST("/users/new", amazonwebservices.HandleUserCreation(dynamodbClient))
-	r.POST("/users/login", amazonwebservices.HandleAuthentication(dynamodbClient))
-	r.GET("/users/all", amazonwebservices.HandleGetAllUsers(dynamodbClient))
-	r.GET("/users/id/:id", amazonwebservices.HandleGetUserById(dynamodbClient))
-	r.PUT("/users/update", amazonwebservices.HandleUpdateUser(dynamodbClient))
-	r.PUT("/users/update/password", amazonwebservices.HandleUpdateUserPassword(dynamodbClient))
-	r.DELETE("/users/id/:id", amazonwebservices.HandleDeleteUserById(dynamodbClient))
+func addVersionRoutes(b *backends, up *amazonwebservices.Uploader, r *gin.RouterGroup) {
+	vr := b.versioner
+	r.GET("/files/:id/versions", vr.HandleList())
+	r.POST("/files/:id/versions", vr.HandleUpload(up.MaxSimpleSize))
+	r.POST("/files/:id/versions/prune", vr.HandlePrune())
+	r.GET("/files/:id/versions/:number", vr.HandleDownload())
+	r.POST("/files/:id/versions/:number/restore", vr.HandleRestore())
+}
+
+func addTrashRoutes(trash *amazonwebservices.Trash, r *gin.RouterGroup) {
+	r.GET("/users/trash", trash.HandleList())
+	r.POST("/users/trash/:id/restore", trash.HandleRestore())
+	r.DELETE("/users/trash/:id", trash.HandleDelete())
+}
+
+func addUploadRoutes(up *amazonwebservices.Uploader, r *gin.RouterGroup) {
+	r.POST("/uploads", up.HandleCreate())
+	r.POST("/uploads/direct", up.HandleDirect())
+	r.POST("/uploads/:id/finalize", up.HandleFinalize())
+	r.PUT("/uploads/:id/parts/:number", up.HandlePart())
+	r.GET("/uploads/:id/parts", up.HandleParts())
+	r.POST("/uploads/:id/complete", up.HandleComplete())
+	r.DELETE("/uploads/:id", up.HandleAbort())
+}
+
+func addShareRoutes(b *backends, gate *amazonwebservices.FaceGate, r *gin.RouterGroup) {
+	r.POST("/shares", amazonwebservices.HandleCreateShare(b.files, b.shares, b.mailer, publicURL()))
+	r.GET("/shares", amazonwebservices.HandleGetShares(b.shares))
+	r.DELETE("/shares/:token", amazonwebservices.HandleRevokeShare(b.shares))
+	r.GET("/shares/:token/attempts", gate.HandleAttempts())
+	r.GET("/s/:token", amazonwebservices.HandleOpenShare(b.files, b.shares, b.store, b.vault, b.events))
+	r.POST("/s/:token/verify", gate.HandleVerify())
+	r.GET("/releases/:id", gate.HandleRelease())
+}
+
+func addPresenceRoutes(hub *websocket.Hub, r *gin.RouterGroup) {
+	r.GET("/presence", websocket.HandlePresence(hub))
+}
+
+func addAdminRoutes(b *backends, r *gin.RouterGroup) {
+	admin := r.Group("/admin", auth.RequireRole("admin"))
+	admin.GET("/outbox", amazonwebservices.HandleListOutboxJobs(b.outbox))
+	admin.GET("/outbox/:id", amazonwebservices.HandleGetOutboxJob(b.outbox))
+	admin.POST("/outbox/:id/replay", amazonwebservices.HandleReplayOutboxJob(b.outbox))
+}
+
+func addAuthRoutes(b *backends, r *gin.RouterGroup) {
+	r.POST("/auth/refresh", amazonwebservices.HandleRefreshToken(b.users))
+	r.POST("/auth/logout", amazonwebservices.HandleLogout())
+	r.POST("/auth/logout/all", amazonwebservices.HandleLogoutEverywhere())
+
+	r.POST("/auth/2fa/enroll", amazonwebservices.HandleTOTPEnroll(b.users))
+	r.POST("/auth/2fa/confirm", amazonwebservices.HandleTOTPConfirm(b.users))
+	r.POST("/auth/2fa/verify", amazonwebservices.HandleTOTPVerify(b.users))
+	r.POST("/auth/2fa/disable", amazonwebservices.HandleTOTPDisable(b.users))
+}
+
+func addUserRoutes(b *backends, r *gin.RouterGroup) {
+	r.POST("/users/new", amazonwebservices.HandleUserCreation(b.users))
+	r.POST("/users/login", amazonwebservices.HandleAuthentication(b.users))
+	r.GET("/users/all", amazonwebservices.HandleGetAllUsers(b.users))
+	r.GET("/users/id/:id", amazonwebservices.HandleGetUserById(b.users))
+	r.PUT("/users/update", amazonwebservices.HandleUpdateUser(b.users))
+	r.PUT("/users/update/password", amazonwebservices.HandleUpdateUserPassword(b.users))
+	r.DELETE("/users/id/:id", amazonwebservices.HandleDeleteUserById(b.users))
 
-	r.GET("/users/files", amazonwebservices.HandleGetUserFiles(dynamodbClient))
-	r.DELETE("/users/files/:id", amazonwebservices.HandleDeleteUserFileById(dynamodbClient, s3client))
+	r.GET("/users/files", amazonwebservices.HandleGetUserFiles(b.files))
+	r.DELETE("/users/files/:id", amazonwebservices.HandleDeleteUserFileById(b.files, b.events))
 }
 
-func addRekognitionRoutes(client *rekognition.Client, r *gin.Engine) {
-	r.GET("/analysis/:file", amazonwebservices.HandleFacialAnalysis(client))
+func addRekognitionRoutes(b *backends, client *rekognition.Client, r *gin.RouterGroup) {
+	r.GET("/analysis/:id", amazonwebservices.HandleFacialAnalysis(client, b.files, b.shares, b.store, b.vault))
 }
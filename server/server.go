@@ -1,25 +1,52 @@
 package server
 
 import (
+	"context"
 	"effective-invention/server/amazonwebservices"
-	"effective-invention/server/amazonwebservices/database"
+	"effective-invention/server/amazonwebservices/auth"
 	"effective-invention/server/websocket"
+	"errors"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"runtime/debug"
+	"syscall"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/gin-gonic/gin"
 )
 
-var aws_client aws.Config
-var hub *websocket.Hub
+// shutdownTimeout bounds how long a stopping server waits for requests,
+// sockets and email deliveries in flight.
+const shutdownTimeout = 15 * time.Second
+
+// recovery answers a panicking handler with a 500, like gin.Recovery, but
+// lets http.ErrAbortHandler through to the server, which drops the
+// connection for it. Handlers panic with it to cut a response short.
+func recovery() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
+			log.Printf("Panic serving %s %s: %v\n%s", c.Request.Method, c.Request.URL.Path, err, debug.Stack())
+			c.AbortWithStatus(http.StatusInternalServerError)
+		}()
+		c.Next()
+	}
+}
 
 func ServeGin() {
 	log.Println("Ordering Gin")
 	gin.SetMode(gin.ReleaseMode)
-	r := gin.Default()
+	r := gin.New()
+	r.Use(gin.Logger(), recovery())
 	r.Use(gin.LoggerWithFormatter(func(param gin.LogFormatterParams) string {
 		return fmt.Sprintf("%s - [%s] \"%s %s %s %d %s \"%s\" %s\"\n",
 			param.ClientIP,
@@ -33,33 +60,122 @@ func ServeGin() {
 			param.ErrorMessage,
 		)
 	}))
-	r.Use(gin.Recovery())
 
-	r.GET("/ping", func(c *gin.Context) {
+	auth.InitAuth()
+
+	// every route in the api group needs an access token unless listed here
+	api := r.Group("/")
+	api.Use(auth.Middleware(
+		"/ping",
+		"/users/new",
+		"/users/login",
+		"/auth/refresh",
+		"/auth/2fa/verify",
+		"/s/:token",
+		"/s/:token/verify",
+		"/releases/:id",
+		"/files/:id/content",
+	))
+
+	api.GET("/ping", func(c *gin.Context) {
 		c.String(200, "pong")
 	})
 
-	hub = websocket.NewHub()
+	hub, err := newHub()
+	if err != nil {
+		log.Fatalf("Error configuring websocket hub: %v", err)
+	}
+	go hub.Run()
 
-	r.GET("/ws", func(c *gin.Context) {
-		websocket.HandleWebsocket(hub, c)
-	})
+	// the websocket route authenticates the upgrade itself, because browsers
+	// cannot send the Authorization header
+	r.GET("/ws", websocket.HandleWebsocket(hub, allowedOrigins()))
+
+	b, err := newBackends(r)
+	if err != nil {
+		log.Fatalf("Error configuring backends: %v", err)
+	}
+
+	auth.UseTokenRepository(b.tokens)
+	hub.Policy = amazonwebservices.NewChannelPolicy(b.files, b.shares)
+	hub.Mailbox = b.mailbox
+	hub.Users = b.users
+	b.events.Subscribe(hub.HandleEvent)
 
-	aws_config := amazonwebservices.StartAws()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	dynamodb_client := amazonwebservices.ConnectDB(aws_config)
-	database.CreateFilesTable(dynamodb_client, "files")
-	database.CreateUsersTable(dynamodb_client, "users")
-	s3_client := amazonwebservices.ConnectS3(aws_config)
-	rekognition_client := amazonwebservices.ConnectRekognition(aws_config)
+	outboxDone := make(chan struct{})
+	go func() {
+		b.outbox.Run(ctx)
+		close(outboxDone)
+	}()
 
-	addDynamoDbRoutes(s3_client, dynamodb_client, r)
-	addS3Routes(s3_client, dynamodb_client, r)
-	addRekognitionRoutes(rekognition_client, r)
+	uploader, err := newUploader(b)
+	if err != nil {
+		log.Fatalf("Error configuring uploads: %v", err)
+	}
+	go uploader.Run(ctx)
+
+	trash, err := newTrash(b)
+	if err != nil {
+		log.Fatalf("Error configuring trash: %v", err)
+	}
+	go trash.Run(ctx)
+
+	addAuthRoutes(b, api)
+	addUserRoutes(b, api)
+	addStorageRoutes(b, uploader, api)
+	addUploadRoutes(uploader, api)
+	addVersionRoutes(b, uploader, api)
+	addTrashRoutes(trash, api)
+
+	var matcher amazonwebservices.FaceMatcher
+	if b.s3 {
+		rekognition_client := amazonwebservices.ConnectRekognition(awsConfig())
+		addRekognitionRoutes(b, rekognition_client, api)
+		matcher = amazonwebservices.NewRekognitionMatcher(rekognition_client)
+	}
+	gate, err := newFaceGate(b, matcher)
+	if err != nil {
+		log.Fatalf("Error configuring face gate: %v", err)
+	}
+	addShareRoutes(b, gate, api)
+	addAdminRoutes(b, api)
+	addPresenceRoutes(hub, api)
 
 	baseUrl := os.Getenv("BASE_URL")
 	port := os.Getenv("PORT")
-	config := fmt.Sprintf(":%s", port)
-	log.Printf("Serving Gin at %s:%s", baseUrl, port)
-	r.Run(config)
+	srv := &http.Server{
+		Addr:    fmt.Sprintf(":%s", port),
+		Handler: r,
+	}
+	go func() {
+		log.Printf("Serving Gin at %s:%s", baseUrl, port)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Error serving: %v", err)
+		}
+	}()
+
+	<-ctx.Done()
+	stop()
+	log.Println("Shutting down")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	// stop taking requests first, then drain the sockets, which the HTTP
+	// server no longer tracks once they are upgraded
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Error shutting down HTTP server: %v", err)
+	}
+	if err := hub.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Error closing websockets: %v", err)
+	}
+	select {
+	case <-outboxDone:
+	case <-shutdownCtx.Done():
+		log.Println("Gave up waiting for outbox deliveries")
+	}
+	log.Println("Shutdown complete")
 }
@@ -0,0 +1,232 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// uploadPolicy is what a signed direct upload to a LocalStore allows: one
+// object at Key of exactly Size bytes of ContentType, until Expires. It
+// travels base64 encoded in the "policy" parameter, next to its signature.
+type uploadPolicy struct {
+	Key         string            `json:"key"`
+	Size        int64             `json:"size"`
+	ContentType string            `json:"contentType"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	Expires     int64             `json:"expires"`
+}
+
+func (s *LocalStore) signPolicy(encoded string) string {
+	mac := hmac.New(sha256.New, s.Secret)
+	// the prefix keeps policy signatures from passing as GET signatures
+	fmt.Fprintf(mac, "POLICY\n%s", encoded)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *LocalStore) newPolicy(key string, opts PutOptions, expires time.Duration) (string, *uploadPolicy, error) {
+	cleaned, err := cleanKey(key)
+	if err != nil {
+		return "", nil, err
+	}
+	policy := &uploadPolicy{
+		Key:         cleaned,
+		Size:        opts.Size,
+		ContentType: opts.ContentType,
+		Metadata:    opts.Metadata,
+		Expires:     time.Now().Add(expires).Unix(),
+	}
+	data, err := json.Marshal(policy)
+	if err != nil {
+		return "", nil, err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), policy, nil
+}
+
+// readPolicy checks the signature of an encoded policy and decodes it.
+func (s *LocalStore) readPolicy(encoded, signature string) (*uploadPolicy, error) {
+	if !hmac.Equal([]byte(s.signPolicy(encoded)), []byte(signature)) {
+		return nil, errors.New("invalid signature")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	var policy uploadPolicy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return nil, err
+	}
+	if time.Now().Unix() > policy.Expires {
+		return nil, errors.New("policy has expired")
+	}
+	return &policy, nil
+}
+
+func (s *LocalStore) SignedPut(ctx context.Context, key string, opts PutOptions, expires time.Duration) (*DirectUpload, error) {
+	encoded, policy, err := s.newPolicy(key, opts, expires)
+	if err != nil {
+		return nil, err
+	}
+	q := url.Values{}
+	q.Set("policy", encoded)
+	q.Set("signature", s.signPolicy(encoded))
+
+	return &DirectUpload{
+		Method:    http.MethodPut,
+		URL:       fmt.Sprintf("%s/objects/%s?%s", s.BaseURL, (&url.URL{Path: policy.Key}).EscapedPath(), q.Encode()),
+		Headers:   map[string]string{"Content-Type": policy.ContentType},
+		ExpiresAt: time.Unix(policy.Expires, 0).UTC(),
+	}, nil
+}
+
+func (s *LocalStore) SignedPost(ctx context.Context, key string, opts PutOptions, expires time.Duration) (*DirectUpload, error) {
+	encoded, policy, err := s.newPolicy(key, opts, expires)
+	if err != nil {
+		return nil, err
+	}
+	return &DirectUpload{
+		Method: http.MethodPost,
+		URL:    s.BaseURL + "/objects",
+		Fields: map[string]string{
+			"key":          policy.Key,
+			"Content-Type": policy.ContentType,
+			"policy":       encoded,
+			"signature":    s.signPolicy(encoded),
+		},
+		ExpiresAt: time.Unix(policy.Expires, 0).UTC(),
+	}, nil
+}
+
+// HandleSignedPut accepts uploads for URLs created by SignedPut.
+// Register it as PUT /objects/*key.
+func (s *LocalStore) HandleSignedPut() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := strings.TrimPrefix(c.Param("key"), "/")
+
+		policy, err := s.readPolicy(c.Query("policy"), c.Query("signature"))
+		if err != nil || policy.Key != key {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Upload link is invalid or has expired"})
+			return
+		}
+		if c.Request.ContentLength != policy.Size {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Upload must be exactly %d bytes", policy.Size)})
+			return
+		}
+		if c.GetHeader("Content-Type") != policy.ContentType {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Content-Type must be %s", policy.ContentType)})
+			return
+		}
+
+		body := http.MaxBytesReader(c.Writer, c.Request.Body, policy.Size)
+		err = s.Put(c.Request.Context(), key, body, PutOptions{
+			ContentType: policy.ContentType,
+			Size:        policy.Size,
+			Metadata:    policy.Metadata,
+		})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store upload"})
+			return
+		}
+		c.Status(http.StatusOK)
+	}
+}
+
+// HandleSignedPost accepts form uploads made with the fields from
+// SignedPost. Register it as POST /objects. As with S3, the file must be the
+// last field of the form, so the policy is checked before any of the file
+// is read, and it may only be as large as the policy allows.
+func (s *LocalStore) HandleSignedPost() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		form, err := c.Request.MultipartReader()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid upload form"})
+			return
+		}
+		fields := map[string]string{}
+		var file *multipart.Part
+		for file == nil {
+			part, err := form.NextPart()
+			if errors.Is(err, io.EOF) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to get file from request"})
+				return
+			}
+			if err != nil || len(fields) == maxPostFields {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid upload form"})
+				return
+			}
+			if part.FormName() == "file" {
+				file = part
+				continue
+			}
+			value, err := io.ReadAll(io.LimitReader(part, maxPostField+1))
+			if err != nil || len(value) > maxPostField {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid upload form"})
+				return
+			}
+			fields[part.FormName()] = string(value)
+		}
+
+		policy, err := s.readPolicy(fields["policy"], fields["signature"])
+		if err != nil || policy.Key != fields["key"] {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Upload policy is invalid or has expired"})
+			return
+		}
+		if fields["Content-Type"] != policy.ContentType {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Content-Type must be %s", policy.ContentType)})
+			return
+		}
+
+		err = s.Put(c.Request.Context(), policy.Key, &exactReader{r: file, n: policy.Size}, PutOptions{
+			ContentType: policy.ContentType,
+			Size:        policy.Size,
+			Metadata:    policy.Metadata,
+		})
+		if errors.Is(err, errWrongSize) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Upload must be exactly %d bytes", policy.Size)})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store upload"})
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// A form upload may have at most maxPostFields fields before the file, of
+// at most maxPostField bytes each.
+const (
+	maxPostFields = 16
+	maxPostField  = 16 << 10
+)
+
+var errWrongSize = errors.New("upload is not the size its policy allows")
+
+// exactReader reads from r, failing with errWrongSize unless it holds
+// exactly n bytes.
+type exactReader struct {
+	r io.Reader
+	n int64
+}
+
+func (e *exactReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	e.n -= int64(n)
+	if e.n < 0 || (errors.Is(err, io.EOF) && e.n > 0) {
+		return n, errWrongSize
+	}
+	return n, err
+}
@@ -0,0 +1,328 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// LocalStore keeps objects on disk under Root and issues HMAC signed,
+// expiring URLs that are served by HandleSignedGet.
+type LocalStore struct {
+	Root    string
+	BaseURL string // public URL of the Gin server, e.g. http://localhost:8080
+	Secret  []byte
+}
+
+type localMeta struct {
+	ContentType  string            `json:"contentType"`
+	Size         int64             `json:"size"`
+	ETag         string            `json:"etag"`
+	LastModified time.Time         `json:"lastModified"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+}
+
+func NewLocalStore(root, baseURL string, secret []byte) (*LocalStore, error) {
+	for _, dir := range []string{"objects", "meta", "multipart"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0o755); err != nil {
+			return nil, fmt.Errorf("failed to create local storage dir: %w", err)
+		}
+	}
+	log.Printf("Using local object storage at %s\n", root)
+	return &LocalStore{
+		Root:    root,
+		BaseURL: strings.TrimSuffix(baseURL, "/"),
+		Secret:  secret,
+	}, nil
+}
+
+func cleanKey(key string) (string, error) {
+	cleaned := path.Clean("/" + key)[1:]
+	if cleaned == "" || cleaned != strings.TrimPrefix(key, "/") {
+		return "", fmt.Errorf("invalid object key %q", key)
+	}
+	return cleaned, nil
+}
+
+func (s *LocalStore) objectPath(key string) (string, error) {
+	cleaned, err := cleanKey(key)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(s.Root, "objects", filepath.FromSlash(cleaned)), nil
+}
+
+func (s *LocalStore) metaPath(key string) (string, error) {
+	cleaned, err := cleanKey(key)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(s.Root, "meta", filepath.FromSlash(cleaned)+".json"), nil
+}
+
+func (s *LocalStore) Put(ctx context.Context, key string, body io.Reader, opts PutOptions) error {
+	objPath, err := s.objectPath(key)
+	if err != nil {
+		return err
+	}
+	metaPath, err := s.metaPath(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(objPath), 0o755); err != nil {
+		return fmt.Errorf("failed to create object dir: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(objPath), ".upload-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := md5.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), body)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write object: %w", err)
+	}
+
+	contentType := opts.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	meta := localMeta{
+		ContentType:  contentType,
+		Size:         size,
+		ETag:         hex.EncodeToString(hash.Sum(nil)),
+		LastModified: time.Now().UTC(),
+		Metadata:     opts.Metadata,
+	}
+	if err := writeMeta(metaPath, meta); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), objPath); err != nil {
+		return fmt.Errorf("failed to store object: %w", err)
+	}
+	return nil
+}
+
+func writeMeta(metaPath string, meta localMeta) error {
+	if err := os.MkdirAll(filepath.Dir(metaPath), 0o755); err != nil {
+		return fmt.Errorf("failed to create metadata dir: %w", err)
+	}
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(metaPath, data, 0o644)
+}
+
+func (s *LocalStore) readMeta(key string) (*ObjectInfo, error) {
+	objPath, err := s.objectPath(key)
+	if err != nil {
+		return nil, err
+	}
+	metaPath, err := s.metaPath(key)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := os.Stat(objPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var meta localMeta
+	data, err := os.ReadFile(metaPath)
+	if err == nil {
+		err = json.Unmarshal(data, &meta)
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read object metadata: %w", err)
+	}
+	if meta.ContentType == "" {
+		meta.ContentType = "application/octet-stream"
+	}
+	if meta.LastModified.IsZero() {
+		meta.LastModified = fi.ModTime().UTC()
+	}
+
+	return &ObjectInfo{
+		Key:          key,
+		Size:         fi.Size(),
+		ContentType:  meta.ContentType,
+		ETag:         meta.ETag,
+		LastModified: meta.LastModified,
+		Metadata:     meta.Metadata,
+	}, nil
+}
+
+func (s *LocalStore) Get(ctx context.Context, key string) (*Object, error) {
+	info, err := s.readMeta(key)
+	if err != nil {
+		return nil, err
+	}
+	objPath, _ := s.objectPath(key)
+	f, err := os.Open(objPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Object{ObjectInfo: *info, Body: f}, nil
+}
+
+func (s *LocalStore) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	return s.readMeta(key)
+}
+
+func (s *LocalStore) Delete(ctx context.Context, key string) error {
+	objPath, err := s.objectPath(key)
+	if err != nil {
+		return err
+	}
+	metaPath, _ := s.metaPath(key)
+
+	for _, p := range []string{objPath, metaPath} {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to delete object: %w", err)
+		}
+	}
+	return nil
+}
+
+// listPageSize is how many objects LocalStore.List passes to fn at once.
+const listPageSize = 1000
+
+func (s *LocalStore) List(ctx context.Context, prefix string, fn func(page []ObjectInfo) error) error {
+	root := filepath.Join(s.Root, "objects")
+	page := make([]ObjectInfo, 0, listPageSize)
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		// Put writes to a hidden temp file and renames it into place
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".") {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		info, err := s.readMeta(key)
+		if errors.Is(err, ErrNotFound) {
+			// deleted since the walk found it
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		page = append(page, *info)
+		if len(page) == listPageSize {
+			if err := fn(page); err != nil {
+				return err
+			}
+			page = make([]ObjectInfo, 0, listPageSize)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list objects: %w", err)
+	}
+	if len(page) > 0 {
+		return fn(page)
+	}
+	return nil
+}
+
+func (s *LocalStore) sign(method, key string, expires int64) string {
+	mac := hmac.New(sha256.New, s.Secret)
+	fmt.Fprintf(mac, "%s\n%s\n%d", method, key, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *LocalStore) SignedURL(ctx context.Context, key string, expires time.Duration) (string, error) {
+	cleaned, err := cleanKey(key)
+	if err != nil {
+		return "", err
+	}
+	exp := time.Now().Add(expires).Unix()
+
+	q := url.Values{}
+	q.Set("expires", strconv.FormatInt(exp, 10))
+	q.Set("signature", s.sign(http.MethodGet, cleaned, exp))
+
+	return fmt.Sprintf("%s/objects/%s?%s", s.BaseURL, (&url.URL{Path: cleaned}).EscapedPath(), q.Encode()), nil
+}
+
+func (s *LocalStore) verify(method, key, expires, signature string) bool {
+	exp, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return false
+	}
+	expected := s.sign(method, key, exp)
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
+
+// HandleSignedGet serves objects for URLs created by SignedURL.
+// Register it as GET /objects/*key.
+func (s *LocalStore) HandleSignedGet() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := strings.TrimPrefix(c.Param("key"), "/")
+
+		if !s.verify(http.MethodGet, key, c.Query("expires"), c.Query("signature")) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Link is invalid or has expired"})
+			return
+		}
+
+		obj, err := s.Get(c.Request.Context(), key)
+		if errors.Is(err, ErrNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer obj.Body.Close()
+
+		c.Header("Content-Type", obj.ContentType)
+		if obj.ETag != "" {
+			c.Header("ETag", fmt.Sprintf("%q", obj.ETag))
+		}
+		http.ServeContent(c.Writer, c.Request, path.Base(key), obj.LastModified, obj.Body.(io.ReadSeeker))
+	}
+}
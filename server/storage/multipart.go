@@ -0,0 +1,227 @@
+package storage
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxParts is the most parts one multipart upload may have, the same limit
+// S3 has.
+const MaxParts = 10000
+
+// localUpload is the manifest of a multipart upload in progress. It lives
+// with the parts in Root/multipart/<uploadId>, each part in a part-NNNNN
+// file with its MD5 in part-NNNNN.md5.
+type localUpload struct {
+	Key         string            `json:"key"`
+	ContentType string            `json:"contentType"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	Created     time.Time         `json:"created"`
+}
+
+const manifestName = "upload.json"
+
+func partName(number int) string {
+	return fmt.Sprintf("part-%05d", number)
+}
+
+func (s *LocalStore) uploadDir(uploadId string) (string, error) {
+	// upload IDs are hex, which keeps them from escaping the directory
+	if uploadId == "" || strings.Trim(uploadId, "0123456789abcdef") != "" {
+		return "", ErrNotFound
+	}
+	return filepath.Join(s.Root, "multipart", uploadId), nil
+}
+
+// openUpload returns the directory and manifest of an upload to key.
+func (s *LocalStore) openUpload(key, uploadId string) (string, *localUpload, error) {
+	dir, err := s.uploadDir(uploadId)
+	if err != nil {
+		return "", nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(dir, manifestName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil, ErrNotFound
+	}
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read upload manifest: %w", err)
+	}
+	var upload localUpload
+	if err := json.Unmarshal(data, &upload); err != nil {
+		return "", nil, fmt.Errorf("failed to read upload manifest: %w", err)
+	}
+	if upload.Key != key {
+		return "", nil, ErrNotFound
+	}
+	return dir, &upload, nil
+}
+
+func (s *LocalStore) CreateMultipart(ctx context.Context, key string, opts PutOptions) (string, error) {
+	if _, err := cleanKey(key); err != nil {
+		return "", err
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	uploadId := hex.EncodeToString(b)
+
+	dir, _ := s.uploadDir(uploadId)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", fmt.Errorf("failed to create upload dir: %w", err)
+	}
+	data, err := json.Marshal(localUpload{
+		Key:         key,
+		ContentType: opts.ContentType,
+		Metadata:    opts.Metadata,
+		Created:     time.Now().UTC(),
+	})
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(filepath.Join(dir, manifestName), data, 0o644); err != nil {
+		return "", fmt.Errorf("failed to write upload manifest: %w", err)
+	}
+	return uploadId, nil
+}
+
+func (s *LocalStore) UploadPart(ctx context.Context, key, uploadId string, number int, body io.Reader, size int64) (*Part, error) {
+	if number < 1 || number > MaxParts {
+		return nil, fmt.Errorf("part number must be between 1 and %d", MaxParts)
+	}
+	dir, _, err := s.openUpload(key, uploadId)
+	if err != nil {
+		return nil, err
+	}
+
+	tmp, err := os.CreateTemp(dir, ".part-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := md5.New()
+	written, err := io.Copy(io.MultiWriter(tmp, hash), io.LimitReader(body, size+1))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to write part: %w", err)
+	}
+	if written != size {
+		return nil, fmt.Errorf("part %d is %d bytes, expected %d", number, written, size)
+	}
+
+	part := &Part{
+		Number:       number,
+		Size:         size,
+		ETag:         hex.EncodeToString(hash.Sum(nil)),
+		LastModified: time.Now().UTC(),
+	}
+	name := filepath.Join(dir, partName(number))
+	if err := os.WriteFile(name+".md5", []byte(part.ETag), 0o644); err != nil {
+		return nil, fmt.Errorf("failed to write part checksum: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), name); err != nil {
+		return nil, fmt.Errorf("failed to store part: %w", err)
+	}
+	return part, nil
+}
+
+func (s *LocalStore) ListParts(ctx context.Context, key, uploadId string) ([]Part, error) {
+	dir, _, err := s.openUpload(key, uploadId)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list parts: %w", err)
+	}
+
+	// ReadDir sorts by name, and the zero padding makes that number order
+	var parts []Part
+	for _, entry := range entries {
+		digits, ok := strings.CutPrefix(entry.Name(), "part-")
+		if !ok || strings.Contains(digits, ".") {
+			continue
+		}
+		number, err := strconv.Atoi(digits)
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		etag, _ := os.ReadFile(filepath.Join(dir, entry.Name()+".md5"))
+		parts = append(parts, Part{
+			Number:       number,
+			Size:         info.Size(),
+			ETag:         string(etag),
+			LastModified: info.ModTime().UTC(),
+		})
+	}
+	return parts, nil
+}
+
+func (s *LocalStore) CompleteMultipart(ctx context.Context, key, uploadId string, parts []Part) error {
+	dir, upload, err := s.openUpload(key, uploadId)
+	if err != nil {
+		return err
+	}
+
+	var readers []io.Reader
+	for i, part := range parts {
+		if i > 0 && part.Number <= parts[i-1].Number {
+			return fmt.Errorf("parts must be in ascending order")
+		}
+		name := filepath.Join(dir, partName(part.Number))
+		if part.ETag != "" {
+			etag, err := os.ReadFile(name + ".md5")
+			if err != nil || string(etag) != part.ETag {
+				return fmt.Errorf("part %d does not match its ETag", part.Number)
+			}
+		}
+		f, err := os.Open(name)
+		if errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("part %d was never uploaded", part.Number)
+		}
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		readers = append(readers, f)
+	}
+
+	err = s.Put(ctx, key, io.MultiReader(readers...), PutOptions{
+		ContentType: upload.ContentType,
+		Metadata:    upload.Metadata,
+	})
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+func (s *LocalStore) AbortMultipart(ctx context.Context, key, uploadId string) error {
+	dir, _, err := s.openUpload(key, uploadId)
+	if err != nil {
+		return err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("failed to abort upload: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+var ErrNotFound = errors.New("object not found")
+
+type ObjectInfo struct {
+	Key          string            `json:"key"`
+	Size         int64             `json:"size"`
+	ContentType  string            `json:"contentType"`
+	ETag         string            `json:"etag"`
+	LastModified time.Time         `json:"lastModified"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+}
+
+type Object struct {
+	ObjectInfo
+	Body io.ReadCloser
+}
+
+type PutOptions struct {
+	ContentType string
+	Size        int64 // 0 when unknown
+	Metadata    map[string]string
+}
+
+// ObjectStore is implemented by every storage backend (S3, local disk).
+// Keys are slash separated, e.g. "users/USER_1/FILE_2".
+type ObjectStore interface {
+	Put(ctx context.Context, key string, body io.Reader, opts PutOptions) error
+	Get(ctx context.Context, key string) (*Object, error)
+	Stat(ctx context.Context, key string) (*ObjectInfo, error)
+	Delete(ctx context.Context, key string) error
+	// List calls fn with the objects whose keys start with prefix, a page
+	// at a time, and stops at the first error fn returns. Objects of
+	// multipart uploads show up once the upload is completed.
+	List(ctx context.Context, prefix string, fn func(page []ObjectInfo) error) error
+	SignedURL(ctx context.Context, key string, expires time.Duration) (string, error)
+	// SignedPut and SignedPost let a client upload straight to the store,
+	// without the object passing through this server. The upload must be
+	// exactly opts.Size bytes of opts.ContentType.
+	SignedPut(ctx context.Context, key string, opts PutOptions, expires time.Duration) (*DirectUpload, error)
+	SignedPost(ctx context.Context, key string, opts PutOptions, expires time.Duration) (*DirectUpload, error)
+	MultipartStore
+}
+
+// DirectUpload is a signed request for uploading one object. A PUT sends
+// the object as the body with Headers set; a POST sends a multipart form
+// with Fields followed by the object in a "file" field.
+type DirectUpload struct {
+	Method    string            `json:"method"`
+	URL       string            `json:"url"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Fields    map[string]string `json:"fields,omitempty"`
+	ExpiresAt time.Time         `json:"expiresAt"`
+}
+
+// Part is one stored part of a multipart upload.
+type Part struct {
+	Number       int       `json:"number"`
+	Size         int64     `json:"size"`
+	ETag         string    `json:"etag"`
+	LastModified time.Time `json:"lastModified"`
+}
+
+// MultipartStore writes an object as numbered parts that are sent, and
+// retried, independently and joined in number order on completion. Calls
+// for an upload that does not exist, or was created for another key, return
+// ErrNotFound.
+type MultipartStore interface {
+	// CreateMultipart starts an upload to key and returns its ID.
+	CreateMultipart(ctx context.Context, key string, opts PutOptions) (string, error)
+	// UploadPart stores part number, replacing any earlier upload of it.
+	// size is the exact length of body.
+	UploadPart(ctx context.Context, key, uploadId string, number int, body io.Reader, size int64) (*Part, error)
+	// ListParts returns the parts stored so far, in number order.
+	ListParts(ctx context.Context, key, uploadId string) ([]Part, error)
+	// CompleteMultipart joins parts into the object at key.
+	CompleteMultipart(ctx context.Context, key, uploadId string, parts []Part) error
+	// AbortMultipart discards the upload and every part stored for it.
+	AbortMultipart(ctx context.Context, key, uploadId string) error
+}
@@ -0,0 +1,118 @@
+package websocket
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"sync"
+)
+
+// Envelope kinds, matching how the receiving hub delivers the message.
+const (
+	KindBroadcast = "broadcast" // to every client
+	KindDirect    = "direct"    // to every connection of Msg.Target
+	KindChannel   = "channel"   // to the subscribers of Msg.Channel
+)
+
+// Envelope is a hub message on its way between instances.
+type Envelope struct {
+	Origin string    `json:"origin"` // ID of the hub that sent it
+	Kind   string    `json:"kind"`
+	Msg    WSMessage `json:"msg"`
+}
+
+// Backplane relays messages between the hubs of several server instances,
+// so a client is reached whichever instance it is connected to.
+type Backplane interface {
+	// Publish sends env to the other instances. It is called from the hub
+	// loop and must not block: an implementation that cannot keep up drops
+	// the message.
+	Publish(env Envelope)
+	// Subscribe sets the function that receives envelopes from other
+	// instances. Envelopes the hub sent itself may come back and are
+	// ignored by their Origin.
+	Subscribe(handler func(Envelope))
+	Close() error
+}
+
+func newInstanceID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// relayQueueSize bounds the envelopes waiting to be handed on, per
+// instance, before new ones are dropped.
+const relayQueueSize = 1024
+
+// MemoryBus connects hubs running in the same process, for running several
+// instances side by side in development and tests. Each hub joins with its
+// own Backplane.
+type MemoryBus struct {
+	mu    sync.RWMutex
+	nodes map[*memoryNode]struct{}
+}
+
+func NewMemoryBus() *MemoryBus {
+	return &MemoryBus{nodes: make(map[*memoryNode]struct{})}
+}
+
+// Join attaches a new instance to the bus.
+func (b *MemoryBus) Join() Backplane {
+	n := &memoryNode{
+		bus:   b,
+		queue: make(chan Envelope, relayQueueSize),
+		done:  make(chan struct{}),
+	}
+	b.mu.Lock()
+	b.nodes[n] = struct{}{}
+	b.mu.Unlock()
+	return n
+}
+
+type memoryNode struct {
+	bus       *MemoryBus
+	queue     chan Envelope
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (n *memoryNode) Publish(env Envelope) {
+	n.bus.mu.RLock()
+	defer n.bus.mu.RUnlock()
+	for other := range n.bus.nodes {
+		if other == n {
+			continue
+		}
+		select {
+		case other.queue <- env:
+		default:
+			log.Printf("Backplane queue full, dropping %s message", env.Kind)
+		}
+	}
+}
+
+func (n *memoryNode) Subscribe(handler func(Envelope)) {
+	go func() {
+		for {
+			select {
+			case env := <-n.queue:
+				handler(env)
+			case <-n.done:
+				return
+			}
+		}
+	}()
+}
+
+func (n *memoryNode) Close() error {
+	n.closeOnce.Do(func() {
+		n.bus.mu.Lock()
+		delete(n.bus.nodes, n)
+		n.bus.mu.Unlock()
+		close(n.done)
+	})
+	return nil
+}
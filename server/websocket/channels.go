@@ -0,0 +1,149 @@
+package websocket
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Channel message types. A client subscribes with
+// {"type":"subscribe","channel":"file:<id>"} and is answered with a
+// "subscribed" or "error" frame; "publish" sends content to every
+// subscriber of a channel the sender has joined.
+const (
+	TypeSubscribe    = "subscribe"
+	TypeUnsubscribe  = "unsubscribe"
+	TypePublish      = "publish"
+	TypeSubscribed   = "subscribed"
+	TypeUnsubscribed = "unsubscribed"
+	TypeError        = "error"
+)
+
+// MaxChannelsPerClient bounds the subscriptions of one connection.
+const MaxChannelsPerClient = 100
+
+// policyTimeout bounds a single ChannelPolicy lookup.
+const policyTimeout = 5 * time.Second
+
+// ChannelPolicy decides whether a user may join a channel.
+type ChannelPolicy interface {
+	CanJoin(ctx context.Context, userId, channel string) (bool, error)
+}
+
+// ChannelPolicyFunc adapts a function to ChannelPolicy.
+type ChannelPolicyFunc func(ctx context.Context, userId, channel string) (bool, error)
+
+func (f ChannelPolicyFunc) CanJoin(ctx context.Context, userId, channel string) (bool, error) {
+	return f(ctx, userId, channel)
+}
+
+// subscription asks the hub to add client to channel, or to remove it when
+// join is false. ref is echoed in the reply.
+type subscription struct {
+	client  *Client
+	channel string
+	join    bool
+	ref     string
+}
+
+type publication struct {
+	client *Client
+	msg    WSMessage
+	ref    string
+}
+
+// reply is a frame for a single connection.
+type reply struct {
+	client *Client
+	msg    WSMessage
+}
+
+var errChannelNotAllowed = NewFrameError(ErrCodeForbidden, "channel not allowed")
+
+// handleSubscribe checks the policy on the reading goroutine, so a slow
+// lookup holds up only this connection, and then hands the join to the hub.
+func handleSubscribe(c *Context) error {
+	hub, channel := c.Hub, c.Msg.Channel
+	if hub.Policy == nil {
+		return errChannelNotAllowed
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), policyTimeout)
+	defer cancel()
+	allowed, err := hub.Policy.CanJoin(ctx, c.Client.UserId, channel)
+	if err != nil {
+		log.Printf("Error checking channel %s for user %s: %v", channel, c.Client.UserId, err)
+		return NewFrameError(ErrCodeInternal, "could not check channel access")
+	}
+	if !allowed {
+		return errChannelNotAllowed
+	}
+	send(hub, hub.subscriptions, subscription{client: c.Client, channel: channel, join: true, ref: c.Ref})
+	return nil
+}
+
+func handleUnsubscribe(c *Context) error {
+	send(c.Hub, c.Hub.subscriptions, subscription{client: c.Client, channel: c.Msg.Channel, ref: c.Ref})
+	return nil
+}
+
+func handlePublish(c *Context) error {
+	send(c.Hub, c.Hub.publications, publication{client: c.Client, msg: c.Msg, ref: c.Ref})
+	return nil
+}
+
+func (h *Hub) applySubscription(sub subscription) {
+	c := sub.client
+	if !sub.join {
+		if _, ok := c.channels[sub.channel]; ok {
+			h.leave(c, sub.channel)
+		}
+		h.deliver(c, WSMessage{Type: TypeUnsubscribed, Channel: sub.channel, Ref: sub.ref})
+		return
+	}
+
+	if _, ok := c.channels[sub.channel]; !ok && len(c.channels) >= MaxChannelsPerClient {
+		frame := errorFrame(sub.channel, InvalidPayload("too many channels"))
+		frame.Ref = sub.ref
+		h.deliver(c, frame)
+		return
+	}
+	// the client may have disconnected while the policy was checked
+	if _, ok := h.Clients[c.UserId][c]; !ok {
+		return
+	}
+	if h.Channels[sub.channel] == nil {
+		h.Channels[sub.channel] = make(map[*Client]struct{})
+	}
+	h.Channels[sub.channel][c] = struct{}{}
+	c.channels[sub.channel] = struct{}{}
+	h.deliver(c, WSMessage{Type: TypeSubscribed, Channel: sub.channel, Ref: sub.ref})
+}
+
+func (h *Hub) leave(c *Client, channel string) {
+	delete(c.channels, channel)
+	members := h.Channels[channel]
+	delete(members, c)
+	if len(members) == 0 {
+		delete(h.Channels, channel)
+	}
+}
+
+// publish sends a client's message to the channel's subscribers. Only
+// subscribers may publish.
+func (h *Hub) publish(pub publication) {
+	if _, ok := pub.client.channels[pub.msg.Channel]; !ok {
+		frame := errorFrame(pub.msg.Channel, NewFrameError(ErrCodeForbidden, "not subscribed to channel"))
+		frame.Ref = pub.ref
+		h.deliver(pub.client, frame)
+		return
+	}
+	h.channelLocal(pub.msg)
+	h.relay(KindChannel, pub.msg)
+}
+
+func (h *Hub) channelLocal(msg WSMessage) {
+	for client := range h.Channels[msg.Channel] {
+		h.deliver(client, msg)
+	}
+}
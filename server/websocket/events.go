@@ -0,0 +1,32 @@
+package websocket
+
+import (
+	"effective-invention/server/events"
+	"encoding/json"
+	"log"
+)
+
+// TypeEvent frames carry a domain event to the user it concerns: Content is
+// the event type and Data the whole event.
+const TypeEvent = "event"
+
+// HandleEvent is an events.Handler that pushes each event to every
+// connection of the event's user.
+func (h *Hub) HandleEvent(e events.Event) {
+	if e.UserID == "" {
+		return
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("Error encoding %s event: %v", e.Type, err)
+		return
+	}
+	msg := WSMessage{
+		Type:    TypeEvent,
+		Target:  e.UserID,
+		Content: e.Type,
+		Data:    data,
+	}
+	stamp(&msg)
+	h.sendDirect(msg)
+}
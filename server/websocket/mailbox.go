@@ -0,0 +1,112 @@
+package websocket
+
+import (
+	"context"
+	"effective-invention/server/amazonwebservices/database"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gofrs/uuid"
+)
+
+// TypeAck frames confirm a direct message: {"type":"ack","id":"MSG_..."}.
+// Direct messages are kept in the hub's Mailbox until acknowledged, and
+// replayed on every connection until then, so a client sees each one at
+// least once and should drop duplicates by ID.
+const TypeAck = "ack"
+
+// maxReplay bounds the stored messages sent to a connecting client, keeping
+// the replay well inside its send buffer.
+const maxReplay = 200
+
+// mailboxTimeout bounds a single Mailbox call.
+const mailboxTimeout = 5 * time.Second
+
+// newMessageID returns an ID that sorts in the order it was created, which
+// is what lets a client resume after the last ID it has seen.
+func newMessageID() string {
+	id, err := uuid.NewV7()
+	if err != nil {
+		panic(fmt.Sprintf("websocket: failed to generate message ID: %v", err))
+	}
+	return fmt.Sprintf("MSG_%s", id)
+}
+
+// stamp gives msg its server-assigned ID and timestamp.
+func stamp(msg *WSMessage) {
+	msg.ID = newMessageID()
+	msg.Time = time.Now().UnixMilli()
+}
+
+// sendDirect stores msg for its target, when the hub has a Mailbox, and
+// delivers it to the target's live connections.
+func (h *Hub) sendDirect(msg WSMessage) {
+	if h.Mailbox != nil && msg.Target != "" {
+		if err := h.store(msg); err != nil {
+			log.Printf("Error storing message %s for user %s: %v", msg.ID, msg.Target, err)
+		}
+	}
+	send(h, h.Direct, msg)
+}
+
+func (h *Hub) store(msg WSMessage) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), mailboxTimeout)
+	defer cancel()
+	return h.Mailbox.StoreMessage(ctx, database.PendingMessage{
+		UserID:    msg.Target,
+		ID:        msg.ID,
+		Payload:   payload,
+		CreatedAt: now.Unix(),
+		ExpiresAt: now.Add(h.Retention).Unix(),
+	})
+}
+
+// handleAck takes the acknowledged ID from the frame's own id, which the
+// router passes on as the Context's Ref.
+func handleAck(c *Context) error {
+	if c.Ref == "" {
+		return InvalidPayload("id is required")
+	}
+	if c.Hub.Mailbox == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), mailboxTimeout)
+	defer cancel()
+	if err := c.Hub.Mailbox.AckMessage(ctx, c.Client.UserId, c.Ref); err != nil {
+		return fmt.Errorf("failed to acknowledge message %s: %w", c.Ref, err)
+	}
+	return nil
+}
+
+// replay sends a newly connected client the messages stored for its user
+// after lastSeen, or all of them when lastSeen is empty.
+func (h *Hub) replay(c *Client, lastSeen string) {
+	if h.Mailbox == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), mailboxTimeout)
+	defer cancel()
+	pending, err := h.Mailbox.ListMessages(ctx, c.UserId, lastSeen, maxReplay)
+	if err != nil {
+		log.Printf("Error loading messages for user %s: %v", c.UserId, err)
+		return
+	}
+	for _, p := range pending {
+		var msg WSMessage
+		if err := json.Unmarshal(p.Payload, &msg); err != nil {
+			log.Printf("Error decoding stored message %s: %v", p.ID, err)
+			continue
+		}
+		msg.Replayed = true
+		if !send(h, h.replies, reply{client: c, msg: msg}) {
+			return
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package websocket
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Presence statuses. A user is online while any of their connections is,
+// away when every connection has said so, and offline with none.
+const (
+	StatusOnline  = "online"
+	StatusAway    = "away"
+	StatusOffline = "offline"
+)
+
+// TypePresence frames go both ways: a client sends
+// {"type":"presence","data":{"status":"away"}} to change the status of its
+// connection, and the hub sends a presence frame with a Presence in data to
+// everyone who shares a channel with a user whose status changed.
+const TypePresence = "presence"
+
+// Presence is a user's status as seen by this hub. LastSeen, in unix
+// seconds, is now for connected users and the last disconnect for offline
+// ones; Since is when the current status began.
+type Presence struct {
+	UserID      string `json:"userId"`
+	Status      string `json:"status"`
+	Connections int    `json:"connections"`
+	LastSeen    int64  `json:"lastSeen,omitempty"`
+	Since       int64  `json:"since,omitempty"`
+}
+
+type presenceUpdate struct {
+	Status string `json:"status"`
+}
+
+func (p *presenceUpdate) Validate() error {
+	if p.Status != StatusOnline && p.Status != StatusAway {
+		return fmt.Errorf("status must be %q or %q", StatusOnline, StatusAway)
+	}
+	return nil
+}
+
+// statusChange marks one connection as away or back.
+type statusChange struct {
+	client *Client
+	away   bool
+}
+
+// presenceQuery asks the hub for the status of userIds, or of every
+// connected user when there are none.
+type presenceQuery struct {
+	userIds []string
+	reply   chan []Presence
+}
+
+func handlePresence(c *Context, p presenceUpdate) error {
+	send(c.Hub, c.Hub.statuses, statusChange{client: c.Client, away: p.Status == StatusAway})
+	return nil
+}
+
+// presenceOf computes a user's status from their live connections.
+func (h *Hub) presenceOf(userId string) Presence {
+	clients := h.Clients[userId]
+	p := Presence{UserID: userId, Status: StatusOffline, Connections: len(clients)}
+	if len(clients) == 0 {
+		return p
+	}
+	p.Status = StatusAway
+	for client := range clients {
+		if !client.away {
+			p.Status = StatusOnline
+			break
+		}
+	}
+	p.LastSeen = time.Now().Unix()
+	p.Since = h.since[userId]
+	return p
+}
+
+// audience is everyone who hears about a user's presence: their own
+// connections and every subscriber of a channel they are in.
+func (h *Hub) audience(userId string) map[*Client]struct{} {
+	audience := make(map[*Client]struct{})
+	for client := range h.Clients[userId] {
+		audience[client] = struct{}{}
+		for channel := range client.channels {
+			for member := range h.Channels[channel] {
+				audience[member] = struct{}{}
+			}
+		}
+	}
+	return audience
+}
+
+// changePresence applies change to userId's connections and, when that
+// changes the user's status, tells the audience and records the time. The
+// audience is taken before the change so that members of channels a last
+// connection is leaving still hear it go.
+func (h *Hub) changePresence(userId string, change func()) {
+	before := h.presenceOf(userId)
+	audience := h.audience(userId)
+	change()
+	after := h.presenceOf(userId)
+	if after.Status == before.Status {
+		return
+	}
+
+	now := time.Now().Unix()
+	if after.Status == StatusOffline {
+		delete(h.since, userId)
+		after.LastSeen = now
+	} else {
+		h.since[userId] = now
+		after.Since = now
+	}
+	if before.Status == StatusOffline || after.Status == StatusOffline {
+		go h.touch(userId, now)
+	}
+
+	data, err := json.Marshal(after)
+	if err != nil {
+		log.Printf("Error encoding presence of user %s: %v", userId, err)
+		return
+	}
+	msg := WSMessage{Type: TypePresence, Sender: userId, Data: data}
+	stamp(&msg)
+	for client := range audience {
+		h.deliver(client, msg)
+	}
+}
+
+// touch persists a user's last-seen time.
+func (h *Hub) touch(userId string, at int64) {
+	if h.Users == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), mailboxTimeout)
+	defer cancel()
+	if err := h.Users.UpdateLastSeen(ctx, userId, at); err != nil {
+		log.Printf("Error saving last seen time of user %s: %v", userId, err)
+	}
+}
+
+func (h *Hub) answerPresence(q presenceQuery) {
+	var result []Presence
+	if len(q.userIds) == 0 {
+		for userId := range h.Clients {
+			result = append(result, h.presenceOf(userId))
+		}
+	} else {
+		for _, userId := range q.userIds {
+			result = append(result, h.presenceOf(userId))
+		}
+	}
+	q.reply <- result
+}
+
+// Presence returns the status of the given users, or of every connected
+// user when none are given. Offline users carry their persisted last-seen
+// time when the hub has a user repository.
+func (h *Hub) Presence(ctx context.Context, userIds ...string) ([]Presence, error) {
+	q := presenceQuery{userIds: userIds, reply: make(chan []Presence, 1)}
+	if !send(h, h.queries, q) {
+		return nil, fmt.Errorf("websocket hub is shut down")
+	}
+	var result []Presence
+	select {
+	case result = <-q.reply:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	for i, p := range result {
+		if p.Status != StatusOffline || h.Users == nil {
+			continue
+		}
+		user, err := h.Users.GetUserById(ctx, p.UserID)
+		if err != nil {
+			return nil, err
+		}
+		if user != nil {
+			result[i].LastSeen = user.LastSeenAt
+		}
+	}
+	slices.SortFunc(result, func(a, b Presence) int { return cmp.Compare(a.UserID, b.UserID) })
+	return result, nil
+}
+
+// HandlePresence lists the connected users with their connection counts,
+// or with ?user=<id> (repeatable) the status of those users, including
+// when offline ones were last seen.
+func HandlePresence(hub *Hub) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userIds := c.QueryArray("user")
+		if len(userIds) > 100 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "At most 100 users can be queried at once"})
+			return
+		}
+		presence, err := hub.Presence(c.Request.Context(), userIds...)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error reading presence"})
+			return
+		}
+		if presence == nil {
+			presence = []Presence{}
+		}
+		c.JSON(http.StatusOK, gin.H{"presence": presence})
+	}
+}
@@ -0,0 +1,246 @@
+package websocket
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// maxEnvelopeSize bounds one encoded envelope on the relay wire. Envelopes
+// are newline-delimited JSON.
+const maxEnvelopeSize = 1 << 20
+
+// Relay is a small TCP broker for TCPBackplane: every line a connected
+// instance writes is copied to all the others. One instance can host it
+// next to its HTTP server, which is enough to run several instances on one
+// machine or a handful on a private network.
+type Relay struct {
+	ln    net.Listener
+	mu    sync.Mutex
+	conns map[*relayConn]struct{}
+}
+
+type relayConn struct {
+	conn net.Conn
+	out  chan []byte
+}
+
+// ListenRelay starts a relay on addr, e.g. "127.0.0.1:7070".
+func ListenRelay(addr string) (*Relay, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	r := &Relay{ln: ln, conns: make(map[*relayConn]struct{})}
+	go r.serve()
+	log.Printf("Websocket relay listening on %s", ln.Addr())
+	return r, nil
+}
+
+func (r *Relay) Addr() net.Addr {
+	return r.ln.Addr()
+}
+
+func (r *Relay) serve() {
+	for {
+		conn, err := r.ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Printf("Error accepting relay connection: %v", err)
+			continue
+		}
+		rc := &relayConn{conn: conn, out: make(chan []byte, relayQueueSize)}
+		r.mu.Lock()
+		r.conns[rc] = struct{}{}
+		r.mu.Unlock()
+		go r.read(rc)
+		go rc.write()
+	}
+}
+
+func (r *Relay) read(rc *relayConn) {
+	defer func() {
+		r.mu.Lock()
+		delete(r.conns, rc)
+		r.mu.Unlock()
+		close(rc.out)
+		rc.conn.Close()
+	}()
+
+	scanner := bufio.NewScanner(rc.conn)
+	scanner.Buffer(make([]byte, 64<<10), maxEnvelopeSize)
+	for scanner.Scan() {
+		line := append([]byte(nil), scanner.Bytes()...)
+		r.mu.Lock()
+		for other := range r.conns {
+			if other == rc {
+				continue
+			}
+			select {
+			case other.out <- line:
+			default:
+				log.Printf("Relay peer %s is too slow, dropping a message", other.conn.RemoteAddr())
+			}
+		}
+		r.mu.Unlock()
+	}
+}
+
+func (rc *relayConn) write() {
+	for line := range rc.out {
+		if _, err := rc.conn.Write(append(line, '\n')); err != nil {
+			rc.conn.Close()
+			for range rc.out {
+			}
+			return
+		}
+	}
+}
+
+// Close stops accepting instances and disconnects the connected ones.
+func (r *Relay) Close() error {
+	err := r.ln.Close()
+	r.mu.Lock()
+	for rc := range r.conns {
+		rc.conn.Close()
+	}
+	r.mu.Unlock()
+	return err
+}
+
+// TCPBackplane is a Backplane connected to a Relay. It reconnects when the
+// relay goes away; messages published while disconnected are dropped once
+// the queue is full.
+type TCPBackplane struct {
+	addr    string
+	out     chan Envelope
+	done    chan struct{}
+	once    sync.Once
+	mu      sync.Mutex
+	conn    net.Conn
+	handler func(Envelope)
+}
+
+// DialBackplane connects to the relay at addr in the background.
+func DialBackplane(addr string) *TCPBackplane {
+	b := &TCPBackplane{
+		addr: addr,
+		out:  make(chan Envelope, relayQueueSize),
+		done: make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+func (b *TCPBackplane) Publish(env Envelope) {
+	select {
+	case b.out <- env:
+	default:
+		log.Printf("Backplane queue full, dropping %s message", env.Kind)
+	}
+}
+
+func (b *TCPBackplane) Subscribe(handler func(Envelope)) {
+	b.mu.Lock()
+	b.handler = handler
+	b.mu.Unlock()
+}
+
+func (b *TCPBackplane) Close() error {
+	b.once.Do(func() {
+		close(b.done)
+		b.mu.Lock()
+		if b.conn != nil {
+			b.conn.Close()
+		}
+		b.mu.Unlock()
+	})
+	return nil
+}
+
+func (b *TCPBackplane) closed() bool {
+	select {
+	case <-b.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// run keeps a connection to the relay open, backing off between failed
+// attempts.
+func (b *TCPBackplane) run() {
+	delay := time.Second
+	for !b.closed() {
+		conn, err := net.DialTimeout("tcp", b.addr, 5*time.Second)
+		if err != nil {
+			log.Printf("Error connecting to websocket relay %s: %v", b.addr, err)
+			select {
+			case <-time.After(delay):
+			case <-b.done:
+				return
+			}
+			delay = min(delay*2, 30*time.Second)
+			continue
+		}
+		delay = time.Second
+
+		b.mu.Lock()
+		b.conn = conn
+		b.mu.Unlock()
+		if b.closed() {
+			conn.Close()
+			return
+		}
+
+		log.Printf("Connected to websocket relay %s", b.addr)
+		b.serve(conn)
+		conn.Close()
+	}
+}
+
+// serve writes queued envelopes and reads the relay's until the connection
+// fails.
+func (b *TCPBackplane) serve(conn net.Conn) {
+	stop := make(chan struct{})
+	go func() {
+		defer close(stop)
+		scanner := bufio.NewScanner(conn)
+		scanner.Buffer(make([]byte, 64<<10), maxEnvelopeSize)
+		for scanner.Scan() {
+			var env Envelope
+			if err := json.Unmarshal(scanner.Bytes(), &env); err != nil {
+				log.Printf("Error decoding relay message: %v", err)
+				continue
+			}
+			b.mu.Lock()
+			handler := b.handler
+			b.mu.Unlock()
+			if handler != nil {
+				handler(env)
+			}
+		}
+	}()
+
+	enc := json.NewEncoder(conn)
+	for {
+		select {
+		case env := <-b.out:
+			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := enc.Encode(env); err != nil {
+				log.Printf("Error writing to websocket relay: %v", err)
+				return
+			}
+		case <-stop:
+			return
+		case <-b.done:
+			return
+		}
+	}
+}
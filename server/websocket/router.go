@@ -0,0 +1,247 @@
+package websocket
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+)
+
+// Error codes sent in the error field of "error" frames.
+const (
+	ErrCodeInvalidFrame   = "invalid_frame"   // the frame is not a JSON message
+	ErrCodeUnknownType    = "unknown_type"    // no handler for the frame's type
+	ErrCodeInvalidPayload = "invalid_payload" // the frame's fields or data are wrong
+	ErrCodeForbidden      = "forbidden"
+	ErrCodeRateLimited    = "rate_limited"
+	ErrCodeInternal       = "internal"
+)
+
+// FrameError is a failure reported back to the client. Handlers return one
+// to choose the code the client sees; any other error is logged and
+// reported as ErrCodeInternal.
+type FrameError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *FrameError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+func NewFrameError(code, message string) *FrameError {
+	return &FrameError{Code: code, Message: message}
+}
+
+// InvalidPayload is the FrameError for a frame with missing or bad fields.
+func InvalidPayload(format string, args ...any) *FrameError {
+	return NewFrameError(ErrCodeInvalidPayload, fmt.Sprintf(format, args...))
+}
+
+// errorFrame builds the reply for err. Content repeats the message for
+// clients that only read Content.
+func errorFrame(channel string, err *FrameError) WSMessage {
+	return WSMessage{Type: TypeError, Channel: channel, Content: err.Message, Error: err}
+}
+
+// Context is one incoming frame on its way through middleware to its
+// handler. Handlers run on the connection's reading goroutine, one frame at
+// a time.
+type Context struct {
+	Hub    *Hub
+	Client *Client
+	// Msg is the frame with Sender, ID and Time set by the server.
+	Msg WSMessage
+	// Ref is the ID the client gave the frame, if any, echoed in replies so
+	// the client can match them to its requests.
+	Ref string
+}
+
+// Reply sends msg to this connection only.
+func (c *Context) Reply(msg WSMessage) {
+	msg.Ref = c.Ref
+	send(c.Hub, c.Hub.replies, reply{client: c.Client, msg: msg})
+}
+
+func (c *Context) replyError(err error) {
+	var frameErr *FrameError
+	if !errors.As(err, &frameErr) {
+		log.Printf("Error handling %q frame from user %s: %v", c.Msg.Type, c.Client.UserId, err)
+		frameErr = NewFrameError(ErrCodeInternal, "could not handle message")
+	}
+	c.Reply(errorFrame(c.Msg.Channel, frameErr))
+}
+
+type HandlerFunc func(c *Context) error
+
+// Middleware wraps a handler, to check or limit frames before they reach
+// it.
+type Middleware func(next HandlerFunc) HandlerFunc
+
+// Router maps frame types to handlers. Register handlers and middleware
+// before the hub starts serving; the router is not safe for changes while
+// frames are dispatched.
+type Router struct {
+	routes     map[string]HandlerFunc
+	middleware []Middleware
+}
+
+func NewRouter() *Router {
+	return &Router{routes: make(map[string]HandlerFunc)}
+}
+
+// Use adds middleware that runs for every frame type, outside the
+// middleware given to Handle.
+func (r *Router) Use(mw ...Middleware) {
+	r.middleware = append(r.middleware, mw...)
+}
+
+// Handle registers h for frames of type typ, wrapped in mw. Registering a
+// type twice panics.
+func (r *Router) Handle(typ string, h HandlerFunc, mw ...Middleware) {
+	if _, ok := r.routes[typ]; ok {
+		panic(fmt.Sprintf("websocket: handler for %q registered twice", typ))
+	}
+	r.routes[typ] = chain(h, mw)
+}
+
+// Handle registers a handler whose frames carry a T in their data field.
+// The data is decoded strictly, and when T has a Validate() error method it
+// is called, so h only sees well-formed payloads.
+func Handle[T any](r *Router, typ string, h func(c *Context, payload T) error, mw ...Middleware) {
+	r.Handle(typ, func(c *Context) error {
+		payload, err := decodePayload[T](c.Msg.Data)
+		if err != nil {
+			return err
+		}
+		return h(c, payload)
+	}, mw...)
+}
+
+type validator interface {
+	Validate() error
+}
+
+func decodePayload[T any](data json.RawMessage) (T, error) {
+	var payload T
+	if len(data) == 0 {
+		return payload, InvalidPayload("data is required")
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&payload); err != nil {
+		return payload, InvalidPayload("invalid data: %v", err)
+	}
+	if v, ok := any(&payload).(validator); ok {
+		if err := v.Validate(); err != nil {
+			return payload, InvalidPayload("%v", err)
+		}
+	}
+	return payload, nil
+}
+
+// Types lists the registered frame types.
+func (r *Router) Types() []string {
+	types := make([]string, 0, len(r.routes))
+	for typ := range r.routes {
+		types = append(types, typ)
+	}
+	slices.Sort(types)
+	return types
+}
+
+func chain(h HandlerFunc, mw []Middleware) HandlerFunc {
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+	return h
+}
+
+// dispatch decodes one frame from c and runs its handler, replying with an
+// error frame when anything fails.
+func (r *Router) dispatch(hub *Hub, c *Client, data []byte) {
+	var msg WSMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		ctx := &Context{Hub: hub, Client: c}
+		ctx.replyError(NewFrameError(ErrCodeInvalidFrame, "frame is not a valid JSON message"))
+		return
+	}
+
+	ctx := &Context{Hub: hub, Client: c, Msg: msg, Ref: msg.ID}
+	ctx.Msg.Sender = c.UserId
+	ctx.Msg.Replayed = false
+	ctx.Msg.Error = nil
+	ctx.Msg.Ref = ""
+	stamp(&ctx.Msg)
+
+	h, ok := r.routes[msg.Type]
+	if !ok {
+		ctx.replyError(NewFrameError(ErrCodeUnknownType, fmt.Sprintf("unknown message type %q", msg.Type)))
+		return
+	}
+	if err := chain(h, r.middleware)(ctx); err != nil {
+		ctx.replyError(err)
+	}
+}
+
+// RequireRole rejects frames from users that hold none of the roles.
+func RequireRole(roles ...string) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(c *Context) error {
+			if c.Client.Principal != nil && slices.ContainsFunc(roles, c.Client.Principal.HasRole) {
+				return next(c)
+			}
+			return NewFrameError(ErrCodeForbidden, "insufficient permissions")
+		}
+	}
+}
+
+// tokenBucket allows burst frames at once and perSecond on average.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type rateLimit struct {
+	perSecond float64
+	burst     float64
+}
+
+// RateLimit limits each connection to perSecond frames on average, with
+// bursts of up to burst. Every RateLimit keeps its own budget, so one can
+// guard the whole router and another a single expensive type.
+func RateLimit(perSecond float64, burst int) Middleware {
+	limit := &rateLimit{perSecond: perSecond, burst: float64(burst)}
+	return func(next HandlerFunc) HandlerFunc {
+		return func(c *Context) error {
+			if !c.Client.allow(limit) {
+				return NewFrameError(ErrCodeRateLimited, "too many messages, slow down")
+			}
+			return next(c)
+		}
+	}
+}
+
+// allow takes a token from the client's bucket for limit. It is only called
+// from the client's reading goroutine.
+func (c *Client) allow(limit *rateLimit) bool {
+	if c.limits == nil {
+		c.limits = make(map[*rateLimit]*tokenBucket)
+	}
+	now := time.Now()
+	b, ok := c.limits[limit]
+	if !ok {
+		b = &tokenBucket{tokens: limit.burst, last: now}
+		c.limits[limit] = b
+	}
+	b.tokens = min(limit.burst, b.tokens+now.Sub(b.last).Seconds()*limit.perSecond)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -1,154 +1,531 @@
 package websocket
 
 import (
+	"context"
+	"effective-invention/server/amazonwebservices/auth"
+	"effective-invention/server/amazonwebservices/database"
+	"encoding/json"
+	"errors"
+	"log"
 	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
 )
 
+// TokenProtocol is the subprotocol browsers use to authenticate, since they
+// cannot set headers on an upgrade: new WebSocket(url, ["bearer", token]).
+// The server selects "bearer" and never echoes the token back.
+const TokenProtocol = "bearer"
+
 type WSMessage struct {
-	Type    string `json:"type"`    // broadcast or private
-	Target  string `json:"target"`  // UserId for private messages
-	Content string `json:"content"` // The actual data
-	Sender  string `json:"sender"`  // Set by the server
+	ID       string          `json:"id,omitempty"`       // Set by the server, sortable by time; a client's own id comes back as ref
+	Time     int64           `json:"time,omitempty"`     // Set by the server, unix milliseconds
+	Replayed bool            `json:"replayed,omitempty"` // Sent again from the mailbox
+	Type     string          `json:"type"`               // broadcast, private, or one of the channel types
+	Target   string          `json:"target"`             // UserId for private messages
+	Channel  string          `json:"channel,omitempty"`  // channel name for channel messages
+	Content  string          `json:"content"`            // The actual data
+	Data     json.RawMessage `json:"data,omitempty"`     // structured payload, see Handle
+	Ref      string          `json:"ref,omitempty"`      // in replies, the ID the client gave its frame
+	Error    *FrameError     `json:"error,omitempty"`    // in error frames
+	Sender   string          `json:"sender"`             // Set by the server
 }
 
+// Close codes and reasons sent to clients as the server closes them.
+const (
+	reasonNormal   = "goodbye"
+	reasonSlow     = "client too slow"
+	reasonShutdown = "server shutting down"
+)
+
+// Client is one connection. A user has one per open tab or device.
 type Client struct {
-	UserId string
-	Conn   *websocket.Conn
-	Send   chan WSMessage
+	UserId    string
+	Principal *auth.Principal
+	Conn      *websocket.Conn
+	Send      chan WSMessage
+
+	// channels the client is subscribed to, owned by the hub
+	channels map[string]struct{}
+	// whether the client reported itself away, owned by the hub
+	away bool
+	// rate limit budgets, owned by ReadPump
+	limits map[*rateLimit]*tokenBucket
+
+	// set by the hub before it closes Send, and sent in the close frame
+	closeCode   int
+	closeReason string
 }
 
 type Hub struct {
-	Clients    map[string]*Client
+	// Clients holds every live connection of each user
+	Clients    map[string]map[*Client]struct{}
 	Register   chan *Client
 	Unregister chan *Client
 	Broadcast  chan WSMessage
 	Direct     chan WSMessage
-}
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
+	// Router handles the frames clients send. It comes with the built-in
+	// types registered; add others before the hub starts serving.
+	Router *Router
+
+	// Channels holds the subscribers of each channel, and Policy decides
+	// who may subscribe. With no Policy every subscription is refused.
+	Channels      map[string]map[*Client]struct{}
+	Policy        ChannelPolicy
+	subscriptions chan subscription
+	publications  chan publication
+	replies       chan reply
+
+	// ID names this instance to the Backplane, which relays broadcast,
+	// direct and channel messages to the hubs of the other instances.
+	// Without a Backplane the hub only reaches its own clients.
+	ID        string
+	Backplane Backplane
+	remote    chan Envelope
+
+	// Mailbox keeps direct messages until their recipient acknowledges
+	// them, for Retention. Without one, messages to offline users are lost.
+	Mailbox   database.MailboxRepository
+	Retention time.Duration
+
+	// Users persists last-seen times for presence; since holds when each
+	// connected user's current status began.
+	Users    database.UserRepository
+	since    map[string]int64
+	statuses chan statusChange
+	queries  chan presenceQuery
+
+	PingInterval   time.Duration // how often to ping each client
+	PongWait       time.Duration // how long a client may go without answering, must exceed PingInterval
+	WriteWait      time.Duration // time allowed for a single write
+	MaxMessageSize int64         // largest message accepted from a client, in bytes
+
+	quit     chan struct{} // closed to ask Run to stop
+	done     chan struct{} // closed once Run has closed every client
+	stopOnce sync.Once
+	writers  sync.WaitGroup // WritePumps still draining
 }
 
 func NewHub() *Hub {
 	return &Hub{
-		Clients:    make(map[string]*Client),
-		Register:   make(chan *Client),
-		Unregister: make(chan *Client),
-		Broadcast:  make(chan WSMessage),
-		Direct:     make(chan WSMessage),
+		Clients:        make(map[string]map[*Client]struct{}),
+		Register:       make(chan *Client),
+		Unregister:     make(chan *Client),
+		Broadcast:      make(chan WSMessage),
+		Direct:         make(chan WSMessage),
+		Router:         newBuiltinRouter(),
+		Channels:       make(map[string]map[*Client]struct{}),
+		subscriptions:  make(chan subscription),
+		publications:   make(chan publication),
+		replies:        make(chan reply),
+		ID:             newInstanceID(),
+		remote:         make(chan Envelope),
+		Retention:      7 * 24 * time.Hour,
+		since:          make(map[string]int64),
+		statuses:       make(chan statusChange),
+		queries:        make(chan presenceQuery),
+		PingInterval:   50 * time.Second,
+		PongWait:       60 * time.Second,
+		WriteWait:      10 * time.Second,
+		MaxMessageSize: 32 << 10,
+		quit:           make(chan struct{}),
+		done:           make(chan struct{}),
 	}
 }
 
+// Run owns Clients and every client's Send channel: only Run sends on or
+// closes them, so an evicted client can never be written to after close.
 func (h *Hub) Run() {
+	if h.Backplane != nil {
+		h.Backplane.Subscribe(func(env Envelope) {
+			if env.Origin != h.ID {
+				send(h, h.remote, env)
+			}
+		})
+	}
+
 	for {
 		select {
 		case client := <-h.Register:
-			h.Clients[client.UserId] = client
+			h.changePresence(client.UserId, func() {
+				if h.Clients[client.UserId] == nil {
+					h.Clients[client.UserId] = make(map[*Client]struct{})
+				}
+				h.Clients[client.UserId][client] = struct{}{}
+			})
+			h.writers.Add(1)
+			go func() {
+				defer h.writers.Done()
+				client.WritePump(h)
+			}()
 
 		case client := <-h.Unregister:
-			if _, ok := h.Clients[client.UserId]; ok {
-				delete(h.Clients, client.UserId)
-				close(client.Send)
-			}
+			h.remove(client, websocket.CloseNormalClosure, reasonNormal)
 
 		case msg := <-h.Broadcast:
-			for id, client := range h.Clients {
-				select {
-				case client.Send <- msg:
-				default:
-					close(client.Send)
-					delete(h.Clients, id)
-				}
-			}
+			h.broadcastLocal(msg)
+			h.relay(KindBroadcast, msg)
 
 		case msg := <-h.Direct:
-			if client, ok := h.Clients[msg.Target]; ok {
-				select {
-				case client.Send <- msg:
-				default:
-					close(client.Send)
-					delete(h.Clients, msg.Target)
+			h.directLocal(msg)
+			h.relay(KindDirect, msg)
+
+		case sub := <-h.subscriptions:
+			h.applySubscription(sub)
+
+		case pub := <-h.publications:
+			h.publish(pub)
+
+		case r := <-h.replies:
+			h.deliver(r.client, r.msg)
+
+		case change := <-h.statuses:
+			if _, ok := h.Clients[change.client.UserId][change.client]; ok {
+				h.changePresence(change.client.UserId, func() { change.client.away = change.away })
+			}
+
+		case q := <-h.queries:
+			h.answerPresence(q)
+
+		case env := <-h.remote:
+			switch env.Kind {
+			case KindBroadcast:
+				h.broadcastLocal(env.Msg)
+			case KindDirect:
+				h.directLocal(env.Msg)
+			case KindChannel:
+				h.channelLocal(env.Msg)
+			}
+
+		case <-h.quit:
+			for _, clients := range h.Clients {
+				for client := range clients {
+					h.remove(client, websocket.CloseGoingAway, reasonShutdown)
 				}
 			}
+			close(h.done)
+			return
+		}
+	}
+}
+
+func (h *Hub) broadcastLocal(msg WSMessage) {
+	for _, clients := range h.Clients {
+		for client := range clients {
+			h.deliver(client, msg)
+		}
+	}
+}
+
+func (h *Hub) directLocal(msg WSMessage) {
+	for client := range h.Clients[msg.Target] {
+		h.deliver(client, msg)
+	}
+}
+
+// relay passes a message that originated here to the other instances.
+func (h *Hub) relay(kind string, msg WSMessage) {
+	if h.Backplane != nil {
+		h.Backplane.Publish(Envelope{Origin: h.ID, Kind: kind, Msg: msg})
+	}
+}
+
+// deliver queues msg for client, evicting the client if it has fallen too
+// far behind to keep up. Clients that are already gone are skipped.
+func (h *Hub) deliver(client *Client, msg WSMessage) {
+	if _, ok := h.Clients[client.UserId][client]; !ok {
+		return
+	}
+	select {
+	case client.Send <- msg:
+	default:
+		log.Printf("Evicting slow websocket client of user %s", client.UserId)
+		h.remove(client, websocket.CloseTryAgainLater, reasonSlow)
+	}
+}
+
+// remove forgets client and closes its send channel, which makes its
+// WritePump flush what is queued and send a close frame with code and
+// reason. It is safe to call more than once for the same client.
+func (h *Hub) remove(client *Client, code int, reason string) {
+	if _, ok := h.Clients[client.UserId][client]; !ok {
+		return
+	}
+	h.changePresence(client.UserId, func() {
+		clients := h.Clients[client.UserId]
+		delete(clients, client)
+		if len(clients) == 0 {
+			delete(h.Clients, client.UserId)
+		}
+		for channel := range client.channels {
+			h.leave(client, channel)
+		}
+	})
+	client.closeCode, client.closeReason = code, reason
+	close(client.Send)
+}
+
+// send hands v to Run over ch, giving up once the hub has stopped so
+// callers never block on a hub that is no longer reading.
+func send[T any](h *Hub, ch chan<- T, v T) bool {
+	select {
+	case ch <- v:
+		return true
+	case <-h.done:
+		return false
+	}
+}
+
+// Shutdown closes every connection with a going-away frame, after each has
+// written what was already queued for it, and stops Run. It returns early
+// with ctx's error if the clients have not drained by then.
+func (h *Hub) Shutdown(ctx context.Context) error {
+	h.stopOnce.Do(func() { close(h.quit) })
+	select {
+	case <-h.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if h.Backplane != nil {
+		if err := h.Backplane.Close(); err != nil {
+			log.Printf("Error closing websocket backplane: %v", err)
+		}
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		h.writers.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// newBuiltinRouter returns a router with the frame types every hub
+// understands.
+func newBuiltinRouter() *Router {
+	r := NewRouter()
+	r.Handle("broadcast", handleBroadcast)
+	r.Handle("broadcast_special", handleProcessedBroadcast)
+	r.Handle("private", handlePrivate, requireTarget)
+	r.Handle("private_special", handleProcessedPrivate, requireTarget)
+	r.Handle(TypeSubscribe, handleSubscribe, requireChannel)
+	r.Handle(TypeUnsubscribe, handleUnsubscribe, requireChannel)
+	r.Handle(TypePublish, handlePublish, requireChannel)
+	r.Handle(TypeAck, handleAck)
+	Handle(r, TypePresence, handlePresence)
+	return r
+}
+
+func requireTarget(next HandlerFunc) HandlerFunc {
+	return func(c *Context) error {
+		if c.Msg.Target == "" {
+			return InvalidPayload("target is required")
 		}
+		return next(c)
+	}
+}
+
+func requireChannel(next HandlerFunc) HandlerFunc {
+	return func(c *Context) error {
+		if c.Msg.Channel == "" {
+			return InvalidPayload("channel is required")
+		}
+		return next(c)
 	}
 }
 
 // broadcast to all
-func handleBroadcast(hub *Hub, msg WSMessage) {
-	hub.Broadcast <- msg
+func handleBroadcast(c *Context) error {
+	send(c.Hub, c.Hub.Broadcast, c.Msg)
+	return nil
 }
 
 // process then broadcast
-func handleProcessedBroadcast(hub *Hub, msg WSMessage) {
-	msg.Content = "ALARM: " + msg.Content // Example processing
-	hub.Broadcast <- msg
+func handleProcessedBroadcast(c *Context) error {
+	c.Msg.Content = "ALARM: " + c.Msg.Content // Example processing
+	send(c.Hub, c.Hub.Broadcast, c.Msg)
+	return nil
 }
 
 // broadcast direct to client x
-func handlePrivate(hub *Hub, msg WSMessage) {
-	hub.Direct <- msg
+func handlePrivate(c *Context) error {
+	c.Hub.sendDirect(c.Msg)
+	return nil
 }
 
 // process then broadcast to client x
-func handleProcessedPrivate(hub *Hub, msg WSMessage) {
-	msg.Content = "SECURE MSG: " + msg.Content // Example processing
-	hub.Direct <- msg
+func handleProcessedPrivate(c *Context) error {
+	c.Msg.Content = "SECURE MSG: " + c.Msg.Content // Example processing
+	c.Hub.sendDirect(c.Msg)
+	return nil
 }
 
+// ReadPump reads messages until the connection fails or closes, then
+// unregisters the client. A client that stops answering pings is timed out
+// by the read deadline.
 func (c *Client) ReadPump(hub *Hub) {
 	defer func() {
-		hub.Unregister <- c
+		send(hub, hub.Unregister, c)
 		c.Conn.Close()
 	}()
 
+	// the connection replies to oversized messages with a 1009 close frame
+	c.Conn.SetReadLimit(hub.MaxMessageSize)
+	c.Conn.SetReadDeadline(time.Now().Add(hub.PongWait))
+	c.Conn.SetPongHandler(func(string) error {
+		return c.Conn.SetReadDeadline(time.Now().Add(hub.PongWait))
+	})
+
 	for {
-		var msg WSMessage
-		err := c.Conn.ReadJSON(&msg)
+		_, data, err := c.Conn.ReadMessage()
 		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived) {
+				log.Printf("Websocket of user %s closed: %v", c.UserId, err)
+			}
 			break
 		}
-		msg.Sender = c.UserId
+		hub.Router.dispatch(hub, c, data)
+	}
+}
+
+// WritePump writes queued messages and pings. When the hub closes Send it
+// sends a close frame and closes the connection, which also ends ReadPump.
+func (c *Client) WritePump(hub *Hub) {
+	ticker := time.NewTicker(hub.PingInterval)
+	defer func() {
+		ticker.Stop()
+		c.Conn.Close()
+	}()
 
-		// ROUTING LOGIC
-		switch msg.Type {
-		case "broadcast":
-			handleBroadcast(hub, msg)
-		case "broadcast_special":
-			handleProcessedBroadcast(hub, msg)
-		case "private":
-			handlePrivate(hub, msg)
-		case "private_special":
-			handleProcessedPrivate(hub, msg)
+	for {
+		select {
+		case msg, ok := <-c.Send:
+			if !ok {
+				frame := websocket.FormatCloseMessage(c.closeCode, c.closeReason)
+				c.Conn.WriteControl(websocket.CloseMessage, frame, time.Now().Add(hub.WriteWait))
+				return
+			}
+			c.Conn.SetWriteDeadline(time.Now().Add(hub.WriteWait))
+			if err := c.Conn.WriteJSON(msg); err != nil {
+				return
+			}
+
+		case <-ticker.C:
+			if err := c.Conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(hub.WriteWait)); err != nil {
+				return
+			}
 		}
 	}
 }
 
-func (c *Client) WritePump() {
-	for msg := range c.Send {
-		c.Conn.WriteJSON(msg)
+// CheckOrigin accepts requests whose Origin is in allowed, given as
+// scheme://host[:port]. A "*" entry accepts any origin. Requests without an
+// Origin header come from non-browser clients and are accepted, and with an
+// empty allowlist only same-origin browser requests are.
+func CheckOrigin(allowed []string) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+		u, err := url.Parse(origin)
+		if err != nil || u.Host == "" {
+			return false
+		}
+		if len(allowed) == 0 {
+			return strings.EqualFold(u.Host, r.Host)
+		}
+		origin = strings.ToLower(u.Scheme + "://" + u.Host)
+		return slices.ContainsFunc(allowed, func(a string) bool {
+			return a == "*" || strings.EqualFold(strings.TrimSuffix(a, "/"), origin)
+		})
 	}
 }
 
-func HandleWebsocket(hub *Hub, ctx *gin.Context) {
-	conn, _ := upgrader.Upgrade(ctx.Writer, ctx.Request, nil)
-	userId := ctx.Query("id") // Example: /ws?id=alice
+// upgradeToken finds the access token of an upgrade request, either in the
+// Authorization header or as the protocol after TokenProtocol in
+// Sec-WebSocket-Protocol.
+func upgradeToken(r *http.Request) (string, bool) {
+	if token, ok := auth.BearerToken(r); ok {
+		return token, true
+	}
+	protocols := websocket.Subprotocols(r)
+	i := slices.Index(protocols, TokenProtocol)
+	if i < 0 || i+1 >= len(protocols) || protocols[i+1] == "" {
+		return "", false
+	}
+	return protocols[i+1], true
+}
 
-	client := &Client{
-		UserId: userId,
-		Conn:   conn,
-		Send:   make(chan WSMessage, 256),
+// HandleWebsocket upgrades requests carrying a valid access token and
+// registers the connection under the token's user. allowedOrigins is the
+// Origin allowlist, see CheckOrigin. A client resuming a session passes the
+// last message ID it saw as ?last_seen= and is sent the stored messages
+// after it.
+func HandleWebsocket(hub *Hub, allowedOrigins []string) gin.HandlerFunc {
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		Subprotocols:    []string{TokenProtocol},
+		CheckOrigin:     CheckOrigin(allowedOrigins),
 	}
 
-	hub.Register <- client
+	return func(ctx *gin.Context) {
+		if !upgrader.CheckOrigin(ctx.Request) {
+			ctx.JSON(http.StatusForbidden, gin.H{"error": "Origin not allowed"})
+			return
+		}
 
-	go client.WritePump()
-	go client.ReadPump(hub)
+		token, ok := upgradeToken(ctx.Request)
+		if !ok {
+			ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Access token required"})
+			return
+		}
+		principal, err := auth.Authenticate(ctx.Request.Context(), token)
+		if errors.Is(err, auth.ErrInvalidToken) || errors.Is(err, auth.ErrTokenRevoked) {
+			ctx.JSON(http.StatusUnauthorized, gin.H{"error": "Access token is invalid or expired"})
+			return
+		}
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "Error checking access token"})
+			return
+		}
+
+		// Upgrade has already written an HTTP error when it fails
+		conn, err := upgrader.Upgrade(ctx.Writer, ctx.Request, nil)
+		if err != nil {
+			log.Printf("Error upgrading websocket for user %s: %v", principal.UserID, err)
+			return
+		}
+
+		client := &Client{
+			UserId:    principal.UserID,
+			Principal: principal,
+			Conn:      conn,
+			Send:      make(chan WSMessage, 256),
+			channels:  make(map[string]struct{}),
+		}
+
+		if !send(hub, hub.Register, client) {
+			frame := websocket.FormatCloseMessage(websocket.CloseGoingAway, reasonShutdown)
+			conn.WriteControl(websocket.CloseMessage, frame, time.Now().Add(hub.WriteWait))
+			conn.Close()
+			return
+		}
+		go hub.replay(client, ctx.Query("last_seen"))
+		go client.ReadPump(hub)
+	}
 }